@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/kilowatt-/ImageRepository/routes/images"
+	"log"
+	"os"
+)
+
+/**
+Runs the audit subcommand, which checks the images collection against blob storage and prints every problem found.
+
+Flags:
+	- fix: repair the problems found, instead of only reporting them.
+
+Exits with status 1 if any problem was left unrepaired.
+*/
+func runAudit(args []string) {
+	auditFlags := flag.NewFlagSet("audit", flag.ExitOnError)
+	fix := auditFlags.Bool("fix", false, "repair the problems found")
+
+	_ = auditFlags.Parse(args)
+
+	report, err := images.Audit(*fix)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	unresolved := 0
+
+	for _, k := range report.Issues {
+		status := "found"
+
+		if k.Fixed {
+			status = "fixed"
+		} else if k.FixErr != nil {
+			status = "fix failed: " + k.FixErr.Error()
+		}
+
+		if !k.Fixed {
+			unresolved++
+		}
+
+		fmt.Printf("%s\timage=%s\tkey=%s\t%s\t(%s)\n", k.Kind, k.ImageID, k.Key, k.Detail, status)
+	}
+
+	fmt.Printf("checked %d images and %d objects: %d problems, %d unresolved\n",
+		report.ImagesChecked, report.ObjectsChecked, len(report.Issues), unresolved)
+
+	if unresolved > 0 {
+		os.Exit(1)
+	}
+}
@@ -200,6 +200,81 @@ func Find(collectionName string, filter interface{}, opts *options.FindOptions)
 	return &FindResponse{nil, errors.New("MongoDB client not initialized yet")}
 }
 
+/**
+Runs an aggregation pipeline on the given collection and returns the resulting documents.
+*/
+func Aggregate(collectionName string, pipeline interface{}, opts *options.AggregateOptions) *FindResponse {
+	if client != nil {
+		if opts == nil {
+			opts = &options.AggregateOptions{}
+		}
+
+		var result []bson.M
+
+		collection := client.Database(dbName).Collection(collectionName)
+
+		cursor, err := collection.Aggregate(context.Background(), pipeline, opts)
+
+		if err != nil {
+			return &FindResponse{nil, err}
+		}
+
+		if err := cursor.All(context.Background(), &result); err != nil {
+			return &FindResponse{nil, err}
+		}
+
+		return &FindResponse{result, nil}
+	}
+
+	return &FindResponse{nil, errors.New("MongoDB client not initialized yet")}
+}
+
+/**
+Creates an index on the given collection if it does not exist yet.
+*/
+func CreateIndex(collectionName string, keys bson.D, opts *options.IndexOptions) error {
+	if client != nil {
+		if opts == nil {
+			opts = &options.IndexOptions{}
+		}
+
+		collection := client.Database(dbName).Collection(collectionName)
+
+		_, err := collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{Keys: keys, Options: opts})
+
+		return err
+	}
+
+	return errors.New("MongoDB client not initialized yet")
+}
+
+/**
+Runs several writes on the given collection in one request. Used for batches of upserts.
+*/
+func BulkWrite(collectionName string, models []mongo.WriteModel, opts *options.BulkWriteOptions) *UpdateResponse {
+	if client != nil {
+		if opts == nil {
+			opts = &options.BulkWriteOptions{}
+		}
+
+		collection := client.Database(dbName).Collection(collectionName)
+
+		result, err := collection.BulkWrite(context.Background(), models, opts)
+
+		if err != nil {
+			return &UpdateResponse{0, 0, err}
+		}
+
+		return &UpdateResponse{
+			Modified: result.ModifiedCount + result.UpsertedCount,
+			Matched:  result.MatchedCount,
+			Err:      nil,
+		}
+	}
+
+	return &UpdateResponse{Modified: 0, Matched: 0, Err: errors.New("MongoDB client not initialized yet")}
+}
+
 func Disconnect() error {
 	if client != nil {
 		if err := client.Disconnect(context.TODO()); err != nil {
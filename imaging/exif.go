@@ -0,0 +1,285 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+)
+
+const exifHeader = "Exif\x00\x00"
+
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+const tagMake = 0x010F
+const tagModel = 0x0110
+const tagOrientation = 0x0112
+const tagDateTime = 0x0132
+const tagExifIFD = 0x8769
+const tagDateTimeOriginal = 0x9003
+
+const typeASCII = 2
+const typeShort = 3
+const typeLong = 4
+
+var errMalformedExif = errors.New("malformed EXIF data")
+
+// A parsed TIFF image file directory entry.
+type tiffEntry struct {
+	tag        uint16
+	valueType  uint16
+	count      uint32
+	valueBytes []byte
+}
+
+// A minimal reader for the TIFF structure inside an EXIF block.
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newTIFFReader(data []byte) (*tiffReader, error) {
+	if len(data) < 8 {
+		return nil, errMalformedExif
+	}
+
+	var order binary.ByteOrder
+
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errMalformedExif
+	}
+
+	if order.Uint16(data[2:4]) != 42 {
+		return nil, errMalformedExif
+	}
+
+	return &tiffReader{data: data, order: order}, nil
+}
+
+// Returns the offset of the first image file directory.
+func (t *tiffReader) firstIFD() uint32 {
+	return t.order.Uint32(t.data[4:8])
+}
+
+// Reads the entries of the directory at the given offset.
+func (t *tiffReader) readIFD(offset uint32) ([]tiffEntry, error) {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil, errMalformedExif
+	}
+
+	count := int(t.order.Uint16(t.data[offset : offset+2]))
+	start := int(offset) + 2
+
+	if start+count*12 > len(t.data) {
+		return nil, errMalformedExif
+	}
+
+	entries := make([]tiffEntry, 0, count)
+
+	for i := 0; i < count; i++ {
+		raw := t.data[start+i*12 : start+(i+1)*12]
+
+		entry := tiffEntry{
+			tag:       t.order.Uint16(raw[0:2]),
+			valueType: t.order.Uint16(raw[2:4]),
+			count:     t.order.Uint32(raw[4:8]),
+		}
+
+		size := uint64(typeSize(entry.valueType)) * uint64(entry.count)
+
+		if size <= 4 {
+			entry.valueBytes = raw[8 : 8+size]
+		} else {
+			valueOffset := uint64(t.order.Uint32(raw[8:12]))
+
+			if valueOffset+size > uint64(len(t.data)) {
+				continue
+			}
+
+			entry.valueBytes = t.data[valueOffset : valueOffset+size]
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Returns the first value of a SHORT entry.
+func (t *tiffReader) short(entry tiffEntry) (uint16, bool) {
+	if entry.valueType != typeShort || len(entry.valueBytes) < 2 {
+		return 0, false
+	}
+
+	return t.order.Uint16(entry.valueBytes), true
+}
+
+// Returns the size in bytes of a single value of the given TIFF type.
+func typeSize(valueType uint16) int {
+	switch valueType {
+	case 1, 2, 6, 7:
+		return 1
+	case 3, 8:
+		return 2
+	case 4, 9, 11:
+		return 4
+	case 5, 10, 12:
+		return 8
+	}
+
+	return 0
+}
+
+// Returns the value of an ASCII entry without its NUL terminator.
+func (t *tiffReader) ascii(entry tiffEntry) (string, bool) {
+	if entry.valueType != typeASCII {
+		return "", false
+	}
+
+	return strings.TrimSpace(strings.TrimRight(string(entry.valueBytes), "\x00")), true
+}
+
+// Returns the first value of a LONG entry.
+func (t *tiffReader) long(entry tiffEntry) (uint32, bool) {
+	if entry.valueType != typeLong || len(entry.valueBytes) < 4 {
+		return 0, false
+	}
+
+	return t.order.Uint32(entry.valueBytes), true
+}
+
+// The non-sensitive parts of an image's EXIF data. GPS data and serial numbers are deliberately not read.
+type ExifSummary struct {
+	Orientation int
+	TakenAt     time.Time
+	CameraMake  string
+	CameraModel string
+}
+
+/**
+Reads an EXIF summary from a JPEG, PNG or WebP file.
+
+EXIF timestamps carry no time zone, so capture times are interpreted as UTC. Returns an upright, empty summary if the
+file has no readable EXIF data.
+*/
+func ReadExif(data []byte, contentType string) ExifSummary {
+	summary := ExifSummary{Orientation: 1}
+
+	tiff := findExif(data, contentType)
+
+	if tiff == nil {
+		return summary
+	}
+
+	reader, err := newTIFFReader(tiff)
+
+	if err != nil {
+		return summary
+	}
+
+	entries, err := reader.readIFD(reader.firstIFD())
+
+	if err != nil {
+		return summary
+	}
+
+	var modified time.Time
+
+	for _, k := range entries {
+		switch k.tag {
+		case tagOrientation:
+			if orientation, ok := reader.short(k); ok && orientation >= 1 && orientation <= 8 {
+				summary.Orientation = int(orientation)
+			}
+		case tagMake:
+			summary.CameraMake, _ = reader.ascii(k)
+		case tagModel:
+			summary.CameraModel, _ = reader.ascii(k)
+		case tagDateTime:
+			if value, ok := reader.ascii(k); ok {
+				modified, _ = time.Parse(exifTimeLayout, value)
+			}
+		case tagExifIFD:
+			offset, ok := reader.long(k)
+
+			if !ok {
+				continue
+			}
+
+			exifEntries, exifErr := reader.readIFD(offset)
+
+			if exifErr != nil {
+				continue
+			}
+
+			for _, e := range exifEntries {
+				if e.tag == tagDateTimeOriginal {
+					if value, ok := reader.ascii(e); ok {
+						summary.TakenAt, _ = time.Parse(exifTimeLayout, value)
+					}
+				}
+			}
+		}
+	}
+
+	// Fall back to the file modification time if the camera did not record the capture time.
+	if summary.TakenAt.IsZero() {
+		summary.TakenAt = modified
+	}
+
+	return summary
+}
+
+// Returns the TIFF block holding the EXIF data of an image, or nil if there is none.
+func findExif(data []byte, contentType string) []byte {
+	switch contentType {
+	case "image/jpeg":
+		segments, _, err := splitJPEG(data)
+
+		if err != nil {
+			return nil
+		}
+
+		for _, k := range segments {
+			if k.marker != 0xE1 {
+				continue
+			}
+
+			if payload := data[k.start+4 : k.end]; bytes.HasPrefix(payload, []byte(exifHeader)) {
+				return payload[len(exifHeader):]
+			}
+		}
+	case "image/png":
+		return findPNGChunk(data, "eXIf")
+	case "image/webp":
+		if chunk := findWebPChunk(data, "EXIF"); chunk != nil {
+			return bytes.TrimPrefix(chunk, []byte(exifHeader))
+		}
+	}
+
+	return nil
+}
+
+/**
+Builds an EXIF block (including the "Exif" header) that contains nothing but the orientation tag.
+*/
+func buildOrientationExif(orientation int) []byte {
+	block := []byte(exifHeader)
+
+	// Big-endian TIFF header with the first directory directly after it.
+	block = append(block, 'M', 'M', 0, 42, 0, 0, 0, 8)
+
+	// One entry: orientation, SHORT, count 1, value left-aligned in the 4 byte value field.
+	block = append(block, 0, 1)
+	block = append(block, byte(tagOrientation>>8), byte(tagOrientation&0xff), 0, typeShort, 0, 0, 0, 1)
+	block = append(block, byte(orientation>>8), byte(orientation&0xff), 0, 0)
+
+	// No further directories.
+	return append(block, 0, 0, 0, 0)
+}
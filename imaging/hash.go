@@ -0,0 +1,39 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"math/bits"
+)
+
+/**
+Computes a 64-bit difference hash (dHash) of the image.
+
+The image is shrunk to 9x8 greyscale pixels and each bit records whether a pixel is brighter than its right-hand
+neighbour. Visually similar images produce hashes with a small Hamming distance, regardless of size or compression.
+*/
+func DifferenceHash(img image.Image) uint64 {
+	small := Scale(img, 9, 8)
+
+	var hash uint64
+
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := color.GrayModel.Convert(small.At(x, y)).(color.Gray).Y
+			right := color.GrayModel.Convert(small.At(x+1, y)).(color.Gray).Y
+
+			hash <<= 1
+
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
+
+// Returns the number of bits that differ between two hashes.
+func HammingDistance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
@@ -0,0 +1,300 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/image/draw"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strconv"
+
+	// Register the remaining upload formats with image.Decode.
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+)
+
+const jpegQuality = 85
+
+// Largest image, in pixels, that Decode accepts. Decoded images take 4 bytes per pixel, so this caps one at 160MB.
+const MaxPixels = 40000000
+
+// Largest width or height that Fit scales an image to, including the size it scales to before cropping in cover mode.
+const MaxFitDimension = 4096
+
+var ErrCropOutOfBounds = errors.New("crop rectangle is outside the image")
+var ErrFitTooLarge = errors.New("the resized image would be larger than " + strconv.Itoa(MaxFitDimension) + " pixels on a side or " + strconv.Itoa(MaxPixels) + " pixels in total")
+var ErrTooManyPixels = errors.New("image has more than " + strconv.Itoa(MaxPixels) + " pixels")
+var errUnsupportedFormat = errors.New("unsupported output format")
+
+/**
+Decodes an image of any accepted upload format.
+
+The dimensions are read from the header first, and images larger than MaxPixels are refused with ErrTooManyPixels
+before any pixel data is allocated, since a small file can claim to be enormous.
+
+Returns the image and the format name reported by the decoder (e.g. "jpeg", "png", "webp").
+*/
+func Decode(data []byte) (image.Image, string, error) {
+	config, _, err := DecodeConfig(data)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if int64(config.Width)*int64(config.Height) > MaxPixels {
+		return nil, "", ErrTooManyPixels
+	}
+
+	return image.Decode(bytes.NewReader(data))
+}
+
+/**
+Reads the dimensions and format of an image without decoding the pixel data.
+*/
+func DecodeConfig(data []byte) (image.Config, string, error) {
+	return image.DecodeConfig(bytes.NewReader(data))
+}
+
+/**
+Turns the image the right way up according to its EXIF orientation (1-8).
+*/
+func ApplyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// Orientations 5-8 are stored rotated by 90 degrees, so the displayed image is transposed.
+	transposed := orientation >= 5
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	if transposed {
+		dst = image.NewRGBA(image.Rect(0, 0, height, width))
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+
+			switch orientation {
+			case 2:
+				dx, dy = width-1-x, y
+			case 3:
+				dx, dy = width-1-x, height-1-y
+			case 4:
+				dx, dy = x, height-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = height-1-y, x
+			case 7:
+				dx, dy = height-1-y, width-1-x
+			case 8:
+				dx, dy = y, width-1-x
+			}
+
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+
+	return dst
+}
+
+// Returns the length of the longest edge of the image.
+func LongEdge(img image.Image) int {
+	bounds := img.Bounds()
+
+	if bounds.Dx() > bounds.Dy() {
+		return bounds.Dx()
+	}
+
+	return bounds.Dy()
+}
+
+/**
+Scales the image down so that its longest edge is at most longEdge pixels, preserving the aspect ratio.
+
+Images that are already small enough are returned unchanged; images are never scaled up.
+*/
+func Resize(img image.Image, longEdge int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if longEdge <= 0 || LongEdge(img) <= longEdge {
+		return img
+	}
+
+	if width >= height {
+		height = maxInt(1, height*longEdge/width)
+		width = longEdge
+	} else {
+		width = maxInt(1, width*longEdge/height)
+		height = longEdge
+	}
+
+	return Scale(img, width, height)
+}
+
+// Scales the image to exactly width x height pixels.
+func Scale(img image.Image, width int, height int) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	return dst
+}
+
+/**
+Picks the format that derived images of a source format should be encoded in.
+
+JPEG sources stay JPEG; everything else becomes PNG so that transparency survives.
+*/
+func OutputFormatFor(sourceFormat string) string {
+	if sourceFormat == "jpeg" {
+		return "jpeg"
+	}
+
+	return "png"
+}
+
+// Returns the MIME type of an output format.
+func ContentTypeFor(format string) string {
+	return "image/" + format
+}
+
+// Encodes the image in the given format ("jpeg", "png" or "gif").
+func Encode(img image.Image, format string) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+
+	var err error
+
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: jpegQuality})
+	case "png":
+		err = png.Encode(buf, img)
+	case "gif":
+		err = gif.Encode(buf, img, nil)
+	default:
+		err = errUnsupportedFormat
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+/**
+Copies the given rectangle out of the image.
+
+Returns an error if the rectangle does not lie entirely within the image.
+*/
+func Crop(img image.Image, rect image.Rectangle) (image.Image, error) {
+	rect = rect.Add(img.Bounds().Min)
+
+	if rect.Empty() || !rect.In(img.Bounds()) {
+		return nil, ErrCropOutOfBounds
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, rect.Min, draw.Src)
+
+	return dst, nil
+}
+
+// Rotates the image clockwise by the given number of degrees, which must be a multiple of 90.
+func Rotate(img image.Image, degrees int) (image.Image, error) {
+	degrees = ((degrees % 360) + 360) % 360
+
+	if degrees%90 != 0 {
+		return nil, errors.New("rotation must be a multiple of 90 degrees")
+	}
+
+	// Clockwise rotations are the matching EXIF orientations.
+	switch degrees {
+	case 90:
+		return ApplyOrientation(img, 6), nil
+	case 180:
+		return ApplyOrientation(img, 3), nil
+	case 270:
+		return ApplyOrientation(img, 8), nil
+	}
+
+	return img, nil
+}
+
+/**
+Resizes the image to fill a width x height box.
+
+With cover, the image is scaled to cover the whole box and the overflow is cropped from the centre, so the result is
+exactly width x height. Otherwise (contain) the image is scaled to fit inside the box and keeps its aspect ratio.
+
+A width or height of 0 means that dimension is derived from the aspect ratio.
+
+Returns ErrFitTooLarge, before anything is allocated, if a side of the image it would scale to is larger than
+MaxFitDimension or its area is larger than MaxPixels. With an extreme aspect ratio, a derived side can be far larger
+than the one asked for.
+*/
+func Fit(img image.Image, width int, height int, cover bool) (image.Image, error) {
+	bounds := img.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+
+	if width <= 0 && height <= 0 {
+		return img, nil
+	}
+
+	if width <= 0 {
+		width = maxInt(1, srcWidth*height/srcHeight)
+	} else if height <= 0 {
+		height = maxInt(1, srcHeight*width/srcWidth)
+	} else if !cover {
+		// Scale by whichever side is more constrained.
+		if srcWidth*height > srcHeight*width {
+			height = maxInt(1, srcHeight*width/srcWidth)
+		} else {
+			width = maxInt(1, srcWidth*height/srcHeight)
+		}
+	} else {
+		scaledWidth, scaledHeight := width, height
+
+		if srcWidth*height > srcHeight*width {
+			scaledWidth = maxInt(width, srcWidth*height/srcHeight)
+		} else {
+			scaledHeight = maxInt(height, srcHeight*width/srcWidth)
+		}
+
+		if !fitsBudget(scaledWidth, scaledHeight) {
+			return nil, ErrFitTooLarge
+		}
+
+		scaled := Scale(img, scaledWidth, scaledHeight)
+		offset := image.Pt((scaledWidth-width)/2, (scaledHeight-height)/2)
+
+		return Crop(scaled, image.Rectangle{Min: offset, Max: offset.Add(image.Pt(width, height))})
+	}
+
+	if !fitsBudget(width, height) {
+		return nil, ErrFitTooLarge
+	}
+
+	return Scale(img, width, height), nil
+}
+
+// Reports whether Fit may allocate an image of the given size.
+func fitsBudget(width int, height int) bool {
+	return width <= MaxFitDimension && height <= MaxFitDimension && int64(width)*int64(height) <= MaxPixels
+}
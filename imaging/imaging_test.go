@@ -0,0 +1,52 @@
+package imaging
+
+import (
+	"image"
+	"testing"
+)
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		name         string
+		srcWidth     int
+		srcHeight    int
+		width        int
+		height       int
+		cover        bool
+		wantWidth    int
+		wantHeight   int
+		wantTooLarge bool
+	}{
+		{"contain by width", 400, 200, 100, 0, false, 100, 50, false},
+		{"contain in box", 400, 200, 100, 100, false, 100, 50, false},
+		{"cover", 400, 200, 100, 100, true, 100, 100, false},
+		{"tall image by width", 1, 4000, 4096, 0, false, 0, 0, true},
+		{"wide image by height", 4000, 1, 0, 4096, false, 0, 0, true},
+		{"tall image in cover box", 1, 4000, 4096, 1, true, 0, 0, true},
+		{"wide image in cover box", 4000, 1, 1, 4096, true, 0, 0, true},
+		{"derived side at the limit", 1, 2, 2048, 0, false, 2048, 4096, false},
+		{"derived side past the limit", 1, 2, 2049, 0, false, 0, 0, true},
+	}
+
+	for _, k := range tests {
+		img := image.NewRGBA(image.Rect(0, 0, k.srcWidth, k.srcHeight))
+
+		fitted, err := Fit(img, k.width, k.height, k.cover)
+
+		if k.wantTooLarge {
+			if err != ErrFitTooLarge {
+				t.Errorf("%s: Fit returned %v; want ErrFitTooLarge", k.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: Fit returned %v", k.name, err)
+			continue
+		}
+
+		if size := fitted.Bounds().Size(); size.X != k.wantWidth || size.Y != k.wantHeight {
+			t.Errorf("%s: Fit returned %dx%d; want %dx%d", k.name, size.X, size.Y, k.wantWidth, k.wantHeight)
+		}
+	}
+}
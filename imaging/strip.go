@@ -0,0 +1,317 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+var errMalformedJPEG = errors.New("malformed JPEG file")
+var errMalformedPNG = errors.New("malformed PNG file")
+var errMalformedWebP = errors.New("malformed WebP file")
+
+// PNG chunks that carry EXIF, XMP, free-form text or timestamps.
+var strippedPNGChunks = map[string]bool{
+	"eXIf": true,
+	"iTXt": true,
+	"tEXt": true,
+	"zTXt": true,
+	"tIME": true,
+}
+
+/**
+Removes privacy-sensitive metadata (EXIF, XMP, IPTC and comments) from an image without re-encoding it.
+
+JPEG, PNG and WebP files are rewritten; every other content type is returned unchanged. The EXIF orientation of a
+JPEG is kept so that the image still displays the right way up.
+*/
+func StripMetadata(data []byte, contentType string) ([]byte, error) {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEG(data)
+	case "image/png":
+		return stripPNG(data)
+	case "image/webp":
+		return stripWebP(data)
+	}
+
+	return data, nil
+}
+
+// A marker segment in the header of a JPEG file.
+type jpegSegment struct {
+	marker byte
+	start  int
+	end    int
+}
+
+/**
+Splits the header of a JPEG file into its marker segments, up to and including the start of scan.
+
+Returns the segments and the offset where the entropy-coded image data begins.
+*/
+func splitJPEG(data []byte) ([]jpegSegment, int, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, 0, errMalformedJPEG
+	}
+
+	segments := []jpegSegment{}
+	pos := 2
+
+	for pos < len(data) {
+		if data[pos] != 0xFF {
+			return nil, 0, errMalformedJPEG
+		}
+
+		// Skip fill bytes.
+		for pos+1 < len(data) && data[pos+1] == 0xFF {
+			pos++
+		}
+
+		if pos+1 >= len(data) {
+			return nil, 0, errMalformedJPEG
+		}
+
+		marker := data[pos+1]
+
+		if marker == 0xD9 {
+			return segments, pos, nil
+		}
+
+		// Standalone markers carry no length.
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			segments = append(segments, jpegSegment{marker, pos, pos + 2})
+			pos += 2
+			continue
+		}
+
+		if pos+4 > len(data) {
+			return nil, 0, errMalformedJPEG
+		}
+
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:pos+4]))
+
+		if end > len(data) || end < pos+4 {
+			return nil, 0, errMalformedJPEG
+		}
+
+		segments = append(segments, jpegSegment{marker, pos, end})
+		pos = end
+
+		// Everything after the start of scan is entropy-coded image data.
+		if marker == 0xDA {
+			return segments, pos, nil
+		}
+	}
+
+	return nil, 0, errMalformedJPEG
+}
+
+/**
+Drops APP1 (EXIF and XMP), APP13 (IPTC) and COM segments from a JPEG file.
+*/
+func stripJPEG(data []byte) ([]byte, error) {
+	segments, imageData, err := splitJPEG(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	orientation := ReadExif(data, "image/jpeg").Orientation
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	wroteOrientation := false
+
+	for _, k := range segments {
+		if k.marker == 0xE1 || k.marker == 0xED || k.marker == 0xFE {
+			continue
+		}
+
+		// Readers expect EXIF directly after the JFIF header, or first if there is none.
+		if k.marker != 0xE0 && !wroteOrientation {
+			writeOrientationSegment(out, orientation)
+			wroteOrientation = true
+		}
+
+		out.Write(data[k.start:k.end])
+	}
+
+	out.Write(data[imageData:])
+
+	return out.Bytes(), nil
+}
+
+// Writes an APP1 segment holding only the orientation, unless the image is already upright.
+func writeOrientationSegment(out *bytes.Buffer, orientation int) {
+	if orientation == 1 {
+		return
+	}
+
+	block := buildOrientationExif(orientation)
+	length := len(block) + 2
+
+	out.Write([]byte{0xFF, 0xE1, byte(length >> 8), byte(length & 0xff)})
+	out.Write(block)
+}
+
+/**
+Drops text, EXIF and timestamp chunks from a PNG file.
+*/
+func stripPNG(data []byte) ([]byte, error) {
+	if len(data) < len(pngSignature) || string(data[:len(pngSignature)]) != pngSignature {
+		return nil, errMalformedPNG
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:len(pngSignature)])
+
+	pos := len(pngSignature)
+
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, errMalformedPNG
+		}
+
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		chunkType := string(data[pos+4 : pos+8])
+
+		// Length, type, data and CRC.
+		chunkEnd := pos + 12 + length
+
+		if length < 0 || chunkEnd > len(data) || chunkEnd < pos {
+			return nil, errMalformedPNG
+		}
+
+		if !strippedPNGChunks[chunkType] {
+			out.Write(data[pos:chunkEnd])
+		}
+
+		pos = chunkEnd
+
+		if chunkType == "IEND" {
+			break
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+/**
+Drops EXIF and XMP chunks from a WebP file, clearing the matching flags in the extended header.
+*/
+func stripWebP(data []byte) ([]byte, error) {
+	const vp8xExifFlag = 0x08
+	const vp8xXMPFlag = 0x04
+
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errMalformedWebP
+	}
+
+	riffEnd := 8 + int(binary.LittleEndian.Uint32(data[4:8]))
+
+	if riffEnd > len(data) || riffEnd < 12 {
+		return nil, errMalformedWebP
+	}
+
+	chunks := bytes.NewBuffer(make([]byte, 0, len(data)))
+	pos := 12
+
+	for pos < riffEnd {
+		if pos+8 > riffEnd {
+			return nil, errMalformedWebP
+		}
+
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+
+		// Chunks are padded to an even size, although some writers leave the padding off the last chunk.
+		chunkEnd := pos + 8 + size + size%2
+
+		if chunkEnd == riffEnd+1 {
+			chunkEnd = riffEnd
+		}
+
+		if size < 0 || chunkEnd > riffEnd || chunkEnd < pos {
+			return nil, errMalformedWebP
+		}
+
+		switch fourCC {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte{}, data[pos:chunkEnd]...)
+
+			if size > 0 {
+				chunk[8] &^= vp8xExifFlag | vp8xXMPFlag
+			}
+
+			chunks.Write(chunk)
+		default:
+			chunks.Write(data[pos:chunkEnd])
+		}
+
+		pos = chunkEnd
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, chunks.Len()+12))
+	out.WriteString("RIFF")
+	_ = binary.Write(out, binary.LittleEndian, uint32(chunks.Len()+4))
+	out.WriteString("WEBP")
+	out.Write(chunks.Bytes())
+
+	return out.Bytes(), nil
+}
+
+// Returns the data of the first PNG chunk of the given type, or nil if there is none.
+func findPNGChunk(data []byte, chunkType string) []byte {
+	if len(data) < len(pngSignature) || string(data[:len(pngSignature)]) != pngSignature {
+		return nil
+	}
+
+	pos := len(pngSignature)
+
+	for pos+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		chunkEnd := pos + 12 + length
+
+		if length < 0 || chunkEnd > len(data) || chunkEnd < pos {
+			return nil
+		}
+
+		if string(data[pos+4:pos+8]) == chunkType {
+			return data[pos+8 : pos+8+length]
+		}
+
+		pos = chunkEnd
+	}
+
+	return nil
+}
+
+// Returns the data of the first WebP chunk with the given FourCC, or nil if there is none.
+func findWebPChunk(data []byte, fourCC string) []byte {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil
+	}
+
+	pos := 12
+
+	for pos+8 <= len(data) {
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+
+		if size < 0 || pos+8+size > len(data) {
+			return nil
+		}
+
+		if string(data[pos:pos+4]) == fourCC {
+			return data[pos+8 : pos+8+size]
+		}
+
+		pos += 8 + size + size%2
+	}
+
+	return nil
+}
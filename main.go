@@ -8,6 +8,10 @@ import (
 	"github.com/kilowatt-/ImageRepository/config"
 	"github.com/kilowatt-/ImageRepository/database"
 	"github.com/kilowatt-/ImageRepository/routes"
+	"github.com/kilowatt-/ImageRepository/routes/events"
+	"github.com/kilowatt-/ImageRepository/routes/images"
+	"github.com/kilowatt-/ImageRepository/routes/webhooks"
+	"github.com/kilowatt-/ImageRepository/storage"
 	"log"
 	"net/http"
 	"os"
@@ -32,21 +36,35 @@ func main() {
 
 	defer database.Disconnect()
 
-	if _, jwtKeyExists := os.LookupEnv("JWT_KEY"); !jwtKeyExists {
-		log.Fatal(JWTKeyNotFound)
+	storageBackend := storage.BackendFromEnvironment()
+
+	// AWS credentials are only needed when images are stored in S3.
+	if storageBackend == storage.S3Backend {
+		if _, awsKeyExists := os.LookupEnv("AWS_ACCESS_KEY_ID"); !awsKeyExists {
+			log.Fatal(AWSKeyNotFound)
+		}
+
+		if _, awsSecretKeyExists := os.LookupEnv("AWS_SECRET_ACCESS_KEY"); !awsSecretKeyExists {
+			log.Fatal(AWSSecretKeyNotFound)
+		}
+
+		if _, awsRegionExists := os.LookupEnv("AWS_REGION"); !awsRegionExists {
+			log.Println("AWS region not found; setting default to us-west-2")
+			_ = os.Setenv("AWS_REGION", "us-west-2")
+		}
 	}
 
-	if _, awsKeyExists := os.LookupEnv("AWS_ACCESS_KEY_ID"); !awsKeyExists {
-		log.Fatal(AWSKeyNotFound)
+	if storageErr := storage.Initialize(storageBackend); storageErr != nil {
+		log.Fatal(storageErr)
 	}
 
-	if _, awsSecretKeyExists := os.LookupEnv("AWS_SECRET_ACCESS_KEY"); !awsSecretKeyExists {
-		log.Fatal(AWSSecretKeyNotFound)
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		runAudit(os.Args[2:])
+		return
 	}
 
-	if _, awsRegionExists := os.LookupEnv("AWS_REGION"); !awsRegionExists {
-		log.Println("AWS region not found; setting default to us-west-2")
-		_ = os.Setenv("AWS_REGION", "us-west-2")
+	if _, jwtKeyExists := os.LookupEnv("JWT_KEY"); !jwtKeyExists {
+		log.Fatal(JWTKeyNotFound)
 	}
 
 	corsOrigins, corsExists := os.LookupEnv("ALLOWED_CORS_ORIGINS")
@@ -65,6 +83,10 @@ func main() {
 
 	routes.RegisterRoutes(r)
 
+	images.StartReconciler()
+	images.StartAffinityScorer()
+	webhooks.StartWebhookDispatcher()
+
 	allowedOrigins := handlers.AllowedOrigins([]string{corsOrigins})
 	allowedCredentials := handlers.AllowCredentials()
 	allowedHeaders := handlers.AllowedHeaders([]string{"Content-Type, Set-Cookie, *"})
@@ -75,6 +97,9 @@ func main() {
 		Handler: handlers.CORS(allowedOrigins, allowedCredentials, allowedHeaders, allowedMethods)(r),
 	}
 
+	// Event streams stay open until the client leaves, so they have to be ended for the server to shut down.
+	srv.RegisterOnShutdown(events.CloseAll)
+
 	log.Println("Listening on port " + PORT)
 
 	go func() {
@@ -0,0 +1,18 @@
+package model
+
+import (
+	"time"
+)
+
+// How much a user interacts with an author's images. Affinities are precomputed in the background and rank the feed.
+type Affinity struct {
+	ID string `json:"_id,omitempty" bson:"_id,omitempty"`
+	UserID string `json:"userid" bson:"userid"`
+	AuthorID string `json:"authorid" bson:"authorid"`
+	// Number of the author's images that the user likes.
+	Likes int64 `json:"likes" bson:"likes"`
+	// Number of the author's private images that the author shared with the user through their access lists.
+	SharedImages int64 `json:"sharedImages" bson:"sharedImages"`
+	Score float64 `json:"score" bson:"score"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
@@ -0,0 +1,25 @@
+package model
+
+import (
+	"time"
+)
+
+// An ordered collection of its author's images. Albums have their own access level and access list, which work in the
+// same way as those of images; an image in a visible album is still only shown to users who can see the image itself.
+type Album struct {
+	ID string `json:"_id,omitempty" bson:"_id,omitempty"`
+	AuthorID string `json:"authorid,omitempty" bson:"authorid,omitempty"`
+	Author User `json:"author,omitempty" bson:"-"`
+	Title string `json:"title" bson:"title"`
+	Description string `json:"description,omitempty" bson:"description,omitempty"`
+	CoverImageID string `json:"coverImageID,omitempty" bson:"coverImageID,omitempty"`
+	ImageIDs []string `json:"imageIDs" bson:"imageIDs"`
+	AccessLevel string `json:"accessLevel,omitempty" bson:"accessLevel,omitempty"`
+	AccessListIDs []string `json:"accessListIDs,omitempty" bson:"accessListIDs"`
+	CreatedAt time.Time `json:"createdAt,omitempty" bson:"createdAt,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+}
+
+func (a *Album) SetAuthor(user User) {
+	a.Author = user
+}
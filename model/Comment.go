@@ -0,0 +1,26 @@
+package model
+
+import (
+	"time"
+)
+
+// A comment on an image, or a reply to one. Replies are only one level deep: a reply's parent is always a top-level
+// comment.
+type Comment struct {
+	ID string `json:"_id,omitempty" bson:"_id,omitempty"`
+	ImageID string `json:"imageID" bson:"imageID"`
+	AuthorID string `json:"authorid" bson:"authorid"`
+	Author User `json:"author,omitempty" bson:"-"`
+	ParentID string `json:"parentID,omitempty" bson:"parentID,omitempty"`
+	Text string `json:"text" bson:"text"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	EditedAt *time.Time `json:"editedAt,omitempty" bson:"editedAt,omitempty"`
+	// Set by the image's author to hide the comment from everyone but themselves and the comment's author.
+	Hidden bool `json:"hidden,omitempty" bson:"hidden,omitempty"`
+	// Number of replies to a top-level comment, including hidden ones.
+	ReplyCount int64 `json:"replyCount" bson:"replyCount"`
+}
+
+func (c *Comment) SetAuthor(user User) {
+	c.Author = user
+}
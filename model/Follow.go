@@ -0,0 +1,18 @@
+package model
+
+import (
+	"time"
+)
+
+// States of a follow. Follows of private accounts are pending until the followed user accepts them.
+const FollowStatusAccepted = "accepted"
+const FollowStatusPending = "pending"
+
+// A user following another user, or requesting to.
+type Follow struct {
+	ID string `json:"_id,omitempty" bson:"_id,omitempty"`
+	FollowerID string `json:"followerID" bson:"followerID"`
+	FolloweeID string `json:"followeeID" bson:"followeeID"`
+	Status string `json:"status" bson:"status"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
@@ -0,0 +1,16 @@
+package model
+
+import (
+	"time"
+)
+
+// A named set of users that its author shares images with. Images that list a group in their accessListGroupIDs are
+// visible to its current members, so removing a member revokes their access to every image shared with the group.
+type Group struct {
+	ID string `json:"_id,omitempty" bson:"_id,omitempty"`
+	AuthorID string `json:"authorid" bson:"authorid"`
+	Name string `json:"name" bson:"name"`
+	MemberIDs []string `json:"memberIDs" bson:"memberIDs"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
@@ -4,16 +4,75 @@ import (
 	"time"
 )
 
-// TODO: Add enums here
+// Lifecycle states of an image document. Documents without a status predate them and count as committed.
+const ImageStatusPending = "pending"
+const ImageStatusCommitted = "committed"
+const ImageStatusDeleting = "deleting"
+
+// An image whose stored file is missing or does not match its document. Hidden, but can still be deleted by its author.
+const ImageStatusBroken = "broken"
+
 type Image struct {
 	ID string `json:"_id,omitempty" bson:"_id,omitempty"`
 	AuthorID string `json:"authorid,omitempty" bson:"authorid,omitempty"`
 	Author User	`json:"author,omitempty" bson:"author,omitempty"`
 	AccessLevel string	`json:"accessLevel,omitempty" bson:"accessLevel,omitEmpty"`
 	AccessListIDs []string	`json:"accessListIDs,omitempty" bson:"accessListIDs,omitempty"`
-	Likes []string	`json:"likes,omitempty" bson:"likes,omitempty"`
+	// Groups whose members can see the image, in addition to the users in AccessListIDs.
+	AccessListGroupIDs []string `json:"accessListGroupIDs,omitempty" bson:"accessListGroupIDs,omitempty"`
+	// User IDs of likes given before likes moved to their own collection. Moved there at startup.
+	Likes []string	`json:"-" bson:"likes,omitempty"`
+	LikeCount int64 `json:"likeCount" bson:"likeCount"`
+	// Whether the user who requested the image likes it. Not stored.
+	LikedByMe bool `json:"likedByMe" bson:"-"`
 	Caption string `json:"caption,omitempty" bson:"caption,omitempty"`
+	// Every tag of the image: the hashtags in its caption and the tags its author added explicitly. Searched by tag queries.
+	Tags []string `json:"tags,omitempty" bson:"tags,omitempty"`
+	// The tags the author added explicitly, kept so that Tags can be rebuilt when the caption changes.
+	ExplicitTags []string `json:"explicitTags,omitempty" bson:"explicitTags,omitempty"`
 	UploadDate time.Time `json:"uploadDateTime,omitempty" bson:"uploadDateTime,omitempty"`
+	Variants []ImageVariant `json:"variants,omitempty" bson:"variants,omitempty"`
+	Info ImageInfo `json:"info,omitempty" bson:"info,omitempty"`
+	PerceptualHash string `json:"perceptualHash,omitempty" bson:"perceptualHash,omitempty"`
+	BlobKey string `json:"-" bson:"blobKey,omitempty"`
+	Status string `json:"-" bson:"status,omitempty"`
+	// Increased by every edit of the image's caption, access level or tags. Documents without a version are at version 0.
+	Version int64 `json:"version" bson:"version"`
+	Upload *PendingUpload `json:"-" bson:"upload,omitempty"`
+}
+
+// A direct-to-storage or resumable upload that has been requested for a pending image but not finalized yet.
+// The file is uploaded to a staging key derived from the image ID; resumable uploads stage one object per chunk, and
+// list the keys of the accepted chunks in order.
+type PendingUpload struct {
+	ContentType string `bson:"contentType"`
+	KeepMetadata bool `bson:"keepMetadata,omitempty"`
+	Duplicates string `bson:"duplicates,omitempty"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+	Resumable bool `bson:"resumable,omitempty"`
+	Length int64 `bson:"length,omitempty"`
+	Offset int64 `bson:"offset"`
+	Chunks []string `bson:"chunks,omitempty"`
+}
+
+// Technical metadata extracted from an image when it is uploaded.
+type ImageInfo struct {
+	Width int `json:"width,omitempty" bson:"width,omitempty"`
+	Height int `json:"height,omitempty" bson:"height,omitempty"`
+	ByteSize int64 `json:"byteSize,omitempty" bson:"byteSize,omitempty"`
+	Format string `json:"format,omitempty" bson:"format,omitempty"`
+	Orientation string `json:"orientation,omitempty" bson:"orientation,omitempty"`
+	TakenAt time.Time `json:"takenAt,omitempty" bson:"takenAt,omitempty"`
+	CameraMake string `json:"cameraMake,omitempty" bson:"cameraMake,omitempty"`
+	CameraModel string `json:"cameraModel,omitempty" bson:"cameraModel,omitempty"`
+}
+
+// A resized copy of an image, stored alongside the original.
+type ImageVariant struct {
+	Size int `json:"size" bson:"size"`
+	Width int `json:"width" bson:"width"`
+	Height int `json:"height" bson:"height"`
+	ContentType string `json:"contentType,omitempty" bson:"contentType,omitempty"`
 }
 
 func (i *Image) SetAuthor(user User) {
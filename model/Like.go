@@ -0,0 +1,17 @@
+package model
+
+import (
+	"time"
+)
+
+// A user's like of an image. Likes are kept in their own collection, so that images with many likes stay small.
+type Like struct {
+	ID string `json:"_id,omitempty" bson:"_id,omitempty"`
+	ImageID string `json:"imageID" bson:"imageID"`
+	UserID string `json:"userid" bson:"userid"`
+	// The author of the liked image, so that the likes a user has given each author can be counted.
+	ImageAuthorID string `json:"imageAuthorID" bson:"imageAuthorID"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	// Set on likes moved out of an image document by the startup migration.
+	Migrated bool `json:"-" bson:"migrated,omitempty"`
+}
@@ -0,0 +1,30 @@
+package model
+
+import (
+	"time"
+)
+
+const (
+	// Someone liked one of the user's images.
+	NotificationTypeLike = "like"
+	// Someone added the user to the access list of one of their images.
+	NotificationTypeImageShared = "imageShared"
+)
+
+// Something that happened to a user. Notifications are removed once they are older than the retention period.
+type Notification struct {
+	ID string `json:"_id,omitempty" bson:"_id,omitempty"`
+	// The user who is notified.
+	UserID string `json:"userid" bson:"userid"`
+	Type string `json:"type" bson:"type"`
+	// The user whose action caused the notification.
+	ActorID string `json:"actorID" bson:"actorID"`
+	Actor User `json:"actor,omitempty" bson:"-"`
+	ImageID string `json:"imageID,omitempty" bson:"imageID,omitempty"`
+	Read bool `json:"read" bson:"read"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+func (n *Notification) SetActor(user User) {
+	n.Actor = user
+}
@@ -6,5 +6,9 @@ type User struct {
 	UserHandle string	`json:"userHandle,omitempty" bson:"userHandle,omitEmpty"`
 	Email string	`json:"emailAddr,omitempty" bson:"email,omitempty"`
 	Password []byte	`json:"pwd,omitempty" bson:"password,omitempty"`
+	// Private accounts must accept follow requests before they take effect.
+	Private bool `json:"private,omitempty" bson:"private,omitempty"`
+	FollowerCount int64 `json:"followerCount,omitempty" bson:"followerCount,omitempty"`
+	FollowingCount int64 `json:"followingCount,omitempty" bson:"followingCount,omitempty"`
 }
 
@@ -0,0 +1,49 @@
+package model
+
+import (
+	"time"
+)
+
+const (
+	WebhookEventImageCreated = "image.created"
+	WebhookEventImageDeleted = "image.deleted"
+	WebhookEventImageLiked = "image.liked"
+	WebhookEventACLChanged = "acl.changed"
+)
+
+const (
+	WebhookDeliveryPending = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	// Every attempt failed, or the webhook was removed before the delivery succeeded.
+	WebhookDeliveryFailed = "failed"
+)
+
+// An endpoint that is sent the events about a user's images.
+type Webhook struct {
+	ID string `json:"_id,omitempty" bson:"_id,omitempty"`
+	UserID string `json:"userid" bson:"userid"`
+	URL string `json:"url" bson:"url"`
+	Events []string `json:"events" bson:"events"`
+	// The key that payloads are signed with. Only returned when the webhook is created.
+	Secret string `json:"secret,omitempty" bson:"secret"`
+	Active bool `json:"active" bson:"active"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// One event to be sent to one webhook, and the outcome of sending it.
+type WebhookDelivery struct {
+	ID string `json:"_id,omitempty" bson:"_id,omitempty"`
+	WebhookID string `json:"webhookID" bson:"webhookID"`
+	UserID string `json:"userid" bson:"userid"`
+	Event string `json:"event" bson:"event"`
+	// The JSON request body, exactly as it is signed and sent.
+	Payload string `json:"payload" bson:"payload"`
+	Status string `json:"status" bson:"status"`
+	Attempts int `json:"attempts" bson:"attempts"`
+	NextAttemptAt time.Time `json:"nextAttemptAt" bson:"nextAttemptAt"`
+	LastAttemptAt *time.Time `json:"lastAttemptAt,omitempty" bson:"lastAttemptAt,omitempty"`
+	LastStatusCode int `json:"lastStatusCode,omitempty" bson:"lastStatusCode,omitempty"`
+	LastError string `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty" bson:"deliveredAt,omitempty"`
+}
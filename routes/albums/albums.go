@@ -0,0 +1,886 @@
+package albums
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/middleware"
+	"github.com/kilowatt-/ImageRepository/routes/users"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const albumNotFound = "album not found"
+const albumModified = "album was modified by another request; reload it and try again"
+
+// Largest number of images in an album.
+const maxAlbumImages = 1000
+
+const maxTitleLength = 200
+const maxDescriptionLength = 2000
+
+// The JSON body of the album endpoints. Each endpoint documents which fields it uses; fields left out are not changed.
+type albumBody struct {
+	ID            string    `json:"_id,omitempty"`
+	Title         *string   `json:"title,omitempty"`
+	Description   *string   `json:"description,omitempty"`
+	CoverImageID  *string   `json:"coverImageID,omitempty"`
+	AccessLevel   *string   `json:"accessLevel,omitempty"`
+	AccessListIDs *[]string `json:"accessListIDs,omitempty"`
+	ImageIDs      []string  `json:"imageIDs,omitempty"`
+	Position      *int      `json:"position,omitempty"`
+}
+
+// An album request that could not be carried out, and the status code to respond with.
+type albumError struct {
+	status  int
+	message string
+}
+
+func (e *albumError) Error() string {
+	return e.message
+}
+
+func sendAlbumError(w http.ResponseWriter, err error) {
+	if refused, ok := err.(*albumError); ok {
+		http.Error(w, refused.message, refused.status)
+		return
+	}
+
+	log.Println(err)
+	common.SendInternalServerError(w)
+}
+
+/**
+Decodes the JSON body of an album request. If requireID is set, the body must name an album.
+
+Returns the body and the album ID, which is nil if the body does not name one.
+*/
+func decodeAlbumBody(r *http.Request, requireID bool) (*albumBody, *primitive.ObjectID, error) {
+	body := &albumBody{}
+
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		return nil, nil, err
+	}
+
+	if body.ID == "" {
+		if requireID {
+			return nil, nil, errors.New("album id not passed in")
+		}
+
+		return body, nil, nil
+	}
+
+	hex, hexErr := primitive.ObjectIDFromHex(body.ID)
+
+	if hexErr != nil {
+		return nil, nil, errors.New("invalid album ID passed in: " + body.ID)
+	}
+
+	return body, &hex, nil
+}
+
+// Removes duplicates from a list of IDs, keeping the first occurrence of each.
+func uniqueIDs(ids []string) []string {
+	seen := make(map[string]bool)
+	unique := make([]string, 0, len(ids))
+
+	for _, k := range ids {
+		if !seen[k] {
+			seen[k] = true
+			unique = append(unique, k)
+		}
+	}
+
+	return unique
+}
+
+// Checks that a title or description is within its length limit; titles must also not be blank.
+func validateAlbumText(body *albumBody) error {
+	if body.Title != nil {
+		title := strings.TrimSpace(*body.Title)
+
+		if title == "" {
+			return &albumError{http.StatusBadRequest, "title must not be empty"}
+		}
+
+		if len(title) > maxTitleLength {
+			return &albumError{http.StatusBadRequest, "title is longer than " + strconv.Itoa(maxTitleLength) + " characters"}
+		}
+
+		body.Title = &title
+	}
+
+	if body.Description != nil && len(*body.Description) > maxDescriptionLength {
+		return &albumError{http.StatusBadRequest, "description is longer than " + strconv.Itoa(maxDescriptionLength) + " characters"}
+	}
+
+	return nil
+}
+
+/**
+Checks that every ID in an album's access list belongs to an existing user, and removes duplicates from it.
+*/
+func validateAccessList(accessListIDs []string) ([]string, error) {
+	accessListIDs = uniqueIDs(accessListIDs)
+
+	if len(accessListIDs) == 0 {
+		return accessListIDs, nil
+	}
+
+	hexes, hexErr := parseObjectIDs(accessListIDs, "user")
+
+	if hexErr != nil {
+		return nil, &albumError{http.StatusBadRequest, hexErr.Error()}
+	}
+
+	channel := make(chan []users.FindUserResponse)
+
+	go users.GetUsersFromDatabase(bson.D{{"_id", bson.D{{"$in", hexes}}}}, bson.D{{"_id", 1}}, channel)
+
+	res := <-channel
+
+	if len(res) == 1 && res[0].Err != nil {
+		return nil, res[0].Err
+	}
+
+	if len(res) != len(hexes) {
+		return nil, &albumError{http.StatusNotFound, "not all users in access list found"}
+	}
+
+	return accessListIDs, nil
+}
+
+/**
+Checks that every given image is a committed image of the given user, and removes duplicates from the list.
+*/
+func validateOwnImages(userid string, imageIDs []string) ([]string, error) {
+	imageIDs = uniqueIDs(imageIDs)
+
+	if len(imageIDs) == 0 {
+		return imageIDs, nil
+	}
+
+	hexes, hexErr := parseObjectIDs(imageIDs, "image")
+
+	if hexErr != nil {
+		return nil, &albumError{http.StatusBadRequest, hexErr.Error()}
+	}
+
+	channel := make(chan imageIDsResponse)
+
+	go getOwnImageIDs(userid, hexes, channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	for _, k := range imageIDs {
+		if !res.ids[k] {
+			return nil, &albumError{http.StatusNotFound, "image not found: " + k}
+		}
+	}
+
+	return imageIDs, nil
+}
+
+// Gets an album of the given user, responding with an error if there is none.
+func getOwnAlbumOrRespond(w http.ResponseWriter, userid string, albumid primitive.ObjectID) (*model.Album, bool) {
+	channel := make(chan albumDatabaseResponse)
+
+	go getOwnAlbum(userid, albumid, channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		log.Println(res.err)
+		common.SendInternalServerError(w)
+		return nil, false
+	}
+
+	if len(res.albums) == 0 {
+		http.Error(w, albumNotFound, http.StatusNotFound)
+		return nil, false
+	}
+
+	return res.albums[0], true
+}
+
+/**
+Removes the images that the viewer cannot see from albums by other authors, so that their IDs are not revealed.
+An album's cover is cleared if its image is removed.
+*/
+func hideInvisibleImages(viewer *common.Viewer, albums []*model.Album) error {
+	userid := viewer.UserID
+	hexes := []primitive.ObjectID{}
+
+	for _, album := range albums {
+		if album.AuthorID == userid {
+			continue
+		}
+
+		for _, k := range album.ImageIDs {
+			if hex, err := primitive.ObjectIDFromHex(k); err == nil {
+				hexes = append(hexes, hex)
+			}
+		}
+	}
+
+	if len(hexes) == 0 {
+		return nil
+	}
+
+	channel := make(chan imageIDsResponse)
+
+	go getVisibleImageIDs(viewer, hexes, channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		return res.err
+	}
+
+	for _, album := range albums {
+		if album.AuthorID == userid {
+			continue
+		}
+
+		visible := []string{}
+
+		for _, k := range album.ImageIDs {
+			if res.ids[k] {
+				visible = append(visible, k)
+			}
+		}
+
+		album.ImageIDs = visible
+
+		if !res.ids[album.CoverImageID] {
+			album.CoverImageID = ""
+		}
+	}
+
+	return nil
+}
+
+/**
+	[GET]
+
+	Gets the albums that match the query, newest first. Only albums visible to the user are returned: public albums,
+	albums whose access list contains the user, and the user's own albums. Images that the user cannot see are left
+	out of other users' albums.
+
+	Accepted query parameters:
+		- id: {comma separated hex strings} A list of album IDs. Will ignore all other queries if this is present.
+		- user: {comma separated hex strings} Only return albums by these users.
+		- before: {int} Unix timestamp. Only return albums created before this time.
+		- limit: {int} Limit on the number of results returned. Default of 10, max of 100.
+
+	Returns: (application/json)
+		- 200: List of matching albums, with their authors.
+		- 400: At least one of the IDs passed in is invalid.
+		- 500: Internal server error.
+*/
+func getAlbums(w http.ResponseWriter, r *http.Request) {
+	viewer := common.GetViewer(middleware.GetUserIDFromTokenNotStrictValidation(r))
+
+	filter, limit, queryErr := buildAlbumQuery(r, viewer)
+
+	if queryErr != nil {
+		http.Error(w, queryErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts := &options.FindOptions{
+		Limit: &limit,
+		Sort:  bson.D{{"createdAt", -1}},
+	}
+
+	channel := make(chan albumDatabaseResponse)
+
+	go getAlbumsFromDatabase(*filter, opts, channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		log.Println(res.err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if err := hideInvisibleImages(viewer, res.albums); err != nil {
+		log.Println(err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	appendAuthorsToAlbums(res.albums)
+
+	marshalled, _ := json.Marshal(res.albums)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(marshalled)
+}
+
+/**
+	[POST]
+
+	Creates an album.
+
+	JSON body parameters:
+		- title: the album title. Required; at most 200 characters.
+		- description: Optional. At most 2000 characters.
+		- accessLevel: public/private. Defaults to public.
+		- accessListIDs: Optional. An array of user IDs that can see the album if it is private.
+		- imageIDs: Optional. An array of the user's own image IDs, in album order. At most 1000.
+		- coverImageID: Optional. One of imageIDs.
+
+	Returns: (application/json)
+		- 200: The album ID.
+		- 400: Invalid body, title is missing, text is too long, an ID is invalid, there are too many images, or the
+		  cover is not one of the images.
+		- 404: A user in the access list does not exist, or an image is not one of the user's images.
+		- 500: Internal server error.
+*/
+func createAlbum(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	body, _, decodeErr := decodeAlbumBody(r, false)
+
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if body.Title == nil {
+		http.Error(w, "title not passed in", http.StatusBadRequest)
+		return
+	}
+
+	if err := validateAlbumText(body); err != nil {
+		sendAlbumError(w, err)
+		return
+	}
+
+	accessLevel := "public"
+
+	if body.AccessLevel != nil && *body.AccessLevel == "private" {
+		accessLevel = "private"
+	}
+
+	accessListIDs := []string{}
+
+	if body.AccessListIDs != nil {
+		validated, err := validateAccessList(*body.AccessListIDs)
+
+		if err != nil {
+			sendAlbumError(w, err)
+			return
+		}
+
+		accessListIDs = validated
+	}
+
+	if len(body.ImageIDs) > maxAlbumImages {
+		http.Error(w, "an album can have at most "+strconv.Itoa(maxAlbumImages)+" images", http.StatusBadRequest)
+		return
+	}
+
+	imageIDs, imagesErr := validateOwnImages(uid, body.ImageIDs)
+
+	if imagesErr != nil {
+		sendAlbumError(w, imagesErr)
+		return
+	}
+
+	album := model.Album{
+		AuthorID:      uid,
+		Title:         *body.Title,
+		ImageIDs:      imageIDs,
+		AccessLevel:   accessLevel,
+		AccessListIDs: accessListIDs,
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+	}
+
+	if body.Description != nil {
+		album.Description = *body.Description
+	}
+
+	if body.CoverImageID != nil && *body.CoverImageID != "" {
+		if !containsID(imageIDs, *body.CoverImageID) {
+			http.Error(w, "cover image must be one of the album's images", http.StatusBadRequest)
+			return
+		}
+
+		album.CoverImageID = *body.CoverImageID
+	}
+
+	channel := make(chan *database.InsertResponse)
+
+	go insertAlbum(album, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	jsonResponse, _ := json.Marshal(model.Album{ID: res.ID})
+	_, _ = w.Write(jsonResponse)
+}
+
+func containsID(ids []string, id string) bool {
+	for _, k := range ids {
+		if k == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+	[PATCH]
+
+	Edits the details and access control of one of the user's albums.
+
+	JSON body parameters:
+		- _id: the album ID.
+		- title, description: Optional. As for /createAlbum.
+		- coverImageID: Optional. One of the album's images, or an empty string to remove the cover.
+		- accessLevel: Optional. public/private.
+		- accessListIDs: Optional. An array of user IDs that replaces the album's access list.
+
+	Returns:
+		- 200: Album edited.
+		- 400: Invalid body, no fields to edit, text is too long, an invalid access level or user ID, or the cover is
+		  not one of the album's images.
+		- 404: Album not found, or a user in the access list does not exist.
+		- 409: The cover image was removed from the album at the same time.
+		- 500: Internal server error.
+*/
+func editAlbum(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	body, hex, decodeErr := decodeAlbumBody(r, true)
+
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if body.Title == nil && body.Description == nil && body.CoverImageID == nil && body.AccessLevel == nil && body.AccessListIDs == nil {
+		http.Error(w, "no fields to edit passed in", http.StatusBadRequest)
+		return
+	}
+
+	if err := validateAlbumText(body); err != nil {
+		sendAlbumError(w, err)
+		return
+	}
+
+	if body.AccessLevel != nil && *body.AccessLevel != "public" && *body.AccessLevel != "private" {
+		http.Error(w, "invalid access level passed in: "+*body.AccessLevel, http.StatusBadRequest)
+		return
+	}
+
+	album, ok := getOwnAlbumOrRespond(w, uid, *hex)
+
+	if !ok {
+		return
+	}
+
+	set := bson.D{}
+	unset := bson.D{}
+	var condition bson.D
+
+	if body.Title != nil {
+		set = append(set, bson.E{Key: "title", Value: *body.Title})
+	}
+
+	if body.Description != nil {
+		set = append(set, bson.E{Key: "description", Value: *body.Description})
+	}
+
+	if body.AccessLevel != nil {
+		set = append(set, bson.E{Key: "accessLevel", Value: *body.AccessLevel})
+	}
+
+	if body.AccessListIDs != nil {
+		accessListIDs, err := validateAccessList(*body.AccessListIDs)
+
+		if err != nil {
+			sendAlbumError(w, err)
+			return
+		}
+
+		set = append(set, bson.E{Key: "accessListIDs", Value: accessListIDs})
+	}
+
+	if body.CoverImageID != nil {
+		if *body.CoverImageID == "" {
+			unset = append(unset, bson.E{Key: "coverImageID", Value: ""})
+		} else if !containsID(album.ImageIDs, *body.CoverImageID) {
+			http.Error(w, "cover image must be one of the album's images", http.StatusBadRequest)
+			return
+		} else {
+			set = append(set, bson.E{Key: "coverImageID", Value: *body.CoverImageID})
+			condition = bson.D{{"imageIDs", *body.CoverImageID}}
+		}
+	}
+
+	update := bson.D{}
+
+	if len(set) > 0 {
+		update = append(update, bson.E{Key: "$set", Value: set})
+	}
+
+	if len(unset) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: unset})
+	}
+
+	channel := make(chan *database.UpdateResponse)
+
+	go updateOwnAlbum(uid, *hex, condition, update, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if res.Matched == 0 {
+		http.Error(w, albumModified, http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+	[DELETE]
+
+	Deletes one of the user's albums. The images in it are not deleted.
+
+	JSON body parameters:
+		- _id: the album ID.
+
+	Returns:
+		- 200: Album deleted.
+		- 400: Album ID was not passed in or is invalid.
+		- 404: Album not found or user does not have permission to delete it. (no difference)
+		- 500: Internal server error.
+*/
+func deleteAlbum(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	_, hex, decodeErr := decodeAlbumBody(r, true)
+
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	channel := make(chan *database.DeleteResponse)
+
+	go deleteAlbumFromDatabase(uid, *hex, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if res.NumberDeleted == 0 {
+		http.Error(w, albumNotFound, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+	[PATCH]
+
+	Adds some of the user's images to one of their albums. Images that are already in the album are left where they
+	are.
+
+	JSON body parameters:
+		- _id: the album ID.
+		- imageIDs: an array of image IDs, in the order they should appear.
+		- position: Optional. The index to insert the images at. Defaults to the end of the album.
+
+	Returns:
+		- 200: Images added.
+		- 204 No Content: All the images were already in the album.
+		- 400: Invalid body, no images passed in, an invalid image ID or position, or the album would have more than
+		  1000 images.
+		- 404: Album not found, or an image is not one of the user's images.
+		- 409: The album was modified at the same time.
+		- 500: Internal server error.
+*/
+func addAlbumImages(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	body, hex, decodeErr := decodeAlbumBody(r, true)
+
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(body.ImageIDs) == 0 {
+		http.Error(w, "no images passed in", http.StatusBadRequest)
+		return
+	}
+
+	if len(body.ImageIDs) > maxAlbumImages {
+		http.Error(w, "an album can have at most "+strconv.Itoa(maxAlbumImages)+" images", http.StatusBadRequest)
+		return
+	}
+
+	imageIDs, imagesErr := validateOwnImages(uid, body.ImageIDs)
+
+	if imagesErr != nil {
+		sendAlbumError(w, imagesErr)
+		return
+	}
+
+	album, ok := getOwnAlbumOrRespond(w, uid, *hex)
+
+	if !ok {
+		return
+	}
+
+	toAdd := []string{}
+
+	for _, k := range imageIDs {
+		if !containsID(album.ImageIDs, k) {
+			toAdd = append(toAdd, k)
+		}
+	}
+
+	if len(toAdd) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if len(album.ImageIDs)+len(toAdd) > maxAlbumImages {
+		http.Error(w, "an album can have at most "+strconv.Itoa(maxAlbumImages)+" images", http.StatusBadRequest)
+		return
+	}
+
+	push := bson.D{{"$each", toAdd}}
+
+	if body.Position != nil {
+		if *body.Position < 0 || *body.Position > len(album.ImageIDs) {
+			http.Error(w, "position must be between 0 and the number of images in the album", http.StatusBadRequest)
+			return
+		}
+
+		push = append(push, bson.E{Key: "$position", Value: *body.Position})
+	}
+
+	// The images must still be missing from the album, and there must still be room for them.
+	condition := bson.D{
+		{"imageIDs", bson.D{{"$nin", toAdd}}},
+		{"imageIDs." + strconv.Itoa(maxAlbumImages-len(toAdd)), bson.D{{"$exists", false}}},
+	}
+
+	update := bson.D{{"$push", bson.D{{"imageIDs", push}}}}
+
+	channel := make(chan *database.UpdateResponse)
+
+	go updateOwnAlbum(uid, *hex, condition, update, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if res.Matched == 0 {
+		http.Error(w, albumModified, http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+	[PATCH]
+
+	Removes images from one of the user's albums. The images themselves are not deleted. If the album's cover is
+	removed, the album is left without a cover.
+
+	JSON body parameters:
+		- _id: the album ID.
+		- imageIDs: an array of image IDs.
+
+	Returns:
+		- 200: Images removed.
+		- 204 No Content: None of the images were in the album.
+		- 400: Invalid body or no images passed in.
+		- 404: Album not found.
+		- 500: Internal server error.
+*/
+func removeAlbumImages(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	body, hex, decodeErr := decodeAlbumBody(r, true)
+
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(body.ImageIDs) == 0 {
+		http.Error(w, "no images passed in", http.StatusBadRequest)
+		return
+	}
+
+	imageIDs := uniqueIDs(body.ImageIDs)
+
+	update := bson.D{{"$pullAll", bson.D{{"imageIDs", imageIDs}}}}
+	condition := bson.D{{"imageIDs", bson.D{{"$in", imageIDs}}}}
+
+	channel := make(chan *database.UpdateResponse)
+
+	go updateOwnAlbum(uid, *hex, condition, update, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if res.Matched == 0 {
+		// Either the album does not exist, or none of the images were in it.
+		if _, ok := getOwnAlbumOrRespond(w, uid, *hex); ok {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	coverCondition := bson.D{{"coverImageID", bson.D{{"$in", imageIDs}}}}
+	coverUpdate := bson.D{{"$unset", bson.D{{"coverImageID", ""}}}}
+
+	go updateOwnAlbum(uid, *hex, coverCondition, coverUpdate, channel)
+
+	if coverRes := <-channel; coverRes.Err != nil {
+		log.Println(coverRes.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+	[PATCH]
+
+	Changes the order of the images in one of the user's albums.
+
+	JSON body parameters:
+		- _id: the album ID.
+		- imageIDs: an array with every image ID of the album exactly once, in the new order.
+
+	Returns:
+		- 200: Images reordered.
+		- 400: Invalid body, or imageIDs does not list the album's images exactly.
+		- 404: Album not found.
+		- 409: The album's images were changed at the same time.
+		- 500: Internal server error.
+*/
+func reorderAlbumImages(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	body, hex, decodeErr := decodeAlbumBody(r, true)
+
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	album, ok := getOwnAlbumOrRespond(w, uid, *hex)
+
+	if !ok {
+		return
+	}
+
+	isPermutation := len(body.ImageIDs) == len(album.ImageIDs) && len(uniqueIDs(body.ImageIDs)) == len(body.ImageIDs)
+
+	for _, k := range body.ImageIDs {
+		isPermutation = isPermutation && containsID(album.ImageIDs, k)
+	}
+
+	if !isPermutation {
+		http.Error(w, "imageIDs must list every image of the album exactly once", http.StatusBadRequest)
+		return
+	}
+
+	// Only reorder the images if nothing was added or removed since they were read.
+	condition := bson.D{{"imageIDs", album.ImageIDs}}
+	update := bson.D{{"$set", bson.D{{"imageIDs", body.ImageIDs}}}}
+
+	channel := make(chan *database.UpdateResponse)
+
+	go updateOwnAlbum(uid, *hex, condition, update, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if res.Matched == 0 {
+		http.Error(w, albumModified, http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func ServeAlbumRoutes(r *mux.Router) {
+	createAlbumIndexes()
+
+	r.HandleFunc("/getAlbums", getAlbums).Methods("GET")
+
+	s := r.Methods("DELETE", "PATCH", "POST").Subrouter()
+
+	s.Use(middleware.JWTMiddleware)
+
+	s.HandleFunc("/createAlbum", createAlbum).Methods("POST")
+	s.HandleFunc("/editAlbum", editAlbum).Methods("PATCH")
+	s.HandleFunc("/deleteAlbum", deleteAlbum).Methods("DELETE")
+	s.HandleFunc("/addAlbumImages", addAlbumImages).Methods("PATCH")
+	s.HandleFunc("/removeAlbumImages", removeAlbumImages).Methods("PATCH")
+	s.HandleFunc("/reorderAlbumImages", reorderAlbumImages).Methods("PATCH")
+}
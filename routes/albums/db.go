@@ -0,0 +1,237 @@
+package albums
+
+import (
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/users"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+)
+
+type albumDatabaseResponse struct {
+	albums []*model.Album
+	err    error
+}
+
+type FindAlbumResponse struct {
+	Album *model.Album
+	Err   error
+}
+
+type imageIDsResponse struct {
+	ids map[string]bool
+	err error
+}
+
+/**
+Creates the indexes that album queries rely on.
+*/
+func createAlbumIndexes() {
+	indexes := []bson.D{
+		{{"authorid", 1}, {"createdAt", -1}},
+		{{"createdAt", -1}},
+		{{"imageIDs", 1}},
+	}
+
+	for _, k := range indexes {
+		if err := database.CreateIndex("albums", k, nil); err != nil {
+			log.Println("could not create album index: " + err.Error())
+		}
+	}
+}
+
+func decodeAlbum(document bson.M) *model.Album {
+	album := model.Album{}
+
+	bsonBytes, _ := bson.Marshal(document)
+
+	_ = bson.Unmarshal(bsonBytes, &album)
+
+	if album.ImageIDs == nil {
+		album.ImageIDs = []string{}
+	}
+
+	return &album
+}
+
+func insertAlbum(album model.Album, channel chan *database.InsertResponse) {
+	channel <- database.InsertOne("albums", album, nil)
+}
+
+func getAlbumsFromDatabase(filter bson.D, opts *options.FindOptions, channel chan albumDatabaseResponse) {
+	res := database.Find("albums", filter, opts)
+
+	if res.Err != nil {
+		channel <- albumDatabaseResponse{albums: nil, err: res.Err}
+		return
+	}
+
+	albumList := []*model.Album{}
+
+	for _, k := range res.Result {
+		albumList = append(albumList, decodeAlbum(k))
+	}
+
+	channel <- albumDatabaseResponse{albums: albumList, err: nil}
+}
+
+// Gets an album that belongs to the given user.
+func getOwnAlbum(userid string, albumid primitive.ObjectID, channel chan albumDatabaseResponse) {
+	filter := bson.D{{"$and", []bson.D{
+		{{"_id", albumid}},
+		{{"authorid", userid}},
+	}}}
+
+	getAlbumsFromDatabase(filter, nil, channel)
+}
+
+/**
+Gets an album if it is visible to the viewer. The album is nil if it does not exist or cannot be seen.
+
+Image IDs are not filtered; the images in the album must be queried with the user's visibility as well.
+*/
+func GetVisibleAlbum(viewer *common.Viewer, albumid primitive.ObjectID, channel chan FindAlbumResponse) {
+	filter := bson.D{{"$and", []bson.D{
+		{{"_id", albumid}},
+		{{"$or", common.BuildVisibilityFilters(viewer)}},
+	}}}
+
+	res := database.FindOne("albums", filter, nil)
+
+	if res.Err != nil {
+		channel <- FindAlbumResponse{Album: nil, Err: res.Err}
+	} else if res.Result == nil {
+		channel <- FindAlbumResponse{Album: nil, Err: nil}
+	} else {
+		channel <- FindAlbumResponse{Album: decodeAlbum(res.Result), Err: nil}
+	}
+}
+
+/**
+Updates an album of the given user, and sets its modification time. condition restricts the update further, so that
+it only applies if the album is still in the expected state; it may be nil.
+*/
+func updateOwnAlbum(userid string, albumid primitive.ObjectID, condition bson.D, update bson.D, channel chan *database.UpdateResponse) {
+	filters := []bson.D{
+		{{"_id", albumid}},
+		{{"authorid", userid}},
+	}
+
+	if condition != nil {
+		filters = append(filters, condition)
+	}
+
+	update = append(update, bson.E{Key: "$currentDate", Value: bson.D{{"updatedAt", true}}})
+
+	channel <- database.UpdateOne("albums", bson.D{{"$and", filters}}, update, nil)
+}
+
+func deleteAlbumFromDatabase(userid string, albumid primitive.ObjectID, channel chan *database.DeleteResponse) {
+	filter := bson.D{{"$and", []bson.D{
+		{{"_id", albumid}},
+		{{"authorid", userid}},
+	}}}
+
+	channel <- database.DeleteOne("albums", filter, nil)
+}
+
+/**
+Removes the given images from every album that contains them, clearing the cover of albums that used one of them.
+Called when images are deleted.
+*/
+func RemoveImagesFromAlbums(imageIDs []string, channel chan *database.UpdateResponse) {
+	coverFilter := bson.D{{"coverImageID", bson.D{{"$in", imageIDs}}}}
+	coverUpdate := bson.D{{"$unset", bson.D{{"coverImageID", ""}}}}
+
+	if res := database.Update("albums", coverFilter, coverUpdate, nil); res.Err != nil {
+		channel <- res
+		return
+	}
+
+	filter := bson.D{{"imageIDs", bson.D{{"$in", imageIDs}}}}
+	update := bson.D{
+		{"$pullAll", bson.D{{"imageIDs", imageIDs}}},
+		{"$currentDate", bson.D{{"updatedAt", true}}},
+	}
+
+	channel <- database.Update("albums", filter, update, nil)
+}
+
+// Gets which of the given images are committed images of the given user.
+func getOwnImageIDs(userid string, imageids []primitive.ObjectID, channel chan imageIDsResponse) {
+	filter := bson.D{{"$and", []bson.D{
+		{{"_id", bson.D{{"$in", imageids}}}},
+		{{"authorid", userid}},
+		common.CommittedImageFilter,
+	}}}
+
+	findImageIDs(filter, channel)
+}
+
+// Gets which of the given images are committed images that the viewer can see.
+func getVisibleImageIDs(viewer *common.Viewer, imageids []primitive.ObjectID, channel chan imageIDsResponse) {
+	filter := bson.D{{"$and", []bson.D{
+		{{"_id", bson.D{{"$in", imageids}}}},
+		{{"$or", common.BuildVisibilityFilters(viewer)}},
+		common.CommittedImageFilter,
+	}}}
+
+	findImageIDs(filter, channel)
+}
+
+func findImageIDs(filter bson.D, channel chan imageIDsResponse) {
+	res := database.Find("images", filter, options.Find().SetProjection(bson.D{{"_id", 1}}))
+
+	if res.Err != nil {
+		channel <- imageIDsResponse{ids: nil, err: res.Err}
+		return
+	}
+
+	ids := make(map[string]bool)
+
+	for _, k := range res.Result {
+		if id, ok := k["_id"].(primitive.ObjectID); ok {
+			ids[id.Hex()] = true
+		}
+	}
+
+	channel <- imageIDsResponse{ids: ids, err: nil}
+}
+
+// Appends author to each album in the list.
+func appendAuthorsToAlbums(albums []*model.Album) {
+	idSet := make(map[string]bool)
+	userIDs := []primitive.ObjectID{}
+
+	for _, k := range albums {
+		if hex, err := primitive.ObjectIDFromHex(k.AuthorID); err == nil && !idSet[k.AuthorID] {
+			idSet[k.AuthorID] = true
+			userIDs = append(userIDs, hex)
+		}
+	}
+
+	filter := bson.D{{"_id", bson.D{{"$in", userIDs}}}}
+	projection := bson.D{{"name", 1}, {"userHandle", 1}}
+
+	c := make(chan []users.FindUserResponse)
+	go users.GetUsersFromDatabase(filter, projection, c)
+
+	res := <-c
+
+	if len(res) == 1 && res[0].Err != nil {
+		return
+	}
+
+	userMap := make(map[string]model.User)
+
+	for _, k := range res {
+		userMap[k.User.ID] = k.User
+	}
+
+	for _, k := range albums {
+		k.SetAuthor(userMap[k.AuthorID])
+	}
+}
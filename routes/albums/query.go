@@ -0,0 +1,76 @@
+package albums
+
+import (
+	"errors"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultAlbumLimit = 10
+const maxAlbumLimit = 100
+
+/**
+Builds the album query based on the parameters passed in the request, matching only albums visible to the viewer.
+
+Returns a BSON Document representing the database query to be built, and a number that represents the limit.
+*/
+func buildAlbumQuery(r *http.Request, viewer *common.Viewer) (*bson.D, int64, error) {
+	var limit int64 = defaultAlbumLimit
+	subFilters := []interface{}{bson.D{{"$or", common.BuildVisibilityFilters(viewer)}}}
+
+	if idQuery := r.URL.Query().Get("id"); idQuery != "" {
+		ids, err := parseObjectIDs(strings.Split(idQuery, ","), "album")
+
+		if err != nil {
+			return nil, limit, err
+		}
+
+		subFilters = append(subFilters, bson.D{{"_id", bson.D{{"$in", ids}}}})
+
+		return &bson.D{{"$and", subFilters}}, int64(len(ids)), nil
+	}
+
+	if beforeQuery := r.URL.Query().Get("before"); beforeQuery != "" {
+		if conv, convErr := strconv.ParseInt(beforeQuery, 10, 64); convErr == nil {
+			subFilters = append(subFilters, bson.D{{"createdAt", bson.D{{"$lt", primitive.NewDateTimeFromTime(time.Unix(conv, 0))}}}})
+		}
+	}
+
+	if limitQuery := r.URL.Query().Get("limit"); limitQuery != "" {
+		if conv, convErr := strconv.ParseInt(limitQuery, 10, 64); convErr == nil && conv > 0 {
+			limit = conv
+		}
+	}
+
+	if limit > maxAlbumLimit {
+		limit = maxAlbumLimit
+	}
+
+	if userQuery := r.URL.Query().Get("user"); userQuery != "" {
+		subFilters = append(subFilters, bson.D{{"authorid", bson.D{{"$in", strings.Split(userQuery, ",")}}}})
+	}
+
+	return &bson.D{{"$and", subFilters}}, limit, nil
+}
+
+// Parses a list of hex IDs. kind names what they identify in the error message.
+func parseObjectIDs(ids []string, kind string) ([]primitive.ObjectID, error) {
+	hexes := make([]primitive.ObjectID, 0, len(ids))
+
+	for _, k := range ids {
+		hex, err := primitive.ObjectIDFromHex(k)
+
+		if err != nil {
+			return nil, errors.New("invalid " + kind + " ID passed in: " + k)
+		}
+
+		hexes = append(hexes, hex)
+	}
+
+	return hexes, nil
+}
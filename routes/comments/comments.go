@@ -0,0 +1,640 @@
+package comments
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/middleware"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const commentNotFound = "comment not found"
+const imageNotFound = "image not found"
+
+// Longest comment, in characters.
+const maxCommentLength = 2000
+
+const defaultCommentLimit = 20
+const maxCommentLimit = 100
+
+// The JSON body of the comment endpoints. Each endpoint documents which fields it uses.
+type commentBody struct {
+	ID       string  `json:"_id,omitempty"`
+	ImageID  string  `json:"imageID,omitempty"`
+	ParentID string  `json:"parentID,omitempty"`
+	Text     *string `json:"text,omitempty"`
+	Hidden   *bool   `json:"hidden,omitempty"`
+}
+
+type commentPage struct {
+	Comments   []*model.Comment `json:"comments"`
+	NextCursor string           `json:"nextCursor,omitempty"`
+}
+
+// Parses a hex ID. kind names what it identifies in the error message.
+func parseObjectID(id string, kind string) (*primitive.ObjectID, error) {
+	if id == "" {
+		return nil, errors.New(kind + " id not passed in")
+	}
+
+	hex, err := primitive.ObjectIDFromHex(id)
+
+	if err != nil {
+		return nil, errors.New("invalid " + kind + " ID passed in: " + id)
+	}
+
+	return &hex, nil
+}
+
+// Trims a comment's text and checks that it is not empty or too long.
+func validateCommentText(text *string) (string, error) {
+	if text == nil {
+		return "", errors.New("text not passed in")
+	}
+
+	trimmed := strings.TrimSpace(*text)
+
+	if trimmed == "" {
+		return "", errors.New("text must not be empty")
+	}
+
+	if utf8.RuneCountInString(trimmed) > maxCommentLength {
+		return "", errors.New("text is longer than " + strconv.Itoa(maxCommentLength) + " characters")
+	}
+
+	return trimmed, nil
+}
+
+/**
+Gets the author of an image that is visible to the viewer, responding with an error if there is none.
+*/
+func getVisibleImageAuthorOrRespond(w http.ResponseWriter, viewer *common.Viewer, imageid primitive.ObjectID) (string, bool) {
+	channel := make(chan imageAuthorResponse)
+
+	go getVisibleImageAuthor(viewer, imageid, channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		log.Println(res.err)
+		common.SendInternalServerError(w)
+		return "", false
+	}
+
+	if res.authorID == "" {
+		http.Error(w, imageNotFound, http.StatusNotFound)
+		return "", false
+	}
+
+	return res.authorID, true
+}
+
+// Gets a comment, responding with an error if there is none.
+func getCommentOrRespond(w http.ResponseWriter, commentid primitive.ObjectID) (*model.Comment, bool) {
+	channel := make(chan commentDatabaseResponse)
+
+	go getComment(commentid, channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		log.Println(res.err)
+		common.SendInternalServerError(w)
+		return nil, false
+	}
+
+	if len(res.comments) == 0 {
+		http.Error(w, commentNotFound, http.StatusNotFound)
+		return nil, false
+	}
+
+	return res.comments[0], true
+}
+
+// Reports whether a user can see a comment on an image by the given author.
+func canSeeComment(userid string, imageAuthorID string, comment *model.Comment) bool {
+	return !comment.Hidden || userid == imageAuthorID || (userid != "" && userid == comment.AuthorID)
+}
+
+/**
+	[GET]
+
+	Gets the comments on an image, oldest first, or the replies to one of them. Only works if the image is visible to
+	the user. Hidden comments are only returned to the image's author and to the comment's author.
+
+	Accepted query parameters:
+		- image: the image ID.
+		- parent: Optional. A top-level comment ID. Gets the replies to this comment instead of the top-level comments.
+		- cursor: Optional. The nextCursor of the previous page.
+		- limit: integer. The number of comments to return. Default 20, max 100.
+
+	Returns: (application/json)
+		- 200: The comments with their authors, and a nextCursor to get the next page with. nextCursor is left out on
+		  the last page.
+		- 400: An invalid image, parent or cursor ID was passed in.
+		- 404: Image or parent comment not found, or user not authorised to view them. (no difference.)
+		- 500: Internal server error.
+*/
+func getComments(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromTokenNotStrictValidation(r)
+
+	imageHex, imageErr := parseObjectID(r.URL.Query().Get("image"), "image")
+
+	if imageErr != nil {
+		http.Error(w, imageErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	subFilters := []bson.D{{{"imageID", imageHex.Hex()}}}
+
+	var parentHex *primitive.ObjectID
+
+	if parent := r.URL.Query().Get("parent"); parent != "" {
+		hex, parentErr := parseObjectID(parent, "parent")
+
+		if parentErr != nil {
+			http.Error(w, parentErr.Error(), http.StatusBadRequest)
+			return
+		}
+
+		parentHex = hex
+		subFilters = append(subFilters, bson.D{{"parentID", parentHex.Hex()}})
+	} else {
+		subFilters = append(subFilters, bson.D{{"parentID", bson.D{{"$exists", false}}}})
+	}
+
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		cursorHex, cursorErr := parseObjectID(cursor, "cursor")
+
+		if cursorErr != nil {
+			http.Error(w, cursorErr.Error(), http.StatusBadRequest)
+			return
+		}
+
+		subFilters = append(subFilters, bson.D{{"_id", bson.D{{"$gt", *cursorHex}}}})
+	}
+
+	var limit int64 = defaultCommentLimit
+
+	if limitQuery := r.URL.Query().Get("limit"); limitQuery != "" {
+		if conv, convErr := strconv.ParseInt(limitQuery, 10, 64); convErr == nil && conv > 0 {
+			limit = conv
+		}
+	}
+
+	if limit > maxCommentLimit {
+		limit = maxCommentLimit
+	}
+
+	imageAuthorID, ok := getVisibleImageAuthorOrRespond(w, common.GetViewer(uid), *imageHex)
+
+	if !ok {
+		return
+	}
+
+	// The replies to a hidden comment are only shown to those who can see the comment.
+	if parentHex != nil {
+		parent, found := getCommentOrRespond(w, *parentHex)
+
+		if !found {
+			return
+		}
+
+		if parent.ImageID != imageHex.Hex() || !canSeeComment(uid, imageAuthorID, parent) {
+			http.Error(w, commentNotFound, http.StatusNotFound)
+			return
+		}
+	}
+
+	if uid != imageAuthorID {
+		visibleFilters := []bson.D{{{"hidden", bson.D{{"$ne", true}}}}}
+
+		if uid != "" {
+			visibleFilters = append(visibleFilters, bson.D{{"authorid", uid}})
+		}
+
+		subFilters = append(subFilters, bson.D{{"$or", visibleFilters}})
+	}
+
+	// Fetch one comment more than the limit, to find out whether there is a next page.
+	fetchLimit := limit + 1
+
+	opts := &options.FindOptions{
+		Limit: &fetchLimit,
+		Sort:  bson.D{{"_id", 1}},
+	}
+
+	channel := make(chan commentDatabaseResponse)
+
+	go getCommentsFromDatabase(bson.D{{"$and", subFilters}}, opts, channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		log.Println(res.err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	page := commentPage{Comments: res.comments}
+
+	if int64(len(res.comments)) > limit {
+		page.Comments = res.comments[:limit]
+		page.NextCursor = page.Comments[limit-1].ID
+	}
+
+	appendAuthorsToComments(page.Comments)
+
+	jsonResponse, _ := json.Marshal(page)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonResponse)
+}
+
+/**
+	[POST]
+
+	Comments on an image that is visible to the user, or replies to a top-level comment on it. Replies cannot be
+	replied to.
+
+	JSON body parameters:
+		- imageID: the image ID.
+		- parentID: Optional. The ID of the top-level comment to reply to.
+		- text: the comment. At most 2000 characters.
+
+	Returns: (application/json)
+		- 200: The comment ID.
+		- 400: Invalid body or ID, text is empty or too long, or the parent is a reply.
+		- 404: Image or parent comment not found, or user not authorised to view them. (no difference.)
+		- 500: Internal server error.
+*/
+func addComment(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	body := &commentBody{}
+
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	imageHex, imageErr := parseObjectID(body.ImageID, "image")
+
+	if imageErr != nil {
+		http.Error(w, imageErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	text, textErr := validateCommentText(body.Text)
+
+	if textErr != nil {
+		http.Error(w, textErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	imageAuthorID, ok := getVisibleImageAuthorOrRespond(w, common.GetViewer(uid), *imageHex)
+
+	if !ok {
+		return
+	}
+
+	var parentHex *primitive.ObjectID
+
+	if body.ParentID != "" {
+		hex, parentErr := parseObjectID(body.ParentID, "parent")
+
+		if parentErr != nil {
+			http.Error(w, parentErr.Error(), http.StatusBadRequest)
+			return
+		}
+
+		parent, found := getCommentOrRespond(w, *hex)
+
+		if !found {
+			return
+		}
+
+		if parent.ImageID != imageHex.Hex() || !canSeeComment(uid, imageAuthorID, parent) {
+			http.Error(w, commentNotFound, http.StatusNotFound)
+			return
+		}
+
+		if parent.ParentID != "" {
+			http.Error(w, "replies cannot be replied to", http.StatusBadRequest)
+			return
+		}
+
+		parentHex = hex
+	}
+
+	comment := model.Comment{
+		ImageID:   imageHex.Hex(),
+		AuthorID:  uid,
+		ParentID:  body.ParentID,
+		Text:      text,
+		CreatedAt: time.Now(),
+	}
+
+	insertChannel := make(chan *database.InsertResponse)
+
+	go insertComment(comment, insertChannel)
+
+	insertResponse := <-insertChannel
+
+	if insertResponse.Err != nil {
+		log.Println(insertResponse.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if parentHex != nil {
+		countChannel := make(chan *database.UpdateResponse)
+
+		go updateReplyCount(*parentHex, 1, countChannel)
+
+		if res := <-countChannel; res.Err != nil {
+			log.Println("could not update reply count of comment " + parentHex.Hex() + ": " + res.Err.Error())
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	jsonResponse, _ := json.Marshal(model.Comment{ID: insertResponse.ID})
+	_, _ = w.Write(jsonResponse)
+}
+
+/**
+	[PATCH]
+
+	Edits the text of one of the user's comments. Only works while the image is visible to the user.
+
+	JSON body parameters:
+		- _id: the comment ID.
+		- text: the new text. At most 2000 characters.
+
+	Returns:
+		- 200: Comment edited.
+		- 400: Invalid body or ID, or text is empty or too long.
+		- 404: Comment not found, user is not its author, or the image is not visible to the user. (no difference.)
+		- 500: Internal server error.
+*/
+func editComment(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	body := &commentBody{}
+
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hex, hexErr := parseObjectID(body.ID, "comment")
+
+	if hexErr != nil {
+		http.Error(w, hexErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	text, textErr := validateCommentText(body.Text)
+
+	if textErr != nil {
+		http.Error(w, textErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	comment, ok := getCommentOrRespond(w, *hex)
+
+	if !ok {
+		return
+	}
+
+	if comment.AuthorID != uid {
+		http.Error(w, commentNotFound, http.StatusNotFound)
+		return
+	}
+
+	imageHex, _ := primitive.ObjectIDFromHex(comment.ImageID)
+
+	if _, visible := getVisibleImageAuthorOrRespond(w, common.GetViewer(uid), imageHex); !visible {
+		return
+	}
+
+	channel := make(chan *database.UpdateResponse)
+
+	go updateCommentText(uid, *hex, text, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if res.Matched == 0 {
+		http.Error(w, commentNotFound, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+	[DELETE]
+
+	Deletes a comment and its replies. Comments can be deleted by their author, and by the author of the image they
+	are on.
+
+	JSON body parameters:
+		- _id: the comment ID.
+
+	Returns:
+		- 200: Comment deleted.
+		- 400: Invalid body or ID.
+		- 404: Comment not found, or user does not have permission to delete it. (no difference.)
+		- 500: Internal server error.
+*/
+func deleteComment(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	body := &commentBody{}
+
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hex, hexErr := parseObjectID(body.ID, "comment")
+
+	if hexErr != nil {
+		http.Error(w, hexErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	comment, ok := getCommentOrRespond(w, *hex)
+
+	if !ok {
+		return
+	}
+
+	if comment.AuthorID != uid {
+		imageHex, _ := primitive.ObjectIDFromHex(comment.ImageID)
+		authorChannel := make(chan imageAuthorResponse)
+
+		go getVisibleImageAuthor(common.GetViewer(uid), imageHex, authorChannel)
+
+		imageAuthor := <-authorChannel
+
+		if imageAuthor.err != nil {
+			log.Println(imageAuthor.err)
+			common.SendInternalServerError(w)
+			return
+		}
+
+		if imageAuthor.authorID != uid {
+			http.Error(w, commentNotFound, http.StatusNotFound)
+			return
+		}
+	}
+
+	channel := make(chan *database.DeleteResponse)
+
+	go deleteCommentFromDatabase(*hex, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if res.NumberDeleted == 0 {
+		http.Error(w, commentNotFound, http.StatusNotFound)
+		return
+	}
+
+	if comment.ParentID != "" {
+		if parentHex, err := primitive.ObjectIDFromHex(comment.ParentID); err == nil {
+			countChannel := make(chan *database.UpdateResponse)
+
+			go updateReplyCount(parentHex, -1, countChannel)
+
+			if countRes := <-countChannel; countRes.Err != nil {
+				log.Println("could not update reply count of comment " + comment.ParentID + ": " + countRes.Err.Error())
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+	[PATCH]
+
+	Hides a comment on one of the user's images from everyone but the user and the comment's author, or shows it
+	again.
+
+	JSON body parameters:
+		- _id: the comment ID.
+		- hidden: Optional. false to show the comment again. Default true.
+
+	Returns:
+		- 200: Comment hidden or shown.
+		- 400: Invalid body or ID.
+		- 404: Comment not found, or user is not the author of its image. (no difference.)
+		- 500: Internal server error.
+*/
+func hideComment(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	body := &commentBody{}
+
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hex, hexErr := parseObjectID(body.ID, "comment")
+
+	if hexErr != nil {
+		http.Error(w, hexErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hidden := true
+
+	if body.Hidden != nil {
+		hidden = *body.Hidden
+	}
+
+	comment, ok := getCommentOrRespond(w, *hex)
+
+	if !ok {
+		return
+	}
+
+	imageHex, _ := primitive.ObjectIDFromHex(comment.ImageID)
+	authorChannel := make(chan imageAuthorResponse)
+
+	go getVisibleImageAuthor(common.GetViewer(uid), imageHex, authorChannel)
+
+	imageAuthor := <-authorChannel
+
+	if imageAuthor.err != nil {
+		log.Println(imageAuthor.err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if imageAuthor.authorID != uid {
+		http.Error(w, commentNotFound, http.StatusNotFound)
+		return
+	}
+
+	channel := make(chan *database.UpdateResponse)
+
+	go setCommentHidden(*hex, hidden, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if res.Matched == 0 {
+		http.Error(w, commentNotFound, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func ServeCommentRoutes(r *mux.Router) {
+	createCommentIndexes()
+
+	r.HandleFunc("/getComments", getComments).Methods("GET")
+
+	s := r.Methods("DELETE", "PATCH", "POST").Subrouter()
+
+	s.Use(middleware.JWTMiddleware)
+
+	s.HandleFunc("/addComment", addComment).Methods("POST")
+	s.HandleFunc("/editComment", editComment).Methods("PATCH")
+	s.HandleFunc("/deleteComment", deleteComment).Methods("DELETE")
+	s.HandleFunc("/hideComment", hideComment).Methods("PATCH")
+}
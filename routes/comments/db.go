@@ -0,0 +1,163 @@
+package comments
+
+import (
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/users"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"time"
+)
+
+type commentDatabaseResponse struct {
+	comments []*model.Comment
+	err      error
+}
+
+// The author of an image, or an empty string if the image does not exist or is not visible.
+type imageAuthorResponse struct {
+	authorID string
+	err      error
+}
+
+/**
+Creates the indexes that comment queries rely on.
+*/
+func createCommentIndexes() {
+	indexes := []bson.D{
+		{{"imageID", 1}, {"parentID", 1}, {"_id", 1}},
+		{{"parentID", 1}},
+	}
+
+	for _, k := range indexes {
+		if err := database.CreateIndex("comments", k, nil); err != nil {
+			log.Println("could not create comment index: " + err.Error())
+		}
+	}
+}
+
+/**
+Gets the author of an image if the image is visible to the viewer.
+*/
+func getVisibleImageAuthor(viewer *common.Viewer, imageid primitive.ObjectID, channel chan imageAuthorResponse) {
+	authorID, err := common.GetVisibleImageAuthor(viewer, imageid)
+
+	channel <- imageAuthorResponse{authorID: authorID, err: err}
+}
+
+func getCommentsFromDatabase(filter bson.D, opts *options.FindOptions, channel chan commentDatabaseResponse) {
+	res := database.Find("comments", filter, opts)
+
+	if res.Err != nil {
+		channel <- commentDatabaseResponse{comments: nil, err: res.Err}
+		return
+	}
+
+	commentList := []*model.Comment{}
+
+	for _, k := range res.Result {
+		comment := model.Comment{}
+
+		bsonBytes, _ := bson.Marshal(k)
+
+		_ = bson.Unmarshal(bsonBytes, &comment)
+
+		commentList = append(commentList, &comment)
+	}
+
+	channel <- commentDatabaseResponse{comments: commentList, err: nil}
+}
+
+func getComment(commentid primitive.ObjectID, channel chan commentDatabaseResponse) {
+	getCommentsFromDatabase(bson.D{{"_id", commentid}}, nil, channel)
+}
+
+func insertComment(comment model.Comment, channel chan *database.InsertResponse) {
+	channel <- database.InsertOne("comments", comment, nil)
+}
+
+// Changes the replyCount of a top-level comment by delta.
+func updateReplyCount(commentid primitive.ObjectID, delta int64, channel chan *database.UpdateResponse) {
+	update := bson.D{{"$inc", bson.D{{"replyCount", delta}}}}
+
+	channel <- database.UpdateOne("comments", bson.D{{"_id", commentid}}, update, nil)
+}
+
+func updateCommentText(userid string, commentid primitive.ObjectID, text string, channel chan *database.UpdateResponse) {
+	filter := bson.D{{"$and", []bson.D{
+		{{"_id", commentid}},
+		{{"authorid", userid}},
+	}}}
+
+	update := bson.D{{"$set", bson.D{
+		{"text", text},
+		{"editedAt", time.Now()},
+	}}}
+
+	channel <- database.UpdateOne("comments", filter, update, nil)
+}
+
+func setCommentHidden(commentid primitive.ObjectID, hidden bool, channel chan *database.UpdateResponse) {
+	update := bson.D{{"$set", bson.D{{"hidden", hidden}}}}
+
+	if !hidden {
+		update = bson.D{{"$unset", bson.D{{"hidden", ""}}}}
+	}
+
+	channel <- database.UpdateOne("comments", bson.D{{"_id", commentid}}, update, nil)
+}
+
+// Deletes a comment and its replies.
+func deleteCommentFromDatabase(commentid primitive.ObjectID, channel chan *database.DeleteResponse) {
+	filter := bson.D{{"$or", []bson.D{
+		{{"_id", commentid}},
+		{{"parentID", commentid.Hex()}},
+	}}}
+
+	channel <- database.Delete("comments", filter, nil)
+}
+
+/**
+Deletes every comment on the given images. Called when images are deleted.
+*/
+func DeleteImageComments(imageIDs []string, channel chan *database.DeleteResponse) {
+	channel <- database.Delete("comments", bson.D{{"imageID", bson.D{{"$in", imageIDs}}}}, nil)
+}
+
+// Appends author to each comment in the list.
+func appendAuthorsToComments(comments []*model.Comment) {
+	idSet := make(map[string]bool)
+	userIDs := []primitive.ObjectID{}
+
+	for _, k := range comments {
+		if hex, err := primitive.ObjectIDFromHex(k.AuthorID); err == nil && !idSet[k.AuthorID] {
+			idSet[k.AuthorID] = true
+			userIDs = append(userIDs, hex)
+		}
+	}
+
+	filter := bson.D{{"_id", bson.D{{"$in", userIDs}}}}
+	projection := bson.D{{"name", 1}, {"userHandle", 1}}
+
+	c := make(chan []users.FindUserResponse)
+	go users.GetUsersFromDatabase(filter, projection, c)
+
+	res := <-c
+
+	if len(res) == 1 && res[0].Err != nil {
+		return
+	}
+
+	userMap := make(map[string]model.User)
+
+	for _, k := range res {
+		userMap[k.User.ID] = k.User
+	}
+
+	for _, k := range comments {
+		k.SetAuthor(userMap[k.AuthorID])
+	}
+}
@@ -0,0 +1,108 @@
+package common
+
+import (
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+)
+
+var publicFilter = bson.D{{"accessLevel", "public"}}
+
+/**
+Matches image documents that are fully created and not being deleted. Every query that returns images to users must
+include it.
+*/
+var CommittedImageFilter = bson.D{{"status", bson.D{{"$nin", []string{model.ImageStatusPending, model.ImageStatusDeleting, model.ImageStatusBroken}}}}}
+
+/**
+A user that documents are shown to, and the groups they are a member of.
+*/
+type Viewer struct {
+	UserID   string
+	GroupIDs []string
+}
+
+/**
+Gets the viewer for the given user, looking up the groups they are a member of. Each request gets its viewer once and
+passes it to every visibility check it makes, so membership is looked up once per request; as it is looked up on every
+request, removing a member from a group revokes their access straight away. If the lookup fails, the user is treated
+as a member of no groups.
+
+Anonymous users, with an empty user ID, can only see public documents, so nothing is looked up for them.
+*/
+func GetViewer(userid string) *Viewer {
+	viewer := &Viewer{UserID: userid}
+
+	if userid != "" {
+		viewer.GroupIDs = getMemberGroupIDs(userid)
+	}
+
+	return viewer
+}
+
+/**
+Builds the filters that match documents visible to the given viewer: public documents, documents whose access list
+contains the viewer or one of the groups the viewer is a member of, and the viewer's own documents. Any one of them
+must match.
+
+Used for images and albums, which share the accessLevel, accessListIDs and authorid fields. Only images have
+accessListGroupIDs.
+*/
+func BuildVisibilityFilters(viewer *Viewer) []interface{} {
+	filters := []interface{}{publicFilter}
+
+	if viewer.UserID != "" {
+		filters = append(filters, bson.D{{"accessListIDs", viewer.UserID}})
+		filters = append(filters, bson.D{{"authorid", viewer.UserID}})
+
+		if len(viewer.GroupIDs) > 0 {
+			filters = append(filters, bson.D{{"accessListGroupIDs", bson.D{{"$in", viewer.GroupIDs}}}})
+		}
+	}
+
+	return filters
+}
+
+/**
+Gets the author of a committed image if the image is visible to the viewer, or an empty string if it is not.
+*/
+func GetVisibleImageAuthor(viewer *Viewer, imageid primitive.ObjectID) (string, error) {
+	filter := bson.D{{"$and", []bson.D{
+		{{"_id", imageid}},
+		{{"$or", BuildVisibilityFilters(viewer)}},
+		CommittedImageFilter,
+	}}}
+
+	res := database.FindOne("images", filter, options.FindOne().SetProjection(bson.D{{"authorid", 1}}))
+
+	if res.Err != nil {
+		return "", res.Err
+	}
+
+	authorID, _ := res.Result["authorid"].(string)
+
+	return authorID, nil
+}
+
+// Gets the IDs of the groups that the given user is a member of.
+func getMemberGroupIDs(userid string) []string {
+	res := database.Find("groups", bson.D{{"memberIDs", userid}}, options.Find().SetProjection(bson.D{{"_id", 1}}))
+
+	if res.Err != nil {
+		log.Println("could not look up groups of user " + userid + ": " + res.Err.Error())
+		return nil
+	}
+
+	groupIDs := []string{}
+
+	for _, k := range res.Result {
+		if id, ok := k["_id"].(primitive.ObjectID); ok {
+			groupIDs = append(groupIDs, id.Hex())
+		}
+	}
+
+	return groupIDs
+}
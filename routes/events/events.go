@@ -0,0 +1,108 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/middleware"
+	"net/http"
+	"time"
+)
+
+// How often an idle stream is sent a comment, so that proxies do not close it.
+const heartbeatInterval = 30 * time.Second
+
+const (
+	reasonOverflow = "overflow"
+	reasonShutdown = "shutdown"
+)
+
+/**
+	[GET] text/event-stream
+
+	Streams events to the user as Server-Sent Events. Each event has its type as the event name, and its data as JSON:
+		- imageCreated: a new image that the user can see. The image, as returned by getImagesMetadata without its
+		  author.
+		- imageLiked, imageUnliked: someone liked or unliked one of the user's images. The imageID, and the userid of
+		  who did it.
+		- imageShared: someone added the user to the access list of one of their images. The imageID, and the
+		  authorid of the image.
+		- followed: someone followed the user, or asked to. The userid of the follower, and the status of the follow.
+
+	Events are only sent while the stream is open. If the user falls too far behind, an overflow event is sent and the
+	stream is closed; the client should refetch what it shows before reconnecting. A close event with reason shutdown
+	is sent when the server shuts down.
+
+	Returns:
+		- 200: The stream.
+		- 429: The user already has too many streams open.
+		- 500: Streaming is not supported by the connection.
+*/
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		common.SendInternalServerError(w)
+		return
+	}
+
+	s := defaultHub.subscribe(uid)
+
+	if s == nil {
+		http.Error(w, "too many event streams open", http.StatusTooManyRequests)
+		return
+	}
+
+	defer defaultHub.unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	var id int64
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			if s.reason == reasonOverflow {
+				_, _ = fmt.Fprint(w, "event: overflow\ndata: {}\n\n")
+			} else {
+				_, _ = fmt.Fprintf(w, "event: close\ndata: {\"reason\":%q}\n\n", s.reason)
+			}
+			flusher.Flush()
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event := <-s.events:
+			data, err := json.Marshal(event.Data)
+
+			if err != nil {
+				continue
+			}
+
+			id++
+
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, event.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func ServeEventRoutes(r *mux.Router) {
+	r.Handle("/stream", middleware.JWTMiddleware(http.HandlerFunc(streamEvents))).Methods("GET")
+}
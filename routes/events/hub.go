@@ -0,0 +1,195 @@
+package events
+
+import (
+	"sync"
+)
+
+// Events buffered for each subscriber. A subscriber that falls this far behind is disconnected.
+const subscriberBuffer = 64
+
+// Most streams one user can have open at once.
+const maxSubscriptionsPerUser = 5
+
+const (
+	// A new image that the subscriber can see was uploaded.
+	TypeImageCreated = "imageCreated"
+	// Someone liked one of the subscriber's images.
+	TypeImageLiked = "imageLiked"
+	// Someone unliked one of the subscriber's images.
+	TypeImageUnliked = "imageUnliked"
+	// Someone added the subscriber to the access list of one of their images.
+	TypeImageShared = "imageShared"
+	// Someone followed the subscriber, or asked to.
+	TypeFollowed = "followed"
+)
+
+/**
+Who can receive an event. Public events go to every subscriber; the rest only go to the listed users.
+*/
+type Audience struct {
+	Public  bool
+	UserIDs []string
+}
+
+func (a Audience) includes(userid string) bool {
+	if a.Public {
+		return true
+	}
+
+	for _, k := range a.UserIDs {
+		if k == userid {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+The audience of an event about an image: everyone if it is public, otherwise its author and the users on its access
+list, including the members of the groups on it. Mirrors common.BuildVisibilityFilters.
+*/
+func ImageAudience(accessLevel string, authorID string, accessListIDs []string) Audience {
+	if accessLevel == "public" {
+		return Audience{Public: true}
+	}
+
+	return Audience{UserIDs: append([]string{authorID}, accessListIDs...)}
+}
+
+// The audience of an event that only concerns the given user.
+func UserAudience(userid string) Audience {
+	return Audience{UserIDs: []string{userid}}
+}
+
+// The data of imageLiked and imageUnliked events.
+type LikeData struct {
+	ImageID string `json:"imageID"`
+	UserID  string `json:"userid"`
+}
+
+// The data of imageShared events.
+type ShareData struct {
+	ImageID  string `json:"imageID"`
+	AuthorID string `json:"authorid"`
+}
+
+// The data of followed events.
+type FollowData struct {
+	UserID string `json:"userid"`
+	Status string `json:"status"`
+}
+
+type Event struct {
+	Type     string
+	Data     interface{}
+	Audience Audience
+}
+
+type subscriber struct {
+	userid string
+	events chan Event
+	// Closed when the subscriber has to stop: it fell behind, or the server is shutting down.
+	done chan struct{}
+	// Why done was closed. Only read after done is closed.
+	reason string
+	once   sync.Once
+}
+
+func (s *subscriber) stop(reason string) {
+	s.once.Do(func() {
+		s.reason = reason
+		close(s.done)
+	})
+}
+
+type hub struct {
+	mu          sync.RWMutex
+	subscribers map[*subscriber]bool
+	perUser     map[string]int
+}
+
+var defaultHub = &hub{
+	subscribers: make(map[*subscriber]bool),
+	perUser:     make(map[string]int),
+}
+
+// Adds a subscriber for the given user, or returns nil if the user already has too many.
+func (h *hub) subscribe(userid string) *subscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.perUser[userid] >= maxSubscriptionsPerUser {
+		return nil
+	}
+
+	s := &subscriber{
+		userid: userid,
+		events: make(chan Event, subscriberBuffer),
+		done:   make(chan struct{}),
+	}
+
+	h.subscribers[s] = true
+	h.perUser[userid]++
+
+	return s
+}
+
+func (h *hub) unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.subscribers[s] {
+		return
+	}
+
+	delete(h.subscribers, s)
+
+	if h.perUser[s.userid]--; h.perUser[s.userid] == 0 {
+		delete(h.perUser, s.userid)
+	}
+}
+
+/**
+Sends an event to every subscriber in its audience. Never blocks: a subscriber whose buffer is full is disconnected
+instead, and has to catch up through the regular endpoints when it reconnects.
+*/
+func (h *hub) publish(event Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for s := range h.subscribers {
+		if !event.Audience.includes(s.userid) {
+			continue
+		}
+
+		select {
+		case s.events <- event:
+		default:
+			s.stop(reasonOverflow)
+		}
+	}
+}
+
+func (h *hub) closeAll() {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for s := range h.subscribers {
+		s.stop(reasonShutdown)
+	}
+}
+
+/**
+Publishes an event to the connected subscribers in its audience. Safe to call from any handler: it never blocks.
+*/
+func Publish(event Event) {
+	defaultHub.publish(event)
+}
+
+/**
+Ends every open stream. Called when the server shuts down, since open streams would otherwise hold it up.
+*/
+func CloseAll() {
+	defaultHub.closeAll()
+}
@@ -0,0 +1,191 @@
+package groups
+
+import (
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"time"
+)
+
+type groupDatabaseResponse struct {
+	groups []*model.Group
+	err    error
+}
+
+/**
+Creates the indexes that group queries rely on. Group names are unique for each author.
+*/
+func createGroupIndexes() {
+	if err := database.CreateIndex("groups", bson.D{{"authorid", 1}, {"name", 1}}, options.Index().SetUnique(true)); err != nil {
+		log.Println("could not create group index: " + err.Error())
+	}
+
+	// Visibility filters look up the groups that a user is a member of.
+	if err := database.CreateIndex("groups", bson.D{{"memberIDs", 1}}, nil); err != nil {
+		log.Println("could not create group index: " + err.Error())
+	}
+}
+
+func getGroupsFromDatabase(filter bson.D, opts *options.FindOptions, channel chan groupDatabaseResponse) {
+	res := database.Find("groups", filter, opts)
+
+	if res.Err != nil {
+		channel <- groupDatabaseResponse{groups: nil, err: res.Err}
+		return
+	}
+
+	groupList := []*model.Group{}
+
+	for _, k := range res.Result {
+		group := model.Group{}
+
+		bsonBytes, _ := bson.Marshal(k)
+
+		_ = bson.Unmarshal(bsonBytes, &group)
+
+		groupList = append(groupList, &group)
+	}
+
+	channel <- groupDatabaseResponse{groups: groupList, err: nil}
+}
+
+func countGroups(userid string) (int64, error) {
+	pipeline := []bson.D{
+		{{"$match", bson.D{{"authorid", userid}}}},
+		{{"$count", "count"}},
+	}
+
+	res := database.Aggregate("groups", pipeline, nil)
+
+	if res.Err != nil || len(res.Result) == 0 {
+		return 0, res.Err
+	}
+
+	switch n := res.Result[0]["count"].(type) {
+	case int32:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	}
+
+	return 0, nil
+}
+
+func insertGroup(group model.Group, channel chan *database.InsertResponse) {
+	channel <- database.InsertOne("groups", group, nil)
+}
+
+/**
+Updates one of the user's groups. condition, if not nil, must also match the group, so that concurrent edits of its
+members cannot push it past its size limit.
+*/
+func updateOwnGroup(userid string, groupid primitive.ObjectID, condition bson.D, update bson.D, channel chan *database.UpdateResponse) {
+	filter := bson.D{{"_id", groupid}, {"authorid", userid}}
+
+	if condition != nil {
+		filter = append(filter, condition...)
+	}
+
+	update = withUpdatedAt(update)
+
+	channel <- database.UpdateOne("groups", filter, update, nil)
+}
+
+// Adds updatedAt to the $set of an update, adding a $set if it has none.
+func withUpdatedAt(update bson.D) bson.D {
+	for i, k := range update {
+		if set, ok := k.Value.(bson.D); ok && k.Key == "$set" {
+			update[i].Value = append(set, bson.E{Key: "updatedAt", Value: time.Now()})
+			return update
+		}
+	}
+
+	return append(update, bson.E{Key: "$set", Value: bson.D{{"updatedAt", time.Now()}}})
+}
+
+// Deletes one of the user's groups, and removes it from the access lists of the images shared with it.
+func deleteOwnGroup(userid string, groupid primitive.ObjectID, channel chan *database.DeleteResponse) {
+	res := database.DeleteOne("groups", bson.D{{"_id", groupid}, {"authorid", userid}}, nil)
+
+	if res.Err != nil || res.NumberDeleted == 0 {
+		channel <- res
+		return
+	}
+
+	filter := bson.D{{"accessListGroupIDs", groupid.Hex()}}
+	update := bson.D{{"$pull", bson.D{{"accessListGroupIDs", groupid.Hex()}}}}
+
+	if pulled := database.Update("images", filter, update, nil); pulled.Err != nil {
+		channel <- &database.DeleteResponse{NumberDeleted: res.NumberDeleted, Err: pulled.Err}
+		return
+	}
+
+	channel <- res
+}
+
+/**
+Gets the IDs of the members of the given groups, without duplicates.
+*/
+func GetMemberIDs(groupIDs []string) ([]string, error) {
+	if len(groupIDs) == 0 {
+		return []string{}, nil
+	}
+
+	hexes := []primitive.ObjectID{}
+
+	for _, k := range groupIDs {
+		if hex, err := primitive.ObjectIDFromHex(k); err == nil {
+			hexes = append(hexes, hex)
+		}
+	}
+
+	channel := make(chan groupDatabaseResponse)
+
+	go getGroupsFromDatabase(bson.D{{"_id", bson.D{{"$in", hexes}}}}, options.Find().SetProjection(bson.D{{"memberIDs", 1}}), channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	seen := make(map[string]bool)
+	members := []string{}
+
+	for _, group := range res.groups {
+		for _, k := range group.MemberIDs {
+			if !seen[k] {
+				seen[k] = true
+				members = append(members, k)
+			}
+		}
+	}
+
+	return members, nil
+}
+
+/**
+Checks that every given group exists and belongs to the user. Returns false if any does not.
+*/
+func OwnsGroups(userid string, groupIDs []primitive.ObjectID) (bool, error) {
+	if len(groupIDs) == 0 {
+		return true, nil
+	}
+
+	channel := make(chan groupDatabaseResponse)
+
+	filter := bson.D{{"_id", bson.D{{"$in", groupIDs}}}, {"authorid", userid}}
+
+	go getGroupsFromDatabase(filter, options.Find().SetProjection(bson.D{{"_id", 1}}), channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		return false, res.err
+	}
+
+	return len(res.groups) == len(groupIDs), nil
+}
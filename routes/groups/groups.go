@@ -0,0 +1,530 @@
+package groups
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/middleware"
+	"github.com/kilowatt-/ImageRepository/routes/users"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const groupNotFound = "group not found"
+
+// Longest group name, in characters.
+const maxNameLength = 100
+
+// Most groups one user can have.
+const maxGroupsPerUser = 100
+
+// Most members one group can have.
+const maxGroupMembers = 500
+
+// The JSON body of the group endpoints. Each endpoint documents which fields it uses.
+type groupBody struct {
+	ID        string   `json:"_id,omitempty"`
+	Name      *string  `json:"name,omitempty"`
+	MemberIDs []string `json:"memberIDs,omitempty"`
+}
+
+// A request that cannot be carried out, and the status to refuse it with.
+type groupError struct {
+	status  int
+	message string
+}
+
+func (e *groupError) Error() string {
+	return e.message
+}
+
+// Responds with the status of a groupError, or a 500 for any other error.
+func sendGroupError(w http.ResponseWriter, err error) {
+	if refused, ok := err.(*groupError); ok {
+		http.Error(w, refused.message, refused.status)
+		return
+	}
+
+	log.Println(err)
+	common.SendInternalServerError(w)
+}
+
+/**
+Decodes the JSON body of a group request. If requireID is set, the body must name a group.
+
+Returns the body and the group ID, which is nil if the body does not name one.
+*/
+func decodeGroupBody(r *http.Request, requireID bool) (*groupBody, *primitive.ObjectID, error) {
+	body := &groupBody{}
+
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		return nil, nil, err
+	}
+
+	if body.ID == "" {
+		if requireID {
+			return nil, nil, errors.New("group id not passed in")
+		}
+		return body, nil, nil
+	}
+
+	hex, err := primitive.ObjectIDFromHex(body.ID)
+
+	if err != nil {
+		return nil, nil, errors.New("invalid group ID passed in: " + body.ID)
+	}
+
+	return body, &hex, nil
+}
+
+// Trims a group name and checks that it is not empty or too long.
+func validateName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+
+	if name == "" {
+		return "", &groupError{http.StatusBadRequest, "name must not be empty"}
+	}
+
+	if utf8.RuneCountInString(name) > maxNameLength {
+		return "", &groupError{http.StatusBadRequest, "name is longer than " + strconv.Itoa(maxNameLength) + " characters"}
+	}
+
+	return name, nil
+}
+
+/**
+Checks that the given members exist and do not include the group's author, and removes duplicates.
+*/
+func validateMembers(userid string, memberIDs []string) ([]string, error) {
+	seen := make(map[string]bool)
+	unique := []string{}
+	hexes := []primitive.ObjectID{}
+
+	for _, k := range memberIDs {
+		if seen[k] {
+			continue
+		}
+
+		if k == userid {
+			return nil, &groupError{http.StatusBadRequest, "users cannot be members of their own groups"}
+		}
+
+		hex, err := primitive.ObjectIDFromHex(k)
+
+		if err != nil {
+			return nil, &groupError{http.StatusBadRequest, "invalid user ID passed in: " + k}
+		}
+
+		seen[k] = true
+		unique = append(unique, k)
+		hexes = append(hexes, hex)
+	}
+
+	if len(hexes) == 0 {
+		return unique, nil
+	}
+
+	channel := make(chan []users.FindUserResponse)
+
+	go users.GetUsersFromDatabase(bson.D{{"_id", bson.D{{"$in", hexes}}}}, bson.D{{"_id", 1}}, channel)
+
+	res := <-channel
+
+	if len(res) == 1 && res[0].Err != nil {
+		return nil, res[0].Err
+	}
+
+	if len(res) != len(hexes) {
+		return nil, &groupError{http.StatusNotFound, "not all members found"}
+	}
+
+	return unique, nil
+}
+
+/**
+	[GET]
+
+	Gets the user's groups, ordered by name.
+
+	Returns: (application/json)
+		- 200: The groups, each with its _id, name and memberIDs.
+		- 500: Internal server error.
+*/
+func getGroups(w http.ResponseWriter, r *http.Request) {
+	channel := make(chan groupDatabaseResponse)
+
+	opts := options.Find().SetSort(bson.D{{"name", 1}})
+
+	go getGroupsFromDatabase(bson.D{{"authorid", middleware.GetUserIDFromToken(r)}}, opts, channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		log.Println(res.err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	jsonResponse, _ := json.Marshal(res.groups)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonResponse)
+}
+
+/**
+	[POST]
+
+	Creates a group.
+
+	JSON body parameters:
+		- name: the group name. Required; at most 100 characters, and unique among the user's groups.
+		- memberIDs: Optional. An array of user IDs. At most 500.
+
+	Returns: (application/json)
+		- 200: The ID of the new group.
+		- 400: Invalid body, name or member ID, too many members, the user tried to add themselves, or the user already
+		  has 100 groups.
+		- 404: Not all members found.
+		- 409: The user already has a group with this name.
+		- 500: Internal server error.
+*/
+func createGroup(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	body, _, decodeErr := decodeGroupBody(r, false)
+
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if body.Name == nil {
+		http.Error(w, "name not passed in", http.StatusBadRequest)
+		return
+	}
+
+	name, nameErr := validateName(*body.Name)
+
+	if nameErr != nil {
+		sendGroupError(w, nameErr)
+		return
+	}
+
+	if len(body.MemberIDs) > maxGroupMembers {
+		http.Error(w, "a group can have at most "+strconv.Itoa(maxGroupMembers)+" members", http.StatusBadRequest)
+		return
+	}
+
+	members, membersErr := validateMembers(uid, body.MemberIDs)
+
+	if membersErr != nil {
+		sendGroupError(w, membersErr)
+		return
+	}
+
+	count, countErr := countGroups(uid)
+
+	if countErr != nil {
+		log.Println(countErr)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if count >= maxGroupsPerUser {
+		http.Error(w, "a user can have at most "+strconv.Itoa(maxGroupsPerUser)+" groups", http.StatusBadRequest)
+		return
+	}
+
+	group := model.Group{
+		AuthorID:  uid,
+		Name:      name,
+		MemberIDs: members,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	channel := make(chan *database.InsertResponse)
+
+	go insertGroup(group, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
+		if strings.Contains(res.Err.Error(), "E11000") {
+			http.Error(w, "group "+name+" already exists", http.StatusConflict)
+			return
+		}
+
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	jsonResponse, _ := json.Marshal(model.Group{ID: res.ID})
+	_, _ = w.Write(jsonResponse)
+}
+
+/**
+	[PATCH]
+
+	Renames one of the user's groups.
+
+	JSON body parameters:
+		- _id: the group ID.
+		- name: the new name. At most 100 characters, and unique among the user's groups.
+
+	Returns:
+		- 200: Group renamed.
+		- 400: Invalid body, ID or name.
+		- 404: Group not found.
+		- 409: The user already has a group with this name.
+		- 500: Internal server error.
+*/
+func editGroup(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	body, hex, decodeErr := decodeGroupBody(r, true)
+
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if body.Name == nil {
+		http.Error(w, "name not passed in", http.StatusBadRequest)
+		return
+	}
+
+	name, nameErr := validateName(*body.Name)
+
+	if nameErr != nil {
+		sendGroupError(w, nameErr)
+		return
+	}
+
+	channel := make(chan *database.UpdateResponse)
+
+	go updateOwnGroup(uid, *hex, nil, bson.D{{"$set", bson.D{{"name", name}}}}, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
+		if strings.Contains(res.Err.Error(), "E11000") {
+			http.Error(w, "group "+name+" already exists", http.StatusConflict)
+			return
+		}
+
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if res.Matched == 0 {
+		http.Error(w, groupNotFound, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+	[DELETE]
+
+	Deletes one of the user's groups. Its members lose access to the images that were shared with them only through
+	the group.
+
+	JSON body parameters:
+		- _id: the group ID.
+
+	Returns:
+		- 200: Group deleted.
+		- 400: Invalid body or ID.
+		- 404: Group not found.
+		- 500: Internal server error.
+*/
+func deleteGroup(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	_, hex, decodeErr := decodeGroupBody(r, true)
+
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	channel := make(chan *database.DeleteResponse)
+
+	go deleteOwnGroup(uid, *hex, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if res.NumberDeleted == 0 {
+		http.Error(w, groupNotFound, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+	[PATCH]
+
+	Adds members to one of the user's groups. They can see every image shared with the group straight away. Members
+	already in the group are ignored.
+
+	JSON body parameters:
+		- _id: the group ID.
+		- memberIDs: an array of user IDs.
+
+	Returns:
+		- 200: Members added.
+		- 400: Invalid body or ID, no members passed in, the user tried to add themselves, or the group would have more
+		  than 500 members.
+		- 404: Group not found, or not all members found.
+		- 500: Internal server error.
+*/
+func addGroupMembers(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	body, hex, decodeErr := decodeGroupBody(r, true)
+
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(body.MemberIDs) == 0 {
+		http.Error(w, "no members passed in", http.StatusBadRequest)
+		return
+	}
+
+	if len(body.MemberIDs) > maxGroupMembers {
+		http.Error(w, "a group can have at most "+strconv.Itoa(maxGroupMembers)+" members", http.StatusBadRequest)
+		return
+	}
+
+	members, membersErr := validateMembers(uid, body.MemberIDs)
+
+	if membersErr != nil {
+		sendGroupError(w, membersErr)
+		return
+	}
+
+	// The group must have room for every new member, counting those that may already be in it.
+	room := bson.D{{"$expr", bson.D{{"$lte", bson.A{
+		bson.D{{"$size", bson.D{{"$setUnion", bson.A{"$memberIDs", members}}}}},
+		maxGroupMembers,
+	}}}}}
+	update := bson.D{{"$addToSet", bson.D{{"memberIDs", bson.D{{"$each", members}}}}}}
+	channel := make(chan *database.UpdateResponse)
+
+	go updateOwnGroup(uid, *hex, room, update, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if res.Matched == 0 {
+		// Tell a full group apart from a missing one.
+		found := make(chan groupDatabaseResponse)
+
+		go getGroupsFromDatabase(bson.D{{"_id", *hex}, {"authorid", uid}}, nil, found)
+
+		if existing := <-found; existing.err == nil && len(existing.groups) > 0 {
+			http.Error(w, "a group can have at most "+strconv.Itoa(maxGroupMembers)+" members", http.StatusBadRequest)
+			return
+		}
+
+		http.Error(w, groupNotFound, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+	[PATCH]
+
+	Removes members from one of the user's groups. They immediately lose access to every image shared with them only
+	through the group. IDs that are not members are ignored.
+
+	JSON body parameters:
+		- _id: the group ID.
+		- memberIDs: an array of user IDs.
+
+	Returns:
+		- 200: Members removed.
+		- 400: Invalid body or ID, or no members passed in.
+		- 404: Group not found.
+		- 500: Internal server error.
+*/
+func removeGroupMembers(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	body, hex, decodeErr := decodeGroupBody(r, true)
+
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(body.MemberIDs) == 0 {
+		http.Error(w, "no members passed in", http.StatusBadRequest)
+		return
+	}
+
+	channel := make(chan *database.UpdateResponse)
+
+	go updateOwnGroup(uid, *hex, nil, bson.D{{"$pullAll", bson.D{{"memberIDs", body.MemberIDs}}}}, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if res.Matched == 0 {
+		http.Error(w, groupNotFound, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func ServeGroupRoutes(r *mux.Router) {
+	createGroupIndexes()
+
+	r.Use(middleware.JWTMiddleware)
+
+	r.HandleFunc("/getGroups", getGroups).Methods("GET")
+	r.HandleFunc("/createGroup", createGroup).Methods("POST")
+	r.HandleFunc("/editGroup", editGroup).Methods("PATCH")
+	r.HandleFunc("/deleteGroup", deleteGroup).Methods("DELETE")
+	r.HandleFunc("/addGroupMembers", addGroupMembers).Methods("PATCH")
+	r.HandleFunc("/removeGroupMembers", removeGroupMembers).Methods("PATCH")
+}
@@ -0,0 +1,300 @@
+package images
+
+import (
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strconv"
+	"time"
+)
+
+// Kinds of problems found by Audit.
+const AuditMissingObject = "missingObject"
+const AuditSizeMismatch = "sizeMismatch"
+const AuditContentTypeMismatch = "contentTypeMismatch"
+const AuditMissingBlobRecord = "missingBlobRecord"
+const AuditMissingVariant = "missingVariant"
+const AuditDanglingBlobRecord = "danglingBlobRecord"
+const AuditOrphanedObject = "orphanedObject"
+
+// A single inconsistency between the images collection, the blobs collection and blob storage.
+type AuditIssue struct {
+	Kind    string
+	ImageID string
+	Key     string
+	Detail  string
+	Fixed   bool
+	FixErr  error
+}
+
+// The result of an audit.
+type AuditReport struct {
+	ImagesChecked  int
+	ObjectsChecked int
+	Issues         []AuditIssue
+}
+
+/**
+Compares every image document and blob record with the objects in blob storage, and reports:
+	- images whose original file is missing, or whose size or content type does not match their records;
+	- committed images whose blob record is missing;
+	- variants whose file is missing or has the wrong content type;
+	- blob records that reference images which no longer exist;
+	- stored objects that no image or blob record refers to.
+
+Pending and deleting images are skipped, as they are still being created or deleted. Images already marked as broken
+are skipped too.
+
+If fix is true, the problems are also repaired: images with a bad original are marked as broken, missing blob records
+are recreated, bad variants are removed from their image, dangling references are removed (deleting the blob if
+nothing else refers to it) and orphaned objects are deleted. Objects younger than an hour are never treated as
+orphans, so the audit can run while the server is handling uploads.
+*/
+func Audit(fix bool) (*AuditReport, error) {
+	report := &AuditReport{Issues: []AuditIssue{}}
+
+	res := database.Find("images", bson.D{}, nil)
+
+	if res.Err != nil {
+		return nil, res.Err
+	}
+
+	images := decodeImages(res.Result)
+
+	records, err := getBlobRecords()
+
+	if err != nil {
+		return nil, err
+	}
+
+	objectList, err := storage.List("")
+
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make(map[string]storage.ObjectInfo)
+
+	for _, k := range objectList {
+		objects[k.Key] = k
+	}
+
+	blobs := make(map[string]blobRecord)
+
+	for _, k := range records {
+		blobs[k.ID] = k
+	}
+
+	existing := make(map[string]bool)
+	legacyImages := make(map[string]bool)
+
+	for _, k := range images {
+		existing[k.ID] = true
+
+		if k.BlobKey == "" {
+			legacyImages[k.ID] = true
+		}
+
+		if k.Status == model.ImageStatusPending || k.Status == model.ImageStatusDeleting || k.Status == model.ImageStatusBroken {
+			continue
+		}
+
+		report.ImagesChecked++
+		report.Issues = append(report.Issues, auditImage(k, objects, blobs, fix)...)
+	}
+
+	for _, k := range records {
+		report.Issues = append(report.Issues, auditBlobRecord(k, existing, fix)...)
+	}
+
+	cutoff := time.Now().Add(-orphanObjectGracePeriod)
+
+	for _, k := range objectList {
+		owner, ok := ownerOfObject(k.Key)
+
+		if !ok || k.LastModified.After(cutoff) {
+			continue
+		}
+
+		report.ObjectsChecked++
+
+		if _, referenced := blobs[owner]; referenced || legacyImages[owner] {
+			continue
+		}
+
+		issue := AuditIssue{Kind: AuditOrphanedObject, Key: k.Key, Detail: "no image or blob record refers to this object"}
+
+		if fix {
+			if err := storage.Delete(k.Key); err != nil {
+				issue.FixErr = err
+			} else {
+				issue.Fixed = true
+			}
+		}
+
+		report.Issues = append(report.Issues, issue)
+	}
+
+	return report, nil
+}
+
+// Looks up a listed object. Listings do not include content types, so the object is also looked up individually.
+func statListedObject(objects map[string]storage.ObjectInfo, key string) (storage.ObjectInfo, bool) {
+	listed, exists := objects[key]
+
+	if !exists {
+		return listed, false
+	}
+
+	if info, err := storage.Stat(key); err == nil {
+		return *info, true
+	}
+
+	return listed, true
+}
+
+// Checks the original file, blob record and variants of a committed image.
+func auditImage(image *model.Image, objects map[string]storage.ObjectInfo, blobs map[string]blobRecord, fix bool) []AuditIssue {
+	issues := []AuditIssue{}
+	key := imageKey(image)
+	hex, _ := primitive.ObjectIDFromHex(image.ID)
+
+	object, stored := statListedObject(objects, key)
+	broken := []AuditIssue{}
+
+	if !stored {
+		broken = append(broken, AuditIssue{Kind: AuditMissingObject, ImageID: image.ID, Key: key, Detail: "original file is missing"})
+	} else {
+		if image.Info.ByteSize > 0 && image.Info.ByteSize != object.Size {
+			broken = append(broken, AuditIssue{Kind: AuditSizeMismatch, ImageID: image.ID, Key: key,
+				Detail: "image records " + strconv.FormatInt(image.Info.ByteSize, 10) + " bytes, stored file has " + strconv.FormatInt(object.Size, 10)})
+		}
+
+		if record, exists := blobs[key]; exists {
+			if record.Size != object.Size {
+				broken = append(broken, AuditIssue{Kind: AuditSizeMismatch, ImageID: image.ID, Key: key,
+					Detail: "blob records " + strconv.FormatInt(record.Size, 10) + " bytes, stored file has " + strconv.FormatInt(object.Size, 10)})
+			}
+
+			if record.ContentType != "" && object.ContentType != "" && record.ContentType != object.ContentType {
+				broken = append(broken, AuditIssue{Kind: AuditContentTypeMismatch, ImageID: image.ID, Key: key,
+					Detail: "blob records " + record.ContentType + ", stored file has " + object.ContentType})
+			}
+		} else if image.BlobKey != "" {
+			issue := AuditIssue{Kind: AuditMissingBlobRecord, ImageID: image.ID, Key: key, Detail: "blob record is missing"}
+
+			if fix {
+				issue.FixErr = acquireBlob(key, image.ID, object.Size, object.ContentType)
+				issue.Fixed = issue.FixErr == nil
+			}
+
+			issues = append(issues, issue)
+		}
+	}
+
+	if len(broken) > 0 {
+		// The image cannot be served correctly, so there is no point checking its variants.
+		if fix {
+			channel := make(chan *database.UpdateResponse)
+
+			go markImageBroken(hex, channel)
+
+			res := <-channel
+
+			for i := range broken {
+				broken[i].FixErr = res.Err
+				broken[i].Fixed = res.Err == nil
+			}
+		}
+
+		return append(issues, broken...)
+	}
+
+	for _, k := range image.Variants {
+		vKey := variantKey(key, k.Size)
+		issue := AuditIssue{ImageID: image.ID, Key: vKey}
+
+		if variant, exists := statListedObject(objects, vKey); !exists {
+			issue.Kind = AuditMissingVariant
+			issue.Detail = "variant file is missing"
+		} else if k.ContentType != "" && variant.ContentType != "" && k.ContentType != variant.ContentType {
+			issue.Kind = AuditContentTypeMismatch
+			issue.Detail = "image records " + k.ContentType + ", stored variant has " + variant.ContentType
+		} else {
+			continue
+		}
+
+		if fix {
+			channel := make(chan *database.UpdateResponse)
+
+			go removeImageVariant(hex, k.Size, channel)
+
+			issue.FixErr = (<-channel).Err
+			issue.Fixed = issue.FixErr == nil
+		}
+
+		issues = append(issues, issue)
+	}
+
+	return issues
+}
+
+/**
+Checks that every image a blob record refers to still exists.
+
+A record marked as deleting is always unreferenced, so fixing it finishes its deletion, as the reconciler would. This
+is safe even if the deletion is still in progress elsewhere, as deleting objects and the record twice does no harm.
+*/
+func auditBlobRecord(record blobRecord, existing map[string]bool, fix bool) []AuditIssue {
+	missing := []string{}
+
+	for _, ref := range record.Refs {
+		if !existing[ref] {
+			missing = append(missing, ref)
+		}
+	}
+
+	if len(missing) == 0 && len(record.Refs) > 0 {
+		return nil
+	}
+
+	issues := []AuditIssue{}
+
+	for _, ref := range missing {
+		issues = append(issues, AuditIssue{Kind: AuditDanglingBlobRecord, ImageID: ref, Key: record.ID, Detail: "blob refers to an image that does not exist"})
+	}
+
+	if record.Deleting {
+		issues = append(issues, AuditIssue{Kind: AuditDanglingBlobRecord, Key: record.ID, Detail: "blob is being deleted but its deletion has not finished"})
+	} else if len(record.Refs) == 0 {
+		issues = append(issues, AuditIssue{Kind: AuditDanglingBlobRecord, Key: record.ID, Detail: "blob is not referenced by any image"})
+	}
+
+	if fix && record.Deleting {
+		fixErr := finishBlobDeletion(record.ID)
+
+		for i := range issues {
+			issues[i].FixErr = fixErr
+			issues[i].Fixed = fixErr == nil
+		}
+	} else if fix {
+		var fixErr error
+
+		update := bson.D{{"$pullAll", bson.D{{"refs", missing}}}}
+
+		if res := database.UpdateOne(blobsCollection, bson.D{{"_id", record.ID}}, update, nil); res.Err != nil {
+			fixErr = res.Err
+		} else {
+			fixErr = deleteBlobIfUnreferenced(record.ID)
+		}
+
+		for i := range issues {
+			issues[i].FixErr = fixErr
+			issues[i].Fixed = fixErr == nil
+		}
+	}
+
+	return issues
+}
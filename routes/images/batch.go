@@ -0,0 +1,305 @@
+package images
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/middleware"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const defaultBatchUploadConcurrency = 4
+
+// Largest number of files in one batch upload.
+const maxBatchFiles = 50
+
+// Largest total size of a batch upload request, in bytes.
+const maxBatchSize = maxBatchFiles * maxUploadSize
+
+// Part of a batch upload request that is kept in memory; larger requests are buffered on disk.
+const batchMemoryLimit = 32 << 20
+
+// Number of files of a batch upload that are processed at the same time.
+var batchUploadConcurrency = defaultBatchUploadConcurrency
+
+// The settings of one file in a batch upload. Settings that are left out fall back to the request's form fields.
+type batchFileSettings struct {
+	Caption       *string   `json:"caption,omitempty"`
+	AccessLevel   *string   `json:"accessLevel,omitempty"`
+	AccessListIDs *[]string `json:"accessListIDs,omitempty"`
+	Tags          *[]string `json:"tags,omitempty"`
+	KeepMetadata  *bool     `json:"keepMetadata,omitempty"`
+	Duplicates    *string   `json:"duplicates,omitempty"`
+}
+
+// The outcome of one file in a batch upload.
+type batchFileResult struct {
+	Index      int      `json:"index"`
+	Filename   string   `json:"filename"`
+	Status     int      `json:"status"`
+	ID         string   `json:"_id,omitempty"`
+	Duplicates []string `json:"duplicates,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// A request body that counts the bytes read from it.
+type countingReadCloser struct {
+	io.ReadCloser
+	read int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.read += int64(n)
+
+	return n, err
+}
+
+/**
+Loads the batch upload concurrency from BATCH_UPLOAD_CONCURRENCY. Falls back to the default if it is missing or invalid.
+*/
+func loadBatchUploadConcurrency() {
+	concurrencyString, exists := os.LookupEnv("BATCH_UPLOAD_CONCURRENCY")
+
+	if !exists {
+		return
+	}
+
+	concurrency, err := strconv.Atoi(concurrencyString)
+
+	if err != nil || concurrency <= 0 {
+		log.Println("invalid BATCH_UPLOAD_CONCURRENCY; using default")
+		return
+	}
+
+	batchUploadConcurrency = concurrency
+}
+
+/**
+Builds the image for one file of a batch upload, filling in the settings it leaves out from the request's form fields.
+
+Returns the image, whether to keep its metadata and its duplicate policy, or an error if its tags are invalid or too many.
+*/
+func imageFromBatchSettings(r *http.Request, authorID string, settings batchFileSettings) (model.Image, bool, string, error) {
+	base, baseErr := imageFromForm(r, authorID)
+
+	if baseErr != nil {
+		return model.Image{}, false, "", baseErr
+	}
+
+	caption, accessLevel, accessListIDs, tags := base.Caption, base.AccessLevel, base.AccessListIDs, base.ExplicitTags
+	keepMetadata := keepMetadataFromForm(r)
+	duplicatePolicy := r.FormValue("duplicates")
+
+	if settings.Caption != nil {
+		caption = *settings.Caption
+	}
+
+	if settings.AccessLevel != nil {
+		accessLevel = *settings.AccessLevel
+	}
+
+	if settings.AccessListIDs != nil {
+		accessListIDs = *settings.AccessListIDs
+	}
+
+	if settings.Tags != nil {
+		tags = *settings.Tags
+	}
+
+	if settings.KeepMetadata != nil {
+		keepMetadata = *settings.KeepMetadata
+	}
+
+	if settings.Duplicates != nil {
+		duplicatePolicy = *settings.Duplicates
+	}
+
+	image, err := newImage(authorID, caption, accessLevel, accessListIDs, tags)
+
+	return image, keepMetadata, duplicatePolicy, err
+}
+
+/**
+Uploads one file of a batch in the same way as addNewImage.
+*/
+func uploadBatchFile(fileHeader *multipart.FileHeader, image model.Image, keepMetadata bool, duplicatePolicy string) batchFileResult {
+	result := batchFileResult{Filename: fileHeader.Filename}
+
+	if fileHeader.Size > maxUploadSize {
+		result.Status = http.StatusRequestEntityTooLarge
+		result.Error = "file is larger than " + strconv.Itoa(maxUploadSize) + " bytes"
+		return result
+	}
+
+	if !validateAcceptableMIMEType(fileHeader.Header.Get("Content-Type")) {
+		result.Status = http.StatusBadRequest
+		result.Error = uploadNonImageFileTypeErr
+		return result
+	}
+
+	file, openErr := fileHeader.Open()
+
+	if openErr != nil {
+		log.Println(openErr)
+		result.Status = http.StatusInternalServerError
+		result.Error = "could not read file"
+		return result
+	}
+
+	defer file.Close()
+
+	buf := bytes.NewBuffer(nil)
+
+	if _, err := io.Copy(buf, file); err != nil {
+		log.Println(err)
+		result.Status = http.StatusInternalServerError
+		result.Error = "could not read file"
+		return result
+	}
+
+	prepared, prepareErr := prepareImage(&image, buf.Bytes(), keepMetadata, duplicatePolicy)
+
+	if prepareErr != nil {
+		if refused, ok := prepareErr.(*uploadError); ok {
+			result.Status = refused.status
+			result.Error = refused.message
+		} else {
+			log.Println(prepareErr)
+			result.Status = http.StatusInternalServerError
+			result.Error = "internal server error"
+		}
+		return result
+	}
+
+	id, createErr := createImage(image, prepared.data, prepared.contentType, prepared.variants)
+
+	if createErr != nil {
+		log.Println(createErr)
+		result.Status = http.StatusInternalServerError
+		result.Error = "internal server error"
+		return result
+	}
+
+	result.Status = http.StatusOK
+	result.ID = id
+	result.Duplicates = prepared.nearDuplicates
+
+	return result
+}
+
+/**
+	[POST] form/multipart
+
+	Uploads many images in one request. Each file is validated, processed and stored exactly as by /addImage, several
+	at a time; a file that fails does not affect the others.
+
+	Form fields:
+		- files: the image files, in order. At most 50, each at most 10MB.
+		- settings: JSON array. Optional. The settings of each file, in the same order as files: objects with any of
+		  caption, accessLevel, accessListIDs (array of user IDs), tags (array), keepMetadata (boolean) and duplicates.
+		- accessLevel, accessListIDs, caption, tags, keepMetadata, duplicates: as for /addImage. Used for any setting
+		  that a file's settings leave out.
+
+	Near-identical images within the same batch are not detected, as they are processed at the same time.
+
+	Returns: (application/json)
+		- 200: An array with the result of each file, in order: its index, filename and status code, and either its
+		  image ID (and near-identical images if duplicates is warn) or an error message. Status codes are those of
+		  /addImage, plus 413 if the file is larger than 10MB.
+		- 400: The form could not be parsed, there are no files or too many, settings is invalid, or a file's tags are
+		  invalid or too many.
+		- 413: The request is too large.
+*/
+func addNewImages(w http.ResponseWriter, r *http.Request) {
+	counted := &countingReadCloser{ReadCloser: r.Body}
+	r.Body = http.MaxBytesReader(w, counted, maxBatchSize)
+
+	if parseFormErr := r.ParseMultipartForm(batchMemoryLimit); parseFormErr != nil {
+		// MaxBytesReader reads one byte past the limit before it fails, so the count tells a too large body apart from
+		// a malformed form.
+		if counted.read > maxBatchSize {
+			http.Error(w, "request is larger than "+strconv.Itoa(maxBatchSize)+" bytes", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		http.Error(w, parseFormErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	defer r.MultipartForm.RemoveAll()
+
+	files := r.MultipartForm.File["files"]
+
+	if len(files) == 0 {
+		http.Error(w, "no files passed in", http.StatusBadRequest)
+		return
+	}
+
+	if len(files) > maxBatchFiles {
+		http.Error(w, "at most "+strconv.Itoa(maxBatchFiles)+" files can be uploaded at once", http.StatusBadRequest)
+		return
+	}
+
+	settings := make([]batchFileSettings, len(files))
+
+	if settingsString := r.FormValue("settings"); settingsString != "" {
+		var parsed []batchFileSettings
+
+		if err := json.Unmarshal([]byte(settingsString), &parsed); err != nil || len(parsed) > len(files) {
+			http.Error(w, "settings must be a JSON array with at most one object per file", http.StatusBadRequest)
+			return
+		}
+
+		copy(settings, parsed)
+	}
+
+	authorID := middleware.GetUserIDFromToken(r)
+	images := make([]model.Image, len(files))
+	keepMetadata := make([]bool, len(files))
+	duplicatePolicies := make([]string, len(files))
+
+	// Settings are checked before any file is stored, so that a mistake in them does not leave half a batch uploaded.
+	for i := range files {
+		var settingsErr error
+
+		images[i], keepMetadata[i], duplicatePolicies[i], settingsErr = imageFromBatchSettings(r, authorID, settings[i])
+
+		if settingsErr != nil {
+			http.Error(w, "file "+strconv.Itoa(i)+": "+settingsErr.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	results := make([]batchFileResult, len(files))
+	semaphore := make(chan struct{}, batchUploadConcurrency)
+
+	var wg sync.WaitGroup
+
+	for i, k := range files {
+		wg.Add(1)
+
+		go func(i int, fileHeader *multipart.FileHeader) {
+			defer wg.Done()
+
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			results[i] = uploadBatchFile(fileHeader, images[i], keepMetadata[i], duplicatePolicies[i])
+			results[i].Index = i
+		}(i, k)
+	}
+
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	jsonResponse, _ := json.Marshal(results)
+	_, _ = w.Write(jsonResponse)
+}
@@ -0,0 +1,255 @@
+package images
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
+	"time"
+)
+
+/**
+Image files are stored under the SHA-256 hash of their contents, so identical uploads share one set of objects. Each
+record in the blobs collection lists the IDs of the image documents that reference its hash; the objects are deleted
+when the last reference is removed. Adding and removing a reference are idempotent, so failed requests and the
+reconciler can safely retry them.
+
+Before its objects are deleted, a record is marked as deleting, and no new reference can be added to it until it is
+gone. An upload of the same file in the meantime waits for the deletion to finish and then stores the file again.
+*/
+const blobsCollection = "blobs"
+
+// How long acquireBlob waits for a blob that is being deleted to go away.
+const blobDeletionWait = 5 * time.Second
+
+/**
+A blob that has been marked as deleting for this long is assumed to have been abandoned by the request that started
+the deletion, and the reconciler finishes it.
+*/
+const staleBlobDeletion = 10 * time.Minute
+
+var errBlobDeleting = errors.New("blob is being deleted; try again")
+
+// A record in the blobs collection.
+type blobRecord struct {
+	ID          string    `bson:"_id"`
+	Refs        []string  `bson:"refs"`
+	Size        int64     `bson:"size"`
+	ContentType string    `bson:"contentType"`
+	Deleting    bool      `bson:"deleting,omitempty"`
+	DeletingAt  time.Time `bson:"deletingAt,omitempty"`
+}
+
+// Returns the hex SHA-256 hash that the given file is stored under.
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+/**
+Returns the storage key of the original file of an image.
+
+Images uploaded before content addressing was introduced are stored under their ID.
+*/
+func imageKey(image *model.Image) string {
+	if image.BlobKey != "" {
+		return image.BlobKey
+	}
+
+	return image.ID
+}
+
+/**
+Adds the image as a reference to the blob with the given hash, creating the blob's record if it does not exist yet.
+
+If the blob is being deleted, waits up to blobDeletionWait for the deletion to finish, then creates a new record.
+Returns errBlobDeleting if it does not finish in time.
+*/
+func acquireBlob(hash string, imageID string, size int64, contentType string) error {
+	// A record that is being deleted does not match, so the upsert tries to insert a second record with its ID and fails.
+	filter := bson.D{{"_id", hash}, {"deleting", bson.D{{"$ne", true}}}}
+	update := bson.D{
+		{"$addToSet", bson.D{{"refs", imageID}}},
+		{"$setOnInsert", bson.D{
+			{"size", size},
+			{"contentType", contentType},
+			{"createdAt", time.Now()},
+		}},
+	}
+
+	deadline := time.Now().Add(blobDeletionWait)
+	wait := 50 * time.Millisecond
+
+	for {
+		res := database.UpdateOne(blobsCollection, filter, update, options.Update().SetUpsert(true))
+
+		if res.Err == nil || !strings.Contains(res.Err.Error(), "E11000") {
+			return res.Err
+		}
+
+		if time.Now().Add(wait).After(deadline) {
+			return errBlobDeleting
+		}
+
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// Loads every blob record.
+func getBlobRecords() ([]blobRecord, error) {
+	res := database.Find(blobsCollection, bson.D{}, nil)
+
+	if res.Err != nil {
+		return nil, res.Err
+	}
+
+	records := make([]blobRecord, 0, len(res.Result))
+
+	for _, k := range res.Result {
+		record := blobRecord{}
+
+		bsonBytes, _ := bson.Marshal(k)
+
+		_ = bson.Unmarshal(bsonBytes, &record)
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+/**
+Uploads the original file and variants of a blob, skipping any object that is already stored.
+*/
+func storeBlob(hash string, data []byte, contentType string, variants []encodedVariant) error {
+	if err := putIfMissing(hash, data, contentType); err != nil {
+		return err
+	}
+
+	for _, k := range variants {
+		if err := putIfMissing(variantKey(hash, k.variant.Size), k.data, k.variant.ContentType); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func putIfMissing(key string, data []byte, contentType string) error {
+	_, statErr := storage.Stat(key)
+
+	if statErr == nil {
+		return nil
+	}
+
+	if statErr != storage.ErrNotFound {
+		return statErr
+	}
+
+	return storage.Put(key, bytes.NewReader(data), contentType)
+}
+
+/**
+Removes the image's reference to the blob with the given hash. When the last reference goes away, the blob record and
+every object stored for it (original, variants and cached derived images) are deleted.
+*/
+func releaseBlob(hash string, imageID string) error {
+	filter := bson.D{{"_id", hash}}
+	update := bson.D{{"$pull", bson.D{{"refs", imageID}}}}
+
+	if res := database.UpdateOne(blobsCollection, filter, update, nil); res.Err != nil {
+		return res.Err
+	}
+
+	return deleteBlobIfUnreferenced(hash)
+}
+
+/**
+Deletes the blob record and its objects if no image references it any more.
+
+The record is marked as deleting first, so that no upload can reference the blob while its objects are deleted, and
+is only removed once they are all gone. If deleting the objects fails, the record stays marked and the reconciler
+finishes the deletion later.
+*/
+func deleteBlobIfUnreferenced(hash string) error {
+	// Only the caller that marks the record deletes the objects, so concurrent releases cannot both clean up.
+	unreferenced := bson.D{{"$and", []bson.D{
+		{{"_id", hash}},
+		{{"refs", bson.D{{"$size", 0}}}},
+		{{"deleting", bson.D{{"$ne", true}}}},
+	}}}
+
+	update := bson.D{{"$set", bson.D{{"deleting", true}, {"deletingAt", time.Now()}}}}
+
+	res := database.UpdateOne(blobsCollection, unreferenced, update, nil)
+
+	if res.Err != nil {
+		return res.Err
+	}
+
+	if res.Modified == 0 {
+		return nil
+	}
+
+	return finishBlobDeletion(hash)
+}
+
+// Deletes the objects of a blob that has been marked as deleting, then its record.
+func finishBlobDeletion(hash string) error {
+	if err := deleteObjectsForKey(hash); err != nil {
+		return err
+	}
+
+	return database.DeleteOne(blobsCollection, bson.D{{"_id", hash}, {"deleting", true}}, nil).Err
+}
+
+/**
+Deletes the original, variants and cached derived images stored under an image key.
+*/
+func deleteObjectsForKey(key string) error {
+	objects, err := storage.List(key)
+
+	if err != nil {
+		return err
+	}
+
+	derived, err := storage.List(derivedPrefix(key))
+
+	if err != nil {
+		return err
+	}
+
+	for _, k := range append(objects, derived...) {
+		// Variant keys are the image key plus a suffix; anything else sharing the prefix belongs to another image.
+		belongs := k.Key == key || strings.HasPrefix(k.Key, key+"-") || strings.HasPrefix(k.Key, derivedPrefix(key))
+
+		if !belongs {
+			continue
+		}
+
+		if err := storage.Delete(k.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+Deletes the stored files of an image whose document has been removed.
+*/
+func deleteImageObjects(image *model.Image) error {
+	if image.BlobKey != "" {
+		return releaseBlob(image.BlobKey, image.ID)
+	}
+
+	return deleteObjectsForKey(image.ID)
+}
@@ -0,0 +1,210 @@
+package images
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/storage"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Public images can be cached by browsers and CDNs for a day; after that, a change of access level takes effect.
+const publicCacheControl = "public, max-age=86400"
+
+// Private images may only be cached by the browser, which must check that the user can still see them on every use.
+const privateCacheControl = "private, no-cache"
+
+/**
+Returns the entity tag of a stored file of an image. Stored files never change under the same key (keys are content
+hashes, or derived from them), so the key identifies the content. It is hashed with the image ID, so that the tag does
+not reveal the content hash, which is shared with any other image of the same file.
+*/
+func etagFor(image *model.Image, key string) string {
+	sum := sha256.Sum256([]byte(image.ID + "\n" + key))
+
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+/**
+Sets the validator and caching headers for a file of the given image.
+
+The image's upload date is used as the file's modification time, as its files never change after upload.
+*/
+func setCacheHeaders(w http.ResponseWriter, image *model.Image, key string) {
+	w.Header().Set("ETag", etagFor(image, key))
+
+	if !image.UploadDate.IsZero() {
+		w.Header().Set("Last-Modified", image.UploadDate.UTC().Format(http.TimeFormat))
+	}
+
+	if image.AccessLevel == "private" {
+		w.Header().Set("Cache-Control", privateCacheControl)
+		w.Header().Set("Vary", "Cookie")
+	} else {
+		w.Header().Set("Cache-Control", publicCacheControl)
+	}
+}
+
+/**
+Reports whether the client's cached copy is still valid according to its If-None-Match or If-Modified-Since header.
+If-Modified-Since is ignored when If-None-Match is present.
+*/
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, k := range strings.Split(ifNoneMatch, ",") {
+			k = strings.TrimSpace(k)
+
+			if k == "*" || strings.TrimPrefix(k, "W/") == etag {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+
+	return err == nil && !modified.IsZero() && !modified.Truncate(time.Second).After(since)
+}
+
+/**
+Responds with 304 Not Modified if the client's cached copy of a file of the given image is still valid, so that the
+file does not need to be fetched from storage.
+
+Returns true if the response has been written.
+*/
+func respondNotModified(w http.ResponseWriter, r *http.Request, image *model.Image, key string) bool {
+	if !notModified(r, etagFor(image, key), image.UploadDate) {
+		return false
+	}
+
+	setCacheHeaders(w, image, key)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+/**
+Reads a stored file through ranged reads, so that only the parts of it that are read are fetched from storage.
+Seeking is free: the next Read fetches the rest of the file from the new offset.
+*/
+type objectRangeReader struct {
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *objectRangeReader) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		object, err := storage.GetRange(o.key, o.offset, o.size-o.offset)
+
+		if err != nil {
+			return 0, err
+		}
+
+		o.body = object.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+
+	return n, err
+}
+
+func (o *objectRangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the object")
+	}
+
+	if offset != o.offset {
+		o.Close()
+		o.offset = offset
+	}
+
+	return offset, nil
+}
+
+func (o *objectRangeReader) Close() error {
+	if o.body == nil {
+		return nil
+	}
+
+	err := o.body.Close()
+	o.body = nil
+
+	return err
+}
+
+/**
+Fetches a stored file to be served to the given request. Range requests only need the file's metadata, since
+serveImageObject fetches the requested ranges itself, so the file is not opened for them.
+*/
+func getObjectForRequest(r *http.Request, key string) (*storage.Object, error) {
+	if r.Header.Get("Range") == "" {
+		return storage.Get(key)
+	}
+
+	info, err := storage.Stat(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &storage.Object{ObjectInfo: *info}, nil
+}
+
+/**
+Serves a stored file of an image, fetched by getObjectForRequest, with its caching headers, honouring Range and
+If-Range headers.
+
+Requests without a Range header are streamed straight from storage. For Range requests, only the requested byte
+ranges are fetched from storage.
+*/
+func serveImageObject(w http.ResponseWriter, r *http.Request, image *model.Image, key string, object *storage.Object) {
+	setCacheHeaders(w, image, key)
+
+	if r.Header.Get("Range") == "" {
+		streamObject(w, object)
+		return
+	}
+
+	if object.Body != nil {
+		object.Body.Close()
+	}
+
+	// Leaving the content type unset makes ServeContent sniff it, as streamObject does for older objects.
+	if validateAcceptableMIMEType(object.ContentType) {
+		w.Header().Set("Content-Type", object.ContentType)
+	}
+
+	content := &objectRangeReader{key: key, size: object.Size}
+	defer content.Close()
+
+	http.ServeContent(w, r, "", image.UploadDate, content)
+}
+
+/**
+Serves a rendered file of an image from memory with its caching headers, honouring Range and If-Range headers.
+*/
+func serveImageBytes(w http.ResponseWriter, r *http.Request, image *model.Image, key string, data []byte, contentType string) {
+	setCacheHeaders(w, image, key)
+	w.Header().Set("Content-Type", contentType)
+
+	http.ServeContent(w, r, "", image.UploadDate, bytes.NewReader(data))
+}
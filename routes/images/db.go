@@ -3,56 +3,367 @@ package images
 import (
 	"github.com/kilowatt-/ImageRepository/database"
 	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/albums"
+	"github.com/kilowatt-/ImageRepository/routes/comments"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/events"
+	"github.com/kilowatt-/ImageRepository/routes/notifications"
 	"github.com/kilowatt-/ImageRepository/routes/users"
+	"github.com/kilowatt-/ImageRepository/routes/webhooks"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"time"
 )
 
-func updateACLAdd(imageid primitive.ObjectID, userid string, add []string, channel chan *database.UpdateResponse) {
+// Matches image documents that their author may delete: committed and broken images.
+var deletableFilter = bson.D{{"status", bson.D{{"$nin", []string{model.ImageStatusPending, model.ImageStatusDeleting}}}}}
+
+// Restricts a filter to committed images.
+func withCommitted(filter interface{}) bson.D {
+	return bson.D{{"$and", []interface{}{filter, common.CommittedImageFilter}}}
+}
+
+/**
+Creates the indexes that image queries rely on.
+*/
+func createImageIndexes() {
+	indexes := []bson.D{
+		{{"uploadDateTime", -1}},
+		{{"info.orientation", 1}, {"uploadDateTime", -1}},
+		{{"info.takenAt", -1}},
+		{{"authorid", 1}, {"perceptualHash", 1}},
+		{{"authorid", 1}, {"uploadDateTime", -1}},
+		{{"status", 1}, {"uploadDateTime", 1}},
+		{{"tags", 1}, {"uploadDateTime", -1}},
+		{{"accessListGroupIDs", 1}},
+	}
+
+	for _, k := range indexes {
+		if err := database.CreateIndex("images", k, nil); err != nil {
+			log.Println("could not create image index: " + err.Error())
+		}
+	}
+}
+
+func updateACLAdd(imageid primitive.ObjectID, userid string, add []string, addGroups []string, channel chan *database.UpdateResponse) {
 	filter := bson.D{{"$and", []bson.D{
 		{{"_id", imageid}},
 		{{"authorid", userid}},
 	}}}
 
-	update := bson.D{{"$addToSet", bson.D{{"accessListIDs", bson.D{{"$each", add}}}}}}
+	update := bson.D{{"$addToSet", bson.D{
+		{"accessListIDs", bson.D{{"$each", add}}},
+		{"accessListGroupIDs", bson.D{{"$each", addGroups}}},
+	}}}
 
 	channel <- database.Update("images", filter, update, nil)
 }
 
-func updateACLRemove(imageid primitive.ObjectID, userid string, remove []string, channel chan *database.UpdateResponse) {
+func updateACLRemove(imageid primitive.ObjectID, userid string, remove []string, removeGroups []string, channel chan *database.UpdateResponse) {
 	filter := bson.D{{"$and", []bson.D{
 		{{"_id", imageid}},
 		{{"authorid", userid}},
 	}}}
 
-	update := bson.D{ {"$pullAll", bson.D{{"accessListIDs", remove}}}}
+	update := bson.D{ {"$pullAll", bson.D{{"accessListIDs", remove}, {"accessListGroupIDs", removeGroups}}}}
 
 	channel <- database.Update("images", filter, update, nil)
 }
 
+/**
+Deletes all of a user's images and releases their stored files. Files shared with other users' images are kept.
+
+The images are marked as deleting first; any image whose files cannot be released is left in that state for the
+reconciler to finish. Released images are removed from albums, and their likes and comments deleted,
+before their documents are deleted.
+*/
 func deleteAllImagesFromDatabase(userid string, channel chan *database.DeleteResponse) {
-	filter := bson.D{{"authorid", userid}}
+	filter := bson.D{{"$and", []bson.D{
+		{{"authorid", userid}},
+		deletableFilter,
+	}}}
+
+	found := database.Find("images", filter, options.Find().SetProjection(bson.D{{"blobKey", 1}}))
+
+	if found.Err != nil {
+		channel <- &database.DeleteResponse{NumberDeleted: -1, Err: found.Err}
+		return
+	}
+
+	ids := make([]interface{}, len(found.Result))
+
+	for i, k := range found.Result {
+		ids[i] = k["_id"]
+	}
+
+	update := bson.D{{"$set", bson.D{{"status", model.ImageStatusDeleting}}}}
+
+	if res := database.Update("images", bson.D{{"_id", bson.D{{"$in", ids}}}}, update, nil); res.Err != nil {
+		channel <- &database.DeleteResponse{NumberDeleted: -1, Err: res.Err}
+		return
+	}
+
+	released := []interface{}{}
+	releasedIDs := []string{}
+
+	for i, k := range found.Result {
+		image := model.Image{}
+
+		bsonBytes, _ := bson.Marshal(k)
+
+		_ = bson.Unmarshal(bsonBytes, &image)
+
+		if err := deleteImageObjects(&image); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		released = append(released, ids[i])
+		releasedIDs = append(releasedIDs, image.ID)
+	}
+
+	albumChannel := make(chan *database.UpdateResponse)
+
+	go albums.RemoveImagesFromAlbums(releasedIDs, albumChannel)
+
+	if res := <-albumChannel; res.Err != nil {
+		channel <- &database.DeleteResponse{NumberDeleted: -1, Err: res.Err}
+		return
+	}
+
+	if err := deleteImageLikes(releasedIDs); err != nil {
+		channel <- &database.DeleteResponse{NumberDeleted: -1, Err: err}
+		return
+	}
+
+	commentChannel := make(chan *database.DeleteResponse)
+
+	go comments.DeleteImageComments(releasedIDs, commentChannel)
+
+	if res := <-commentChannel; res.Err != nil {
+		channel <- &database.DeleteResponse{NumberDeleted: -1, Err: res.Err}
+		return
+	}
+
+	notificationChannel := make(chan *database.DeleteResponse)
 
-	channel <- database.Delete("images", filter, nil)
+	go notifications.DeleteImageNotifications(releasedIDs, notificationChannel)
+
+	if res := <-notificationChannel; res.Err != nil {
+		channel <- &database.DeleteResponse{NumberDeleted: -1, Err: res.Err}
+		return
+	}
+
+	res := database.Delete("images", bson.D{{"_id", bson.D{{"$in", released}}}}, nil)
+
+	if res.Err == nil {
+		for _, k := range releasedIDs {
+			go webhooks.Dispatch(userid, model.WebhookEventImageDeleted, webhooks.ImageDeletedData{ImageID: k})
+		}
+	}
+
+	channel <- res
 }
 
-func deleteImageFromDatabase(userid string, imageid primitive.ObjectID, channel chan *database.DeleteResponse) {
+func insertImage(image model.Image, channel chan *database.InsertResponse) {
+	res := database.InsertOne("images", image, nil)
+	channel <- res
+}
+
+// Marks a pending image as committed, making it visible.
+func commitImage(imageid primitive.ObjectID, channel chan *database.UpdateResponse) {
 	filter := bson.D{{"$and", []bson.D{
+		{{"_id", imageid}},
+		{{"status", model.ImageStatusPending}},
+	}}}
+
+	update := bson.D{{"$set", bson.D{{"status", model.ImageStatusCommitted}}}}
+
+	channel <- database.UpdateOne("images", filter, update, nil)
+}
+
+// Marks a committed or broken image as being deleted, hiding it until its files are released and the document is removed.
+func markImageDeleting(userid string, imageid primitive.ObjectID, channel chan *database.UpdateResponse) {
+	filter := bson.D{{"$and", []bson.D{
+		{{"_id", imageid}},
 		{{"authorid", userid}},
+		deletableFilter,
+	}}}
+
+	update := bson.D{{"$set", bson.D{{"status", model.ImageStatusDeleting}}}}
+
+	channel <- database.UpdateOne("images", filter, update, nil)
+}
+
+// Marks a committed image as broken, hiding it.
+func markImageBroken(imageid primitive.ObjectID, channel chan *database.UpdateResponse) {
+	filter := bson.D{{"$and", []bson.D{
 		{{"_id", imageid}},
+		common.CommittedImageFilter,
 	}}}
 
-	channel <- database.DeleteOne("images", filter, nil)
+	update := bson.D{{"$set", bson.D{{"status", model.ImageStatusBroken}}}}
+
+	channel <- database.UpdateOne("images", filter, update, nil)
 }
 
-func insertImage(image model.Image, channel chan *database.InsertResponse) {
-	res := database.InsertOne("images", image, nil)
-	channel <- res
+// Removes a variant from an image document, so that requests for its size fall back to a larger variant or the original.
+func removeImageVariant(imageid primitive.ObjectID, size int, channel chan *database.UpdateResponse) {
+	update := bson.D{{"$pull", bson.D{{"variants", bson.D{{"size", size}}}}}}
+
+	channel <- database.UpdateOne("images", bson.D{{"_id", imageid}}, update, nil)
+}
+
+// Removes an image document regardless of its author. Used to clean up images that failed to be created or deleted.
+func discardImage(imageid primitive.ObjectID, channel chan *database.DeleteResponse) {
+	channel <- database.DeleteOne("images", bson.D{{"_id", imageid}}, nil)
+}
+
+// Gets one of the user's pending images that is waiting for its file to be uploaded.
+func getPendingUpload(userid string, imageid primitive.ObjectID, channel chan imageDatabaseResponse) {
+	filter := bson.D{{"$and", []bson.D{
+		{{"_id", imageid}},
+		{{"authorid", userid}},
+		{{"status", model.ImageStatusPending}},
+		{{"upload", bson.D{{"$exists", true}}}},
+	}}}
+
+	res := database.FindOne("images", filter, nil)
+
+	if res.Err != nil {
+		channel <- imageDatabaseResponse{images: nil, err: res.Err}
+		return
+	}
+
+	imageList := []*model.Image{}
+
+	if res.Result != nil {
+		image := model.Image{}
+
+		bsonBytes, _ := bson.Marshal(res.Result)
+
+		_ = bson.Unmarshal(bsonBytes, &image)
+
+		imageList = append(imageList, &image)
+	}
+
+	channel <- imageDatabaseResponse{images: imageList, err: nil}
+}
+
+/**
+Records the processed file of a pending upload on its image, and marks the upload as finalized. The upload date is
+set to the time of finalizing.
+
+Only matches images whose upload has not been finalized yet, so that an upload is only processed once.
+*/
+func setUploadedImageContent(imageid primitive.ObjectID, image *model.Image, channel chan *database.UpdateResponse) {
+	filter := bson.D{{"$and", []bson.D{
+		{{"_id", imageid}},
+		{{"status", model.ImageStatusPending}},
+		{{"upload", bson.D{{"$exists", true}}}},
+	}}}
+
+	update := bson.D{
+		{"$set", bson.D{
+			{"info", image.Info},
+			{"perceptualHash", image.PerceptualHash},
+			{"variants", image.Variants},
+			{"blobKey", image.BlobKey},
+			{"uploadDateTime", image.UploadDate},
+		}},
+		{"$unset", bson.D{{"upload", ""}}},
+	}
+
+	channel <- database.UpdateOne("images", filter, update, nil)
+}
+
+/**
+Appends a stored chunk to a resumable upload, advancing its offset and extending its expiry.
+
+Only matches if the upload's offset is still the given offset, so that concurrent requests cannot both append.
+*/
+func appendUploadChunk(imageid primitive.ObjectID, offset int64, newOffset int64, chunkKey string, expiresAt time.Time, channel chan *database.UpdateResponse) {
+	filter := bson.D{{"$and", []bson.D{
+		{{"_id", imageid}},
+		{{"status", model.ImageStatusPending}},
+		{{"upload.resumable", true}},
+		{{"upload.offset", offset}},
+	}}}
+
+	update := bson.D{
+		{"$set", bson.D{
+			{"upload.offset", newOffset},
+			{"upload.expiresAt", expiresAt},
+		}},
+		{"$push", bson.D{{"upload.chunks", chunkKey}}},
+	}
+
+	channel <- database.UpdateOne("images", filter, update, nil)
+}
+
+// Gets one of the user's images that they may delete, including broken images.
+func getDeletableImage(userid string, imageid primitive.ObjectID, channel chan imageDatabaseResponse) {
+	filter := bson.D{{"$and", []bson.D{
+		{{"_id", imageid}},
+		{{"authorid", userid}},
+		deletableFilter,
+	}}}
+
+	res := database.FindOne("images", filter, nil)
+
+	if res.Err != nil {
+		channel <- imageDatabaseResponse{images: nil, err: res.Err}
+		return
+	}
+
+	imageList := []*model.Image{}
+
+	if res.Result != nil {
+		image := model.Image{}
+
+		bsonBytes, _ := bson.Marshal(res.Result)
+
+		_ = bson.Unmarshal(bsonBytes, &image)
+
+		imageList = append(imageList, &image)
+	}
+
+	channel <- imageDatabaseResponse{images: imageList, err: nil}
+}
+
+/**
+Sets fields of one of the user's images and increases its version, if the image is still at the given version.
+*/
+func updateImageMetadata(userid string, imageid primitive.ObjectID, version int64, set bson.D, channel chan *database.UpdateResponse) {
+	versionFilter := bson.D{{"version", version}}
+
+	// Images uploaded before versions were introduced have no version field.
+	if version == 0 {
+		versionFilter = bson.D{{"$or", []bson.D{
+			{{"version", 0}},
+			{{"version", bson.D{{"$exists", false}}}},
+		}}}
+	}
+
+	filter := bson.D{{"$and", []bson.D{
+		{{"_id", imageid}},
+		{{"authorid", userid}},
+		versionFilter,
+		common.CommittedImageFilter,
+	}}}
+
+	update := bson.D{
+		{"$set", set},
+		{"$inc", bson.D{{"version", 1}}},
+	}
+
+	channel <- database.UpdateOne("images", filter, update, nil)
 }
 
 func getOneImage(filter bson.D, opts *options.FindOneOptions, channel chan imageDatabaseResponse) {
-	res := database.FindOne("images", filter, opts)
+	res := database.FindOne("images", withCommitted(filter), opts)
 
 	if res.Err != nil {
 		channel <- imageDatabaseResponse{images: nil, err: res.Err}
@@ -73,30 +384,91 @@ func getOneImage(filter bson.D, opts *options.FindOneOptions, channel chan image
 	}
 }
 
-func like(userid string, imageid primitive.ObjectID, channel chan *database.UpdateResponse) {
-	filter := bson.D{{"$and", []bson.D{
-		{{"_id", imageid}},
-		{{"$or", buildVisibilityFilters(userid)}},
+/**
+Records that the viewer likes an image visible to them, and increases the image's like count.
+
+Matched is 0 if the image is not found, and Modified is 0 if the viewer already likes it.
+*/
+func like(viewer *common.Viewer, imageid primitive.ObjectID, channel chan *database.UpdateResponse) {
+	userid := viewer.UserID
+	authorID, findErr := common.GetVisibleImageAuthor(viewer, imageid)
+
+	if findErr != nil || authorID == "" {
+		channel <- &database.UpdateResponse{Err: findErr}
+		return
+	}
+
+	filter := bson.D{{"imageID", imageid.Hex()}, {"userid", userid}}
+	update := bson.D{{"$setOnInsert", model.Like{
+		ImageID:       imageid.Hex(),
+		UserID:        userid,
+		ImageAuthorID: authorID,
+		CreatedAt:     time.Now(),
 	}}}
 
-	update := bson.D{{"$addToSet", bson.D{{"likes", userid}}}}
+	res := database.UpdateOne("likes", filter, update, options.Update().SetUpsert(true))
 
-	channel <- database.UpdateOne("images", filter, update, nil)
+	if res.Err != nil || res.Matched > 0 {
+		channel <- &database.UpdateResponse{Matched: 1, Err: res.Err}
+		return
+	}
+
+	go notifications.Notify(model.Notification{
+		UserID:  authorID,
+		Type:    model.NotificationTypeLike,
+		ActorID: userid,
+		ImageID: imageid.Hex(),
+	})
+
+	events.Publish(events.Event{
+		Type:     events.TypeImageLiked,
+		Data:     events.LikeData{ImageID: imageid.Hex(), UserID: userid},
+		Audience: events.UserAudience(authorID),
+	})
+
+	go webhooks.Dispatch(authorID, model.WebhookEventImageLiked, webhooks.ImageLikedData{ImageID: imageid.Hex(), UserID: userid})
+
+	countUpdate := bson.D{{"$inc", bson.D{{"likeCount", 1}}}}
+
+	channel <- database.UpdateOne("images", bson.D{{"_id", imageid}}, countUpdate, nil)
 }
 
-func unlike(userid string, imageid primitive.ObjectID, channel chan *database.UpdateResponse) {
-	filter := bson.D{{"$and", []bson.D{
-		{{"_id", imageid}},
-		{{"$or", buildVisibilityFilters(userid)}},
-	}}}
+/**
+Removes the viewer's like of an image visible to them, and decreases the image's like count.
 
-	update := bson.D{{"$pull", bson.D{{"likes", userid}}}}
+Matched is 0 if the image is not found, and Modified is 0 if the viewer does not like it.
+*/
+func unlike(viewer *common.Viewer, imageid primitive.ObjectID, channel chan *database.UpdateResponse) {
+	userid := viewer.UserID
+	authorID, findErr := common.GetVisibleImageAuthor(viewer, imageid)
 
-	channel <- database.UpdateOne("images", filter, update, nil)
+	if findErr != nil || authorID == "" {
+		channel <- &database.UpdateResponse{Err: findErr}
+		return
+	}
+
+	res := database.DeleteOne("likes", bson.D{{"imageID", imageid.Hex()}, {"userid", userid}}, nil)
+
+	if res.Err != nil || res.NumberDeleted == 0 {
+		channel <- &database.UpdateResponse{Matched: 1, Err: res.Err}
+		return
+	}
+
+	go notifications.Withdraw(authorID, model.NotificationTypeLike, userid, imageid.Hex())
+
+	events.Publish(events.Event{
+		Type:     events.TypeImageUnliked,
+		Data:     events.LikeData{ImageID: imageid.Hex(), UserID: userid},
+		Audience: events.UserAudience(authorID),
+	})
+
+	countUpdate := bson.D{{"$inc", bson.D{{"likeCount", -1}}}}
+
+	channel <- database.UpdateOne("images", bson.D{{"_id", imageid}}, countUpdate, nil)
 }
 
 func getImagesMetadataFromDatabase(filter bson.D, opts *options.FindOptions, channel chan imageDatabaseResponse) {
-	res := database.Find("images", filter, opts)
+	res := database.Find("images", withCommitted(filter), opts)
 
 	imageList := []*model.Image{}
 	var authorIDMap = make(map[string]bool)
@@ -0,0 +1,301 @@
+package images
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kilowatt-/ImageRepository/imaging"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/middleware"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+const defaultDuplicateDistance = 6
+
+// Most images of one author that an upload or getDuplicateImages is compared with. Only the newest are considered.
+const maxDuplicateCandidates = 2000
+
+// Largest Hamming distance at which two perceptual hashes count as near-duplicates.
+var duplicateDistance = defaultDuplicateDistance
+
+// How addNewImage treats an upload that is a near-duplicate of one of the author's images.
+const duplicatesReject = "reject"
+const duplicatesWarn = "warn"
+
+/**
+Loads the near-duplicate distance from DUPLICATE_HASH_DISTANCE. Falls back to the default if it is missing or invalid.
+*/
+func loadDuplicateDistance() {
+	distanceString, exists := os.LookupEnv("DUPLICATE_HASH_DISTANCE")
+
+	if !exists {
+		return
+	}
+
+	distance, err := strconv.Atoi(distanceString)
+
+	if err != nil || distance < 0 || distance > 64 {
+		log.Println("invalid DUPLICATE_HASH_DISTANCE; using default")
+		return
+	}
+
+	duplicateDistance = distance
+}
+
+// Perceptual hashes are stored as 16 hex digits.
+func formatHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+func parseHash(str string) (uint64, bool) {
+	hash, err := strconv.ParseUint(str, 16, 64)
+
+	return hash, err == nil
+}
+
+/**
+Finds the author's committed images whose perceptual hash is within the given distance of hash. Only the newest
+maxDuplicateCandidates images are compared, so that an upload by an author with many images stays fast.
+
+Returns the IDs of the matching images.
+*/
+func findNearDuplicates(authorID string, hash uint64, distance int) ([]string, error) {
+	filter := bson.D{{"$and", []bson.D{
+		{{"authorid", authorID}},
+		{{"perceptualHash", bson.D{{"$exists", true}}}},
+	}}}
+
+	// getImagesMetadataFromDatabase adds CommittedImageFilter.
+	opts := options.Find().
+		SetSort(bson.D{{"uploadDateTime", -1}}).
+		SetLimit(maxDuplicateCandidates).
+		SetProjection(bson.D{{"perceptualHash", 1}})
+
+	channel := make(chan imageDatabaseResponse)
+
+	go getImagesMetadataFromDatabase(filter, opts, channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	matches := []string{}
+
+	for _, k := range res.images {
+		if other, ok := parseHash(k.PerceptualHash); ok && imaging.HammingDistance(hash, other) <= distance {
+			matches = append(matches, k.ID)
+		}
+	}
+
+	return matches, nil
+}
+
+/**
+Groups images into clusters of near-duplicates. Two images are in the same cluster if they are connected by a chain of
+images that are each within the given distance of the next.
+
+The hashes are split into distance+1 chunks. Two hashes within the distance differ in at most distance bits, so they
+agree on at least one whole chunk; only images that share a chunk are compared.
+
+Images without a near-duplicate are left out.
+*/
+func clusterNearDuplicates(images []*model.Image, distance int) [][]*model.Image {
+	hashes := make([]uint64, len(images))
+	parent := make([]int, len(images))
+	// Images with the same value of a chunk, keyed by chunk number and value.
+	buckets := make(map[[2]uint64][]int)
+	chunks := distance + 1
+
+	if chunks > 64 {
+		chunks = 64
+	}
+
+	for i, k := range images {
+		parent[i] = i
+
+		hash, valid := parseHash(k.PerceptualHash)
+
+		if !valid {
+			continue
+		}
+
+		hashes[i] = hash
+
+		for c := 0; c < chunks; c++ {
+			low, high := uint(c*64/chunks), uint((c+1)*64/chunks)
+			value := (hash >> low) & (1<<(high-low) - 1)
+			bucket := [2]uint64{uint64(c), value}
+
+			buckets[bucket] = append(buckets[bucket], i)
+		}
+	}
+
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	for _, members := range buckets {
+		for a := 0; a < len(members); a++ {
+			for b := a + 1; b < len(members); b++ {
+				i, j := members[a], members[b]
+
+				if find(i) != find(j) && imaging.HammingDistance(hashes[i], hashes[j]) <= distance {
+					parent[find(i)] = find(j)
+				}
+			}
+		}
+	}
+
+	clusterMap := make(map[int][]*model.Image)
+	order := []int{}
+
+	for i, k := range images {
+		root := find(i)
+
+		if _, exists := clusterMap[root]; !exists {
+			order = append(order, root)
+		}
+
+		clusterMap[root] = append(clusterMap[root], k)
+	}
+
+	clusters := [][]*model.Image{}
+
+	for _, k := range order {
+		if len(clusterMap[k]) > 1 {
+			clusters = append(clusters, clusterMap[k])
+		}
+	}
+
+	return clusters
+}
+
+/**
+[GET]
+Lists clusters of near-identical images uploaded by a user. Only images visible to the logged in user are considered,
+and only the newest maxDuplicateCandidates of them.
+
+Accepted query parameters:
+	- user: the author's user ID. Defaults to the logged in user.
+	- distance: integer between 0 and 64. Optional. Largest Hamming distance between the perceptual hashes of two
+	  images in a cluster. Defaults to the server's DUPLICATE_HASH_DISTANCE.
+
+Returns: (application/json)
+	- 200: A list of clusters, each a list of image metadata, newest first.
+	- 400: If no user was passed in and the user is not logged in, or the distance is invalid.
+	- 500: Internal server error.
+*/
+func getDuplicateImages(w http.ResponseWriter, r *http.Request) {
+	loggedInUser := middleware.GetUserIDFromTokenNotStrictValidation(r)
+	author := loggedInUser
+	distance := duplicateDistance
+
+	if userQuery, ok := r.URL.Query()["user"]; ok && len(userQuery) > 0 && len(userQuery[0]) > 0 {
+		author = userQuery[0]
+	}
+
+	if author == "" {
+		http.Error(w, "user not passed in", http.StatusBadRequest)
+		return
+	}
+
+	if distanceQuery, ok := r.URL.Query()["distance"]; ok && len(distanceQuery) > 0 && len(distanceQuery[0]) > 0 {
+		conv, convErr := strconv.Atoi(distanceQuery[0])
+
+		if convErr != nil || conv < 0 || conv > 64 {
+			http.Error(w, "distance must be an integer between 0 and 64", http.StatusBadRequest)
+			return
+		}
+
+		distance = conv
+	}
+
+	filter := bson.D{{"$and", []bson.D{
+		{{"authorid", author}},
+		{{"perceptualHash", bson.D{{"$exists", true}}}},
+		{{"$or", common.BuildVisibilityFilters(common.GetViewer(loggedInUser))}},
+	}}}
+
+	// Cluster on the hashes alone, then load the full metadata of the images that have a near-duplicate.
+	opts := options.Find().
+		SetSort(bson.D{{"uploadDateTime", -1}}).
+		SetLimit(maxDuplicateCandidates).
+		SetProjection(bson.D{{"perceptualHash", 1}})
+
+	channel := make(chan imageDatabaseResponse)
+
+	go getImagesMetadataFromDatabase(filter, opts, channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		common.SendInternalServerError(w)
+		return
+	}
+
+	clusters := clusterNearDuplicates(res.images, distance)
+	clusteredIDs := []primitive.ObjectID{}
+
+	for _, cluster := range clusters {
+		for _, k := range cluster {
+			hex, _ := primitive.ObjectIDFromHex(k.ID)
+			clusteredIDs = append(clusteredIDs, hex)
+		}
+	}
+
+	if len(clusteredIDs) > 0 {
+		go getImagesMetadataFromDatabase(bson.D{{"_id", bson.D{{"$in", clusteredIDs}}}}, nil, channel)
+
+		full := <-channel
+
+		if full.err != nil {
+			common.SendInternalServerError(w)
+			return
+		}
+
+		appendAuthorsToImages(full.images, *full.userIDMap)
+
+		imageMap := make(map[string]*model.Image)
+
+		for _, k := range full.images {
+			imageMap[k.ID] = k
+		}
+
+		// Images deleted between the two queries are dropped, along with clusters that no longer have a duplicate.
+		filled := [][]*model.Image{}
+
+		for _, cluster := range clusters {
+			images := []*model.Image{}
+
+			for _, k := range cluster {
+				if image, exists := imageMap[k.ID]; exists {
+					images = append(images, image)
+				}
+			}
+
+			if len(images) > 1 {
+				filled = append(filled, images)
+			}
+		}
+
+		clusters = filled
+	}
+
+	marshalled, _ := json.Marshal(clusters)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(marshalled)
+}
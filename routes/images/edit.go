@@ -0,0 +1,173 @@
+package images
+
+import (
+	"encoding/json"
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/middleware"
+	"go.mongodb.org/mongo-driver/bson"
+	"log"
+	"net/http"
+)
+
+type imageEdit struct {
+	ID          string    `json:"_id"`
+	Version     *int64    `json:"version"`
+	Caption     *string   `json:"caption,omitempty"`
+	AccessLevel *string   `json:"accessLevel,omitempty"`
+	Tags        *[]string `json:"tags,omitempty"`
+}
+
+type imageVersionResponse struct {
+	ID      string `json:"_id"`
+	Version int64  `json:"version"`
+}
+
+/**
+	[PATCH]
+
+	Edits the caption, access level and tags of one of the user's images. Fields that are left out are not changed.
+	Changing the caption updates the hashtags in the image's tags.
+
+	Every image has a version, which is returned with its metadata and increases with each edit. The edit is only made
+	if the version passed in is still the image's version, so that an edit based on outdated metadata cannot overwrite
+	another one.
+
+	JSON body parameters:
+		- _id: the image ID.
+		- version: the version of the image that the edit is based on.
+		- caption: Optional. The new caption.
+		- accessLevel: Optional. public/private.
+		- tags: Optional. An array of tags that replaces the image's explicit tags, as for /addImage.
+
+	Returns: (application/json)
+		- 200: The image ID and its new version.
+		- 400: Invalid body, image ID or access level, version not passed in, no fields to edit, or the tags are invalid or
+		  too many.
+		- 404: Image not found or user is not its author. (no difference)
+		- 409: The image was edited since the given version. Returns the image ID and its current version.
+		- 500: Internal server error.
+*/
+func editImage(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	edit := &imageEdit{}
+
+	if err := json.NewDecoder(r.Body).Decode(edit); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hex, hexErr := getHexIDFromString(edit.ID)
+
+	if hexErr != nil {
+		http.Error(w, hexErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if edit.Version == nil {
+		http.Error(w, "version not passed in", http.StatusBadRequest)
+		return
+	}
+
+	if edit.Caption == nil && edit.AccessLevel == nil && edit.Tags == nil {
+		http.Error(w, "no fields to edit passed in", http.StatusBadRequest)
+		return
+	}
+
+	if edit.AccessLevel != nil && *edit.AccessLevel != "public" && *edit.AccessLevel != "private" {
+		http.Error(w, "invalid access level passed in: "+*edit.AccessLevel, http.StatusBadRequest)
+		return
+	}
+
+	findChannel := make(chan imageDatabaseResponse)
+
+	go getOneImage(bson.D{{"_id", *hex}, {"authorid", uid}}, nil, findChannel)
+
+	found := <-findChannel
+
+	if found.err != nil {
+		log.Println(found.err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if len(found.images) == 0 {
+		http.Error(w, imageNotFound, http.StatusNotFound)
+		return
+	}
+
+	image := found.images[0]
+
+	if image.Version != *edit.Version {
+		writeImageVersionConflict(w, image)
+		return
+	}
+
+	set := bson.D{}
+
+	if edit.AccessLevel != nil {
+		set = append(set, bson.E{Key: "accessLevel", Value: *edit.AccessLevel})
+	}
+
+	if edit.Caption != nil || edit.Tags != nil {
+		explicitTags := image.ExplicitTags
+
+		if edit.Caption != nil {
+			image.Caption = *edit.Caption
+		}
+
+		if edit.Tags != nil {
+			explicitTags = *edit.Tags
+		}
+
+		if err := setImageTags(image, explicitTags); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		set = append(set,
+			bson.E{Key: "caption", Value: image.Caption},
+			bson.E{Key: "tags", Value: image.Tags},
+			bson.E{Key: "explicitTags", Value: image.ExplicitTags},
+		)
+	}
+
+	updateChannel := make(chan *database.UpdateResponse)
+
+	go updateImageMetadata(uid, *hex, *edit.Version, set, updateChannel)
+
+	res := <-updateChannel
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	// Another edit was made between reading the image and updating it.
+	if res.Matched == 0 {
+		go getOneImage(bson.D{{"_id", *hex}, {"authorid", uid}}, nil, findChannel)
+
+		if current := <-findChannel; current.err == nil && len(current.images) > 0 {
+			writeImageVersionConflict(w, current.images[0])
+		} else {
+			http.Error(w, imageNotFound, http.StatusNotFound)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	jsonResponse, _ := json.Marshal(imageVersionResponse{ID: image.ID, Version: *edit.Version + 1})
+	_, _ = w.Write(jsonResponse)
+}
+
+// Responds with 409 and the image's current version, after an edit based on an older version was refused.
+func writeImageVersionConflict(w http.ResponseWriter, image *model.Image) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	jsonResponse, _ := json.Marshal(imageVersionResponse{ID: image.ID, Version: image.Version})
+	_, _ = w.Write(jsonResponse)
+}
@@ -0,0 +1,491 @@
+package images
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/middleware"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultAffinityInterval = time.Hour
+
+// Only images uploaded within this window are ranked into the feed.
+const feedWindow = 30 * 24 * time.Hour
+
+// How far ahead of its upload time each point of affinity places an image in the feed.
+const feedAffinityBoost = 12 * time.Hour
+
+// Sharing a private image is a stronger signal than a like, so each share counts for this many likes.
+const shareAffinityWeight = 2.0
+
+// The number of authors, by affinity, whose images are boosted in a user's feed.
+const maxFeedAuthors = 200
+
+/**
+Most images considered for one feed page: this many of the newest visible images, plus this many of the newest images
+by the user's top-affinity authors. Only these are ranked, so a feed request never has to rank every recent image.
+*/
+const feedCandidateLimit = 500
+
+// Most affinities written to the database in one request.
+const affinityWriteBatch = 1000
+
+const defaultFeedLimit = 20
+const maxFeedLimit = 100
+
+type feedPage struct {
+	Images     []*model.Image `json:"images"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+// The position of the last image of a feed page: its rank, in milliseconds, and ID.
+type feedCursor struct {
+	rank int64
+	id   primitive.ObjectID
+}
+
+// An image that may be placed in the feed, and its rank in milliseconds.
+type feedCandidate struct {
+	id   primitive.ObjectID
+	rank int64
+}
+
+/**
+Creates the indexes that affinity queries rely on. Each user has one affinity for each author.
+*/
+func createAffinityIndexes() {
+	if err := database.CreateIndex("affinities", bson.D{{"userid", 1}, {"authorid", 1}}, options.Index().SetUnique(true)); err != nil {
+		log.Println("could not create affinity index: " + err.Error())
+	}
+
+	indexes := []bson.D{
+		{{"userid", 1}, {"score", -1}},
+		{{"updatedAt", 1}},
+	}
+
+	for _, k := range indexes {
+		if err := database.CreateIndex("affinities", k, nil); err != nil {
+			log.Println("could not create affinity index: " + err.Error())
+		}
+	}
+}
+
+/**
+Starts the background job that precomputes each user's affinity with the authors whose images they interact with.
+Affinity grows with the number of the author's images the user likes, and the number of the author's private images
+shared with the user through their access lists.
+
+Runs once at startup and then every FEED_AFFINITY_INTERVAL_MINUTES minutes (default 60).
+*/
+func StartAffinityScorer() {
+	interval := defaultAffinityInterval
+
+	if minutesString, exists := os.LookupEnv("FEED_AFFINITY_INTERVAL_MINUTES"); exists {
+		if minutes, err := strconv.Atoi(minutesString); err == nil && minutes > 0 {
+			interval = time.Duration(minutes) * time.Minute
+		} else {
+			log.Println("invalid FEED_AFFINITY_INTERVAL_MINUTES; using default")
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := computeAffinities(); err != nil {
+				log.Println("could not compute affinities: " + err.Error())
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// Aggregation counts come back as int32 or int64, depending on their size.
+func toInt64(value interface{}) int64 {
+	switch n := value.(type) {
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	}
+	return 0
+}
+
+func affinityScore(likes int64, sharedImages int64) float64 {
+	return math.Log1p(float64(likes)) + shareAffinityWeight*math.Log1p(float64(sharedImages))
+}
+
+/**
+Recomputes every affinity from the likes and image access lists, and deletes the affinities that no longer have any
+interactions behind them.
+*/
+func computeAffinities() error {
+	started := time.Now()
+
+	// Keyed by user ID, then author ID.
+	affinities := make(map[string]map[string]*model.Affinity)
+
+	affinityFor := func(userid string, authorID string) *model.Affinity {
+		if affinities[userid] == nil {
+			affinities[userid] = make(map[string]*model.Affinity)
+		}
+
+		if affinities[userid][authorID] == nil {
+			affinities[userid][authorID] = &model.Affinity{UserID: userid, AuthorID: authorID}
+		}
+
+		return affinities[userid][authorID]
+	}
+
+	likes := database.Aggregate("likes", []bson.D{
+		{{"$match", bson.D{{"$expr", bson.D{{"$ne", bson.A{"$userid", "$imageAuthorID"}}}}}}},
+		{{"$group", bson.D{
+			{"_id", bson.D{{"userid", "$userid"}, {"authorid", "$imageAuthorID"}}},
+			{"count", bson.D{{"$sum", 1}}},
+		}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+
+	if likes.Err != nil {
+		return likes.Err
+	}
+
+	for _, k := range likes.Result {
+		if key, ok := k["_id"].(bson.M); ok {
+			userid, _ := key["userid"].(string)
+			authorID, _ := key["authorid"].(string)
+
+			affinityFor(userid, authorID).Likes = toInt64(k["count"])
+		}
+	}
+
+	shares := database.Aggregate("images", []bson.D{
+		{{"$match", withCommitted(bson.D{{"accessLevel", "private"}, {"accessListIDs.0", bson.D{{"$exists", true}}}})}},
+		{{"$unwind", "$accessListIDs"}},
+		{{"$group", bson.D{
+			{"_id", bson.D{{"userid", "$accessListIDs"}, {"authorid", "$authorid"}}},
+			{"count", bson.D{{"$sum", 1}}},
+		}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+
+	if shares.Err != nil {
+		return shares.Err
+	}
+
+	for _, k := range shares.Result {
+		if key, ok := k["_id"].(bson.M); ok {
+			userid, _ := key["userid"].(string)
+			authorID, _ := key["authorid"].(string)
+
+			if userid != authorID {
+				affinityFor(userid, authorID).SharedImages = toInt64(k["count"])
+			}
+		}
+	}
+
+	writes := []mongo.WriteModel{}
+
+	for userid, authors := range affinities {
+		for authorID, affinity := range authors {
+			filter := bson.D{{"userid", userid}, {"authorid", authorID}}
+			update := bson.D{{"$set", bson.D{
+				{"likes", affinity.Likes},
+				{"sharedImages", affinity.SharedImages},
+				{"score", affinityScore(affinity.Likes, affinity.SharedImages)},
+				{"updatedAt", started},
+			}}}
+
+			writes = append(writes, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true))
+
+			if len(writes) == affinityWriteBatch {
+				if res := database.BulkWrite("affinities", writes, options.BulkWrite().SetOrdered(false)); res.Err != nil {
+					return res.Err
+				}
+
+				writes = []mongo.WriteModel{}
+			}
+		}
+	}
+
+	if len(writes) > 0 {
+		if res := database.BulkWrite("affinities", writes, options.BulkWrite().SetOrdered(false)); res.Err != nil {
+			return res.Err
+		}
+	}
+
+	return database.Delete("affinities", bson.D{{"updatedAt", bson.D{{"$lt", started}}}}, nil).Err
+}
+
+// Gets the authors that the given user has the highest affinity with, and their scores.
+func getTopAffinities(userid string) ([]string, []float64, error) {
+	opts := options.Find().SetSort(bson.D{{"score", -1}}).SetLimit(maxFeedAuthors).SetProjection(bson.D{{"authorid", 1}, {"score", 1}})
+	res := database.Find("affinities", bson.D{{"userid", userid}}, opts)
+
+	if res.Err != nil {
+		return nil, nil, res.Err
+	}
+
+	authors := []string{}
+	scores := []float64{}
+
+	for _, k := range res.Result {
+		authorID, _ := k["authorid"].(string)
+		score, _ := k["score"].(float64)
+
+		authors = append(authors, authorID)
+		scores = append(scores, score)
+	}
+
+	return authors, scores, nil
+}
+
+// Parses a cursor of the form <rank in milliseconds>_<image ID>.
+func parseFeedCursor(cursor string) (*feedCursor, error) {
+	parts := strings.Split(cursor, "_")
+
+	if len(parts) != 2 {
+		return nil, errors.New("invalid cursor passed in: " + cursor)
+	}
+
+	millis, millisErr := strconv.ParseInt(parts[0], 10, 64)
+	hex, hexErr := primitive.ObjectIDFromHex(parts[1])
+
+	if millisErr != nil || hexErr != nil {
+		return nil, errors.New("invalid cursor passed in: " + cursor)
+	}
+
+	return &feedCursor{rank: millis, id: hex}, nil
+}
+
+/**
+Gets the IDs and upload times of the newest images matching the filter, at most feedCandidateLimit of them.
+*/
+func getFeedCandidates(filter bson.D) ([]*model.Image, error) {
+	opts := options.Find().
+		SetSort(bson.D{{"uploadDateTime", -1}}).
+		SetLimit(feedCandidateLimit).
+		SetProjection(bson.D{{"authorid", 1}, {"uploadDateTime", 1}})
+
+	channel := make(chan imageDatabaseResponse)
+
+	go getImagesMetadataFromDatabase(filter, opts, channel)
+
+	res := <-channel
+
+	return res.images, res.err
+}
+
+/**
+Ranks the candidate images of a feed page. Each image is ranked by its upload time, moved ahead by feedAffinityBoost
+for every point of the user's affinity with its author.
+
+Only the newest visible images and the newest images of the user's top-affinity authors are candidates. An image
+ranks no earlier than it was uploaded, so everything after the cursor was uploaded before the cursor's rank, and the
+candidates of later pages are taken from before it.
+
+Returns the candidates after the cursor, best first, at most limit of them.
+*/
+func rankFeed(userid string, authors []string, scores []float64, cursor *feedCursor, limit int64) ([]feedCandidate, error) {
+	uploaded := bson.D{{"$gte", time.Now().Add(-feedWindow)}}
+
+	if cursor != nil {
+		uploaded = append(uploaded, bson.E{Key: "$lte", Value: time.Unix(0, cursor.rank*int64(time.Millisecond))})
+	}
+
+	window := bson.D{{"uploadDateTime", uploaded}}
+
+	// Built once, as it is shared by both candidate queries.
+	visible := bson.D{{"$or", common.BuildVisibilityFilters(common.GetViewer(userid))}}
+
+	candidates, err := getFeedCandidates(bson.D{{"$and", bson.A{visible, window}}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(authors) > 0 {
+		byAuthors, authorsErr := getFeedCandidates(bson.D{{"$and", bson.A{visible, window, bson.D{{"authorid", bson.D{{"$in", authors}}}}}}})
+
+		if authorsErr != nil {
+			return nil, authorsErr
+		}
+
+		candidates = append(candidates, byAuthors...)
+	}
+
+	authorScores := make(map[string]float64)
+
+	for i, k := range authors {
+		authorScores[k] = scores[i]
+	}
+
+	boostMillis := float64(feedAffinityBoost / time.Millisecond)
+	seen := make(map[string]bool)
+	ranked := []feedCandidate{}
+
+	for _, k := range candidates {
+		if seen[k.ID] {
+			continue
+		}
+
+		seen[k.ID] = true
+
+		hex, _ := primitive.ObjectIDFromHex(k.ID)
+		candidate := feedCandidate{
+			id:   hex,
+			rank: k.UploadDate.UnixNano()/int64(time.Millisecond) + int64(authorScores[k.AuthorID]*boostMillis),
+		}
+
+		if cursor == nil || candidate.rank < cursor.rank || (candidate.rank == cursor.rank && k.ID < cursor.id.Hex()) {
+			ranked = append(ranked, candidate)
+		}
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].rank != ranked[j].rank {
+			return ranked[i].rank > ranked[j].rank
+		}
+
+		return ranked[i].id.Hex() > ranked[j].id.Hex()
+	})
+
+	if int64(len(ranked)) > limit {
+		ranked = ranked[:limit]
+	}
+
+	return ranked, nil
+}
+
+/**
+	[GET]
+
+	Gets the user's home feed: the newest images visible to the user, ranked so that images by authors the user has
+	a higher affinity with come first. Affinity grows with the number of the author's images the user likes, and the
+	number of the author's private images shared with the user. Affinities are precomputed in the background, so new
+	interactions change the feed after the next run.
+
+	Accepted query parameters:
+		- cursor: Optional. The nextCursor of the previous page.
+		- limit: integer. The number of images to return. Default 20, max 100.
+
+	Returns: (application/json)
+		- 200: The images, and a nextCursor to get the next page with. nextCursor is left out on the last page.
+		- 400: An invalid cursor was passed in.
+		- 500: Internal server error.
+*/
+func getFeed(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	var cursor *feedCursor
+
+	if cursorQuery := r.URL.Query().Get("cursor"); cursorQuery != "" {
+		parsed, cursorErr := parseFeedCursor(cursorQuery)
+
+		if cursorErr != nil {
+			http.Error(w, cursorErr.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cursor = parsed
+	}
+
+	var limit int64 = defaultFeedLimit
+
+	if limitQuery := r.URL.Query().Get("limit"); limitQuery != "" {
+		if conv, convErr := strconv.ParseInt(limitQuery, 10, 64); convErr == nil && conv > 0 {
+			limit = conv
+		}
+	}
+
+	if limit > maxFeedLimit {
+		limit = maxFeedLimit
+	}
+
+	authors, scores, affinityErr := getTopAffinities(uid)
+
+	if affinityErr != nil {
+		log.Println(affinityErr)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	// Rank one image more than the limit, to find out whether there is a next page.
+	ranked, rankErr := rankFeed(uid, authors, scores, cursor, limit+1)
+
+	if rankErr != nil {
+		log.Println(rankErr)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	page := feedPage{Images: []*model.Image{}}
+
+	if int64(len(ranked)) > limit {
+		ranked = ranked[:limit]
+
+		last := ranked[limit-1]
+		page.NextCursor = strconv.FormatInt(last.rank, 10) + "_" + last.id.Hex()
+	}
+
+	ids := make([]primitive.ObjectID, len(ranked))
+
+	for i, k := range ranked {
+		ids[i] = k.id
+	}
+
+	channel := make(chan imageDatabaseResponse)
+
+	if len(ids) > 0 {
+		go getImagesMetadataFromDatabase(bson.D{{"_id", bson.D{{"$in", ids}}}}, nil, channel)
+
+		res := <-channel
+
+		if res.err != nil {
+			log.Println(res.err)
+			common.SendInternalServerError(w)
+			return
+		}
+
+		imageMap := make(map[string]*model.Image)
+
+		for _, k := range res.images {
+			imageMap[k.ID] = k
+		}
+
+		// Images deleted since they were ranked are left out.
+		for _, k := range ranked {
+			if image, exists := imageMap[k.id.Hex()]; exists {
+				page.Images = append(page.Images, image)
+			}
+		}
+	}
+
+	authorIDMap := make(map[string]bool)
+
+	for _, k := range page.Images {
+		authorIDMap[k.AuthorID] = true
+	}
+
+	appendAuthorsToImages(page.Images, authorIDMap)
+	setLikedByMe(uid, page.Images)
+
+	jsonResponse, _ := json.Marshal(page)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonResponse)
+}
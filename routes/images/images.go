@@ -1,49 +1,48 @@
 package images
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"errors"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
 	"github.com/kilowatt-/ImageRepository/database"
 	"github.com/kilowatt-/ImageRepository/model"
 	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/events"
+	"github.com/kilowatt-/ImageRepository/routes/groups"
 	"github.com/kilowatt-/ImageRepository/routes/middleware"
+	"github.com/kilowatt-/ImageRepository/routes/notifications"
 	"github.com/kilowatt-/ImageRepository/routes/users"
+	"github.com/kilowatt-/ImageRepository/routes/webhooks"
+	"github.com/kilowatt-/ImageRepository/storage"
 	"github.com/kilowatt-/ImageRepository/util"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
-	"strings"
-	"time"
+	"strconv"
 )
 
-const bucketName = "imgrepository-cdn"
 const invalidImageId = "invalid image id"
 const imageNotFound = "image not found"
 
+// Number of bytes http.DetectContentType looks at.
+const sniffLength = 512
+
+type addImageResponse struct {
+	ID         string   `json:"_id"`
+	Duplicates []string `json:"duplicates,omitempty"`
+}
+
 type imageDatabaseResponse struct {
 	images    []*model.Image
 	userIDMap *map[string]bool
 	err       error
 }
 
-var publicFilter = bson.D{{"accessLevel", "public"}}
-var awsSession *session.Session = nil
-var s3Instance *s3.S3 = nil
-var s3Uploader *s3manager.Uploader = nil
-var s3Downloader *s3manager.Downloader = nil
-
 var mimeSet = map[string]bool{
 	"image/bmp":  true,
 	"image/gif":  true,
@@ -94,50 +93,92 @@ func validateAcceptableMIMEType(mimeType string) bool {
 	return mimeSet[mimeType]
 }
 
-func buildVisibilityFilters(userid string) []interface{} {
-	filters := []interface{}{publicFilter}
+/**
+Looks up the image named by the id query parameter, if it is visible to the logged in user.
+
+Writes the error response and returns false if the ID is invalid or the image is not visible.
+*/
+func getVisibleImageFromQuery(w http.ResponseWriter, r *http.Request) (*model.Image, bool) {
+	const parseErrorMessage = "Could not parse id parameter"
+
+	imgIdArr, ok := r.URL.Query()["id"]
 
-	if userid != "" {
-		filters = append(filters, bson.D{{"accessListIDs", userid}})
-		filters = append(filters, bson.D{{"authorid", userid}})
+	if !ok || len(imgIdArr) < 1 || len(imgIdArr[0]) < 1 {
+		http.Error(w, parseErrorMessage, http.StatusBadRequest)
+		return nil, false
 	}
 
-	return filters
-}
+	hex, hexErr := primitive.ObjectIDFromHex(imgIdArr[0])
 
-/**
-Gets user ID from the token.
+	if hexErr != nil {
+		http.Error(w, parseErrorMessage, http.StatusBadRequest)
+		return nil, false
+	}
 
-This is required for endpoints which might require a user ID, but are not checked by the middleware because they
-are not strictly necessary. JWT Middleware is only run on functions where the user MUST be authenticated.
-*/
-func getUserIDFromTokenNotStrictValidation(r *http.Request) string {
-	cookie, err := r.Cookie("token")
-	if err == nil {
-		token := cookie.Value
-		valid, vErr := middleware.VerifyJWT(token)
-
-		if valid && vErr == nil {
-			return getUserIDFromToken(r)
-		}
+	loggedInUser := middleware.GetUserIDFromTokenNotStrictValidation(r)
+	visibilityFilters := common.BuildVisibilityFilters(common.GetViewer(loggedInUser))
+
+	filter := bson.D{{"$and",
+		[]interface{}{
+			bson.D{{"$or", visibilityFilters}},
+			bson.D{{"_id", hex},
+			}}}}
+
+	channel := make(chan imageDatabaseResponse)
+
+	go getOneImage(filter, nil, channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		common.SendInternalServerError(w)
+		return nil, false
 	}
 
-	return ""
+	if len(res.images) == 0 {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return res.images[0], true
 }
 
-func getUserIDFromToken(r *http.Request) string {
-	cookie, _ := r.Cookie("token")
-	token := cookie.Value
+// Streams a stored object to the response with its content type and length. Closes the object body.
+func streamObject(w http.ResponseWriter, object *storage.Object) {
+	defer object.Body.Close()
 
-	parsed, _, _ := new(jwt.Parser).ParseUnverified(token, &jwt.MapClaims{})
+	body := bufio.NewReaderSize(object.Body, sniffLength)
+	contentType := object.ContentType
 
-	claims := parsed.Claims.(*jwt.MapClaims)
+	// Objects uploaded before content types were stored come back as generic binary, so sniff those instead.
+	if !validateAcceptableMIMEType(contentType) {
+		header, peekErr := body.Peek(sniffLength)
 
-	return (*claims)["id"].(string)
+		if peekErr != nil && peekErr != io.EOF {
+			log.Println(peekErr)
+			common.SendInternalServerError(w)
+			return
+		}
+
+		contentType = http.DetectContentType(header)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	if object.Size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(object.Size, 10))
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, body); err != nil {
+		log.Println(err)
+	}
 }
 
 func likeUnlikeImage(w http.ResponseWriter, r *http.Request, isLike bool) {
-	uid := getUserIDFromToken(r)
+	uid := middleware.GetUserIDFromToken(r)
 
 	hex, err := getHexImageIDFromRequest(r)
 
@@ -148,14 +189,22 @@ func likeUnlikeImage(w http.ResponseWriter, r *http.Request, isLike bool) {
 
 	channel := make(chan *database.UpdateResponse)
 
+	viewer := common.GetViewer(uid)
+
 	if isLike {
-		go like(uid, *hex, channel)
+		go like(viewer, *hex, channel)
 	} else {
-		go unlike(uid, *hex, channel)
+		go unlike(viewer, *hex, channel)
 	}
 
 	res := <-channel
 
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
 	if res.Matched == 0 {
 		http.Error(w, imageNotFound, http.StatusNotFound)
 		return
@@ -176,11 +225,19 @@ func likeUnlikeImage(w http.ResponseWriter, r *http.Request, isLike bool) {
 /**
 	[POST] form/multipart
 
-	Inserts a new image record to the database, and uploads the file to our S3 bucket.
+	Inserts a new image record to the database, and uploads the file to blob storage.
+
+	EXIF, XMP and IPTC metadata are removed from JPEG, PNG and WebP files before they are stored, unless the
+	keepMetadata form field is Y/y.
+
+	If the duplicates form field is "reject", the upload is refused with 409 when the author already has a
+	near-identical image; if it is "warn", the upload succeeds and the near-identical images are listed in the response.
+
+	The image is tagged with the #hashtags in its caption and the tags in the tags form field (a JSON array). The upload
+	is refused with 400 if a tag is invalid or the image would have more than 30 tags.
  */
 func addNewImage(w http.ResponseWriter, r *http.Request) {
-	const uploadNonImageFileTypeErr = "Uploaded non-image file type"
-	parseFormErr := r.ParseMultipartForm(10 << 20)
+	parseFormErr := r.ParseMultipartForm(maxUploadSize)
 	// Maximum total form data size: 10MB.
 
 	if parseFormErr != nil {
@@ -190,13 +247,13 @@ func addNewImage(w http.ResponseWriter, r *http.Request) {
 
 	file, fileHeader, formFileErr := r.FormFile("file")
 
-	defer file.Close()
-
 	if formFileErr != nil {
 		http.Error(w, "Error parsing file", http.StatusBadRequest)
 		return
 	}
 
+	defer file.Close()
+
 	contentType := fileHeader.Header.Get("Content-Type")
 
 	if !validateAcceptableMIMEType(contentType) {
@@ -211,71 +268,49 @@ func addNewImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !validateAcceptableMIMEType(http.DetectContentType(buf.Bytes())) {
-		http.Error(w, uploadNonImageFileTypeErr, http.StatusBadRequest)
-		return
-	}
-
-	authorID := getUserIDFromToken(r)
-	accessLevel := r.FormValue("accessLevel")
-	accessListIDsString := r.FormValue("accessListIDs")
-	caption := r.FormValue("caption")
+	authorID := middleware.GetUserIDFromToken(r)
 
 	log.Println(authorID)
 
-	var accessListIDs []string
-
-	jsonParseErr := json.Unmarshal([]byte(accessListIDsString), &accessListIDs)
-
-	if jsonParseErr != nil {
-		log.Println("passed empty access List IDs")
-		accessListIDs = []string{}
-	}
+	image, formErr := imageFromForm(r, authorID)
 
-	if accessLevel != "public" && accessLevel != "private" {
-		log.Println("invalid access level passed in; defaulting to public")
-		accessLevel = "public"
-	}
-
-	image := model.Image{
-		AuthorID:      authorID,
-		AccessLevel:   accessLevel,
-		Caption:       caption,
-		UploadDate:    time.Now(),
-		AccessListIDs: accessListIDs,
-		Likes:         []string{},
+	if formErr != nil {
+		http.Error(w, formErr.Error(), http.StatusBadRequest)
+		return
 	}
 
-	channel := make(chan *database.InsertResponse)
+	prepared, prepareErr := prepareImage(&image, buf.Bytes(), keepMetadataFromForm(r), r.FormValue("duplicates"))
 
-	go insertImage(image, channel)
-
-	insertResponse := <-channel
-
-	if insertResponse.Err != nil {
-		common.SendInternalServerError(w)
+	if prepareErr != nil {
+		sendUploadError(w, prepareErr)
 		return
 	}
-	id := insertResponse.ID
 
-	_, uploadErr := s3Uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(id),
-		Body:   buf,
-	})
+	id, createErr := createImage(image, prepared.data, prepared.contentType, prepared.variants)
 
-	if uploadErr != nil {
+	if createErr != nil {
+		log.Println(createErr)
 		common.SendInternalServerError(w)
 		return
 	}
-	insertResponse.Err = nil
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	jsonResponse, _ := json.Marshal(insertResponse)
+	jsonResponse, _ := json.Marshal(addImageResponse{ID: id, Duplicates: prepared.nearDuplicates})
 	_, _ = w.Write(jsonResponse)
 }
 
+// Responds to an upload that prepareImage refused or could not process.
+func sendUploadError(w http.ResponseWriter, err error) {
+	if refused, ok := err.(*uploadError); ok {
+		http.Error(w, refused.message, refused.status)
+		return
+	}
+
+	log.Println(err)
+	common.SendInternalServerError(w)
+}
+
 func getHexImageIDFromRequest(r *http.Request) (*primitive.ObjectID, error) {
 	image := &model.Image{}
 
@@ -313,6 +348,50 @@ type acl struct {
 	ID		string	`json:"_id,omitempty", bson:"_id,omitempty"`
 	Add    []string `json:"add,omitempty" bson:"add,omitempty"`
 	Remove []string `json:"remove,omitempty" bson:"remove,omitempty"`
+	AddGroups    []string `json:"addGroups,omitempty" bson:"addGroups,omitempty"`
+	RemoveGroups []string `json:"removeGroups,omitempty" bson:"removeGroups,omitempty"`
+}
+
+/**
+Checks the group IDs of an ACL edit: they must be valid, not both added and removed, and the added groups must
+belong to the user.
+*/
+func validateACLGroups(userid string, acl *acl) (int, error) {
+	addSet := make(map[string]bool)
+	addHexes := []primitive.ObjectID{}
+
+	for _, k := range acl.AddGroups {
+		idHex, hexErr := primitive.ObjectIDFromHex(k)
+
+		if hexErr != nil {
+			return http.StatusBadRequest, errors.New("invalid group id: " + k)
+		}
+
+		addSet[k] = true
+		addHexes = append(addHexes, idHex)
+	}
+
+	for _, k := range acl.RemoveGroups {
+		if _, hexErr := primitive.ObjectIDFromHex(k); hexErr != nil {
+			return http.StatusBadRequest, errors.New("invalid group id: " + k)
+		}
+
+		if addSet[k] {
+			return http.StatusBadRequest, errors.New("group id present in both add and delete sets: " + k)
+		}
+	}
+
+	owned, err := groups.OwnsGroups(userid, addHexes)
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if !owned {
+		return http.StatusNotFound, errors.New("not all groups in add list found")
+	}
+
+	return http.StatusOK, nil
 }
 
 /**
@@ -320,20 +399,24 @@ type acl struct {
 
 	Adds the selected user IDs to the image's access control list (ACL)
 
+	Groups of the user can be added too; the image is then visible to the group's current members.
+
 	JSON body parameters:
 		- _id: the image ID.
 		- add: an array of strings: the user IDs to add.
 		- remove: an array of strings: user IDs to remove from database.
+		- addGroups: an array of strings: the IDs of the user's groups to add.
+		- removeGroups: an array of strings: group IDs to remove.
 
 	Returns:
 		- 200 OK: All users were added/removed to the ACL.
 		- 204 No Content: ACL was not modified.
-		- 400: Invalid image ID was sent, at least one invalid user ID was passed in, same user ID was present in both add and delete lists, or both add and remove lists are empty.
-		- 404: At least one user in the add and remove lists does not exist in the database, or image not found.
+		- 400: Invalid image ID was sent, at least one invalid user or group ID was passed in, same user or group ID was present in both add and delete lists, or all add and remove lists are empty.
+		- 404: At least one user in the add and remove lists does not exist in the database, a group in the add list is not one of the user's, or image not found.
 		- 500: Internal server error
  */
 func editImageACL(w http.ResponseWriter, r *http.Request) {
-	uid := getUserIDFromToken(r)
+	uid := middleware.GetUserIDFromToken(r)
 
 	acl := &acl{}
 
@@ -341,6 +424,8 @@ func editImageACL(w http.ResponseWriter, r *http.Request) {
 
 	acl.Add = util.RemoveDuplicatesFromStringArray(acl.Add)
 	acl.Remove = util.RemoveDuplicatesFromStringArray(acl.Remove)
+	acl.AddGroups = util.RemoveDuplicatesFromStringArray(acl.AddGroups)
+	acl.RemoveGroups = util.RemoveDuplicatesFromStringArray(acl.RemoveGroups)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -354,8 +439,8 @@ func editImageACL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(acl.Add) == 0 && len(acl.Remove) == 0 {
-		 http.Error(w, "no users passed to add/remove array", http.StatusBadRequest)
+	if len(acl.Add) == 0 && len(acl.Remove) == 0 && len(acl.AddGroups) == 0 && len(acl.RemoveGroups) == 0 {
+		 http.Error(w, "no users or groups passed to add/remove array", http.StatusBadRequest)
 		 return
 	}
 
@@ -378,8 +463,27 @@ func editImageACL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if status, groupErr := validateACLGroups(uid, acl); groupErr != nil {
+		if status == http.StatusInternalServerError {
+			log.Println(groupErr)
+			common.SendInternalServerError(w)
+		} else {
+			http.Error(w, groupErr.Error(), status)
+		}
+		return
+	}
+
+	// Only users who were not on the access list already are notified.
+	existing := database.FindOne("images", bson.D{{"_id", *hex}, {"authorid", uid}}, options.FindOne().SetProjection(bson.D{{"accessListIDs", 1}, {"accessListGroupIDs", 1}}))
+
+	if existing.Err != nil {
+		log.Println(existing.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
 	addChan := make(chan *database.UpdateResponse)
-	go updateACLAdd(*hex, uid, acl.Add, addChan)
+	go updateACLAdd(*hex, uid, acl.Add, acl.AddGroups, addChan)
 	responseAdd := <-addChan
 
 	if responseAdd.Matched == 0 {
@@ -394,7 +498,7 @@ func editImageACL(w http.ResponseWriter, r *http.Request) {
 	}
 
 	rmChan := make(chan *database.UpdateResponse)
-	go updateACLRemove(*hex, uid, acl.Remove, rmChan)
+	go updateACLRemove(*hex, uid, acl.Remove, acl.RemoveGroups, rmChan)
 	responseRemove := <-rmChan
 
 	if responseRemove.Err != nil {
@@ -408,15 +512,84 @@ func editImageACL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	notifyAddedUsers(hex.Hex(), uid, existing.Result, acl)
+
+	go webhooks.Dispatch(uid, model.WebhookEventACLChanged, webhooks.ACLChangedData{
+		ImageID:       hex.Hex(),
+		Added:         acl.Add,
+		Removed:       acl.Remove,
+		AddedGroups:   acl.AddGroups,
+		RemovedGroups: acl.RemoveGroups,
+	})
+
 	w.WriteHeader(http.StatusOK)
 }
 
 
 
+/**
+Notifies the users that an ACL edit gave access to an image, directly or through a group, and sends them an
+imageShared event. image is the image document as it was before the edit. Users who could already see the image are
+skipped.
+*/
+func notifyAddedUsers(imageID string, authorID string, image bson.M, acl *acl) {
+	skip := map[string]bool{authorID: true}
+
+	for _, k := range stringsOf(image["accessListIDs"]) {
+		skip[k] = true
+	}
+
+	existingMembers, existingErr := groups.GetMemberIDs(stringsOf(image["accessListGroupIDs"]))
+	addedMembers, addedErr := groups.GetMemberIDs(acl.AddGroups)
+
+	if existingErr != nil || addedErr != nil {
+		log.Println("could not look up group members to notify; notifying users added directly only")
+		addedMembers = []string{}
+	}
+
+	for _, k := range existingMembers {
+		skip[k] = true
+	}
+
+	for _, k := range append(acl.Add, addedMembers...) {
+		if !skip[k] {
+			go notifications.Notify(model.Notification{
+				UserID:  k,
+				Type:    model.NotificationTypeImageShared,
+				ActorID: authorID,
+				ImageID: imageID,
+			})
+
+			events.Publish(events.Event{
+				Type:     events.TypeImageShared,
+				Data:     events.ShareData{ImageID: imageID, AuthorID: authorID},
+				Audience: events.UserAudience(k),
+			})
+
+			skip[k] = true
+		}
+	}
+}
+
+// Gets the strings in an array field of a raw document.
+func stringsOf(field interface{}) []string {
+	values := []string{}
+
+	if array, ok := field.(bson.A); ok {
+		for _, k := range array {
+			if value, ok := k.(string); ok {
+				values = append(values, value)
+			}
+		}
+	}
+
+	return values
+}
+
 /**
 [PUT]
 
-Adds this user to the image's like list.
+Adds a like from this user to the image, and increases its like count.
 
 JSON body parameters:
 	- _id: the image ID.
@@ -426,6 +599,7 @@ Returns:
 	- 400: id not passed in, or invalid id passed in
 	- 404: Image not found, or user not authorised to view image. (no difference.)
 	- 409: User already liked image. No-op.
+	- 500: Internal server error.
 */
 func likeImage(w http.ResponseWriter, r *http.Request) {
 	likeUnlikeImage(w, r, true)
@@ -434,7 +608,7 @@ func likeImage(w http.ResponseWriter, r *http.Request) {
 /**
 [DELETE]
 
-Removes this user from the image's like list.
+Removes this user's like from the image, and decreases its like count.
 
 Query parameters:
 	- _id: the image ID.
@@ -444,6 +618,7 @@ Returns:
 	- 400: id not passed in.
 	- 404: Image not found, or user not authorised to view image. (no difference.)
 	- 409: User already unliked image. No-op.
+	- 500: Internal server error.
 */
 func unlikeImage(w http.ResponseWriter, r *http.Request) {
 	likeUnlikeImage(w, r, false)
@@ -464,7 +639,7 @@ Returns
 	- 500: Internal server error
 */
 func deleteImage(w http.ResponseWriter, r *http.Request) {
-	uid := getUserIDFromToken(r)
+	uid := middleware.GetUserIDFromToken(r)
 
 	hex, err := getHexImageIDFromRequest(r)
 
@@ -473,30 +648,43 @@ func deleteImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	channel := make(chan *database.DeleteResponse)
+	findChannel := make(chan imageDatabaseResponse)
 
-	go deleteImageFromDatabase(uid, *hex, channel)
+	go getDeletableImage(uid, *hex, findChannel)
 
-	res := <-channel
+	found := <-findChannel
 
-	if res.Err != nil {
+	if found.err != nil {
 		common.SendInternalServerError(w)
 		return
 	}
 
-	if res.NumberDeleted == 0 {
+	if len(found.images) == 0 {
 		http.Error(w, "image not found", http.StatusNotFound)
 		return
 	}
 
-	if _, err := s3Instance.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(bucketName),
-		Key: aws.String(hex.Hex()),
-	}); err != nil {
+	channel := make(chan *database.UpdateResponse)
+
+	go markImageDeleting(uid, *hex, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
 		common.SendInternalServerError(w)
 		return
 	}
 
+	if res.Matched == 0 {
+		http.Error(w, "image not found", http.StatusNotFound)
+		return
+	}
+
+	// The image is hidden from now on, so the deletion has taken effect even if cleaning up fails here.
+	if err := finishDeletingImage(found.images[0]); err != nil {
+		log.Println("image " + hex.Hex() + " left for the reconciler: " + err.Error())
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -506,73 +694,56 @@ Gets image by ID, if it is visible to the user.
 
 Accepted query parameters:
 	- id: Image ID.
+	- size: integer. Optional. Serves the smallest stored variant whose long edge is at least this many pixels, or the
+	  original if no variant is large enough.
+
+Supports conditional requests (If-None-Match, If-Modified-Since) and Range requests, and sets caching headers that
+depend on the image's access level.
 
 Returns: (image/*)
 		- 200 OK: With the provided image.
-		- 400: If id is not present, or an invalid ID is passed in.
+		- 206 Partial Content: With the requested byte ranges.
+		- 304 Not Modified: The client's cached copy is still valid.
+		- 400: If id is not present, an invalid ID is passed in, or size is not a positive integer.
 		- 404: If image is not found, or user is not authorised to view this image. (there is no difference).
+		- 416: The requested range is outside the image.
 */
 func getImage(w http.ResponseWriter, r *http.Request) {
-	const parseErrorMessage = "Could not parse id parameter"
-
-	imgIdArr, ok := r.URL.Query()["id"]
+	size := 0
 
-	if !ok || len(imgIdArr) < 1 || len(imgIdArr[0]) < 1 {
-		http.Error(w, parseErrorMessage, http.StatusBadRequest)
-		return
-	}
-
-	imgId := imgIdArr[0]
+	if sizeQuery, sizeOK := r.URL.Query()["size"]; sizeOK && len(sizeQuery) > 0 && len(sizeQuery[0]) > 0 {
+		conv, convErr := strconv.Atoi(sizeQuery[0])
 
-	hex, hexErr := primitive.ObjectIDFromHex(imgId)
+		if convErr != nil || conv <= 0 {
+			http.Error(w, "Could not parse size parameter", http.StatusBadRequest)
+			return
+		}
 
-	if hexErr != nil {
-		http.Error(w, parseErrorMessage, http.StatusBadRequest)
-		return
+		size = conv
 	}
 
-	loggedInUser := getUserIDFromTokenNotStrictValidation(r)
-	visibilityFilters := buildVisibilityFilters(loggedInUser)
+	image, ok := getVisibleImageFromQuery(w, r)
 
-	filter := bson.D{{"$and",
-		[]interface{}{
-			bson.D{{"$or", visibilityFilters}},
-			bson.D{{"_id", hex},
-			}}}}
-
-	channel := make(chan imageDatabaseResponse)
-
-	go getOneImage(filter, nil, channel)
-
-	res := <-channel
-
-	if res.err != nil {
-		common.SendInternalServerError(w)
+	if !ok {
 		return
 	}
 
-	if len(res.images) == 0 {
-		http.Error(w, "Image not found", http.StatusNotFound)
-		return
-	}
+	key := imageKey(image)
 
-	file, err := ioutil.TempFile("", imgId)
+	if size > 0 {
+		if variant, found := pickVariant(image, size); found {
+			key = variantKey(imageKey(image), variant.Size)
+		}
+	}
 
-	if err != nil {
-		log.Println(err)
-		common.SendInternalServerError(w)
+	if respondNotModified(w, r, image, key) {
 		return
 	}
 
-	defer os.Remove(file.Name())
-
-	_, dlErr := s3Downloader.Download(file, &s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(imgId),
-	})
+	object, dlErr := getObjectForRequest(r, key)
 
 	if dlErr != nil {
-		if strings.Contains(dlErr.Error(), "NoSuchKey") {
+		if dlErr == storage.ErrNotFound {
 			http.Error(w, "Image not found", http.StatusNotFound)
 		} else {
 			log.Println(dlErr)
@@ -581,17 +752,7 @@ func getImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fileContent, fileErr := ioutil.ReadFile(file.Name())
-
-	if fileErr != nil {
-		log.Println(fileErr)
-		common.SendInternalServerError(w)
-		return
-	}
-
-	w.Header().Add("Content-Type", http.DetectContentType(fileContent))
-	w.WriteHeader(http.StatusOK)
-	w.Write(fileContent)
+	serveImageObject(w, r, image, key, object)
 }
 
 /**
@@ -605,24 +766,48 @@ func getImage(w http.ResponseWriter, r *http.Request) {
 		- limit: integer. the limit on the number of images to fetch. Default 10 if not specified.
 		- user: comma-separated string. Gets images from particular user(s).
 		- id: comma-separated string. Image ID(s). All other parameters are ignored if this is possed in.
+		- orientation: landscape/portrait/square. Gets images with the given orientation.
+		- takenBefore: UNIX time stamp. Gets images that were captured before this time, according to their EXIF data.
+		- takenAfter: UNIX time stamp. Gets images that were captured after this time, according to their EXIF data.
+		- album: album ID. Gets the images of an album that is visible to the user, in album order rather than
+		  chronologically. Images the user cannot see are left out.
+		- offset: integer. With album, the number of the album's images to skip.
+		- tag: comma-separated string. Gets images with any of these tags, or all of them if tagMode is all.
+		- tagMode: any/all. Default any.
+
+	Each image includes its likeCount, and whether the user likes it (likedByMe). The users who like an image are
+	listed by /getLikers.
 
 	Returns: (application/json)
 		- 200: With list of images that match search criteria.
-		- 400: If an invalid hex ID was passed in.
+		- 400: If an invalid hex ID, orientation, tag or tagMode was passed in.
+		- 404: The album does not exist or is not visible to the user.
 		- 500: Internal server error.
 */
 func getImagesMetadata(w http.ResponseWriter, r *http.Request) {
-	if filter, limit, hexErr := buildImageQuery(r); hexErr != nil {
-		http.Error(w, hexErr.Error(), http.StatusBadRequest)
+	if query, queryErr := buildImageQuery(r); queryErr != nil {
+		switch queryErr {
+		case errAlbumNotFound:
+			http.Error(w, queryErr.Error(), http.StatusNotFound)
+		case errAlbumLookupFailed:
+			common.SendInternalServerError(w)
+		default:
+			http.Error(w, queryErr.Error(), http.StatusBadRequest)
+		}
 	} else {
 		opts := &options.FindOptions{
-			Limit: &limit,
+			Limit: &query.limit,
 			Sort:  bson.D{{"uploadDateTime", -1}},
 		}
 
+		// Album images are ordered and paged after they are fetched.
+		if query.album != nil {
+			opts = &options.FindOptions{}
+		}
+
 		channel := make(chan imageDatabaseResponse)
 
-		go getImagesMetadataFromDatabase(*filter, opts, channel)
+		go getImagesMetadataFromDatabase(query.filter, opts, channel)
 
 		res := <-channel
 
@@ -631,9 +816,16 @@ func getImagesMetadata(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		appendAuthorsToImages(res.images, *res.userIDMap)
+		images := res.images
+
+		if query.album != nil {
+			images = orderByAlbum(images, query)
+		}
 
-		marshalled, _ := json.Marshal(res.images)
+		appendAuthorsToImages(images, *res.userIDMap)
+		setLikedByMe(middleware.GetUserIDFromTokenNotStrictValidation(r), images)
+
+		marshalled, _ := json.Marshal(images)
 
 		w.Header().Add("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
@@ -641,28 +833,38 @@ func getImagesMetadata(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-/**
-Initializes the AWS session, S3 Client S3 Uploader and S3 Downloader.
-*/
-func initAWS() {
-	awsSession = session.Must(session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable}))
-	s3Instance = s3.New(awsSession)
-	s3Uploader = s3manager.NewUploader(awsSession)
-	s3Downloader = s3manager.NewDownloader(awsSession)
-}
-
 func ServeImageRoutes(r *mux.Router) {
-	initAWS()
+	loadVariantSizes()
+	loadDuplicateDistance()
+	loadBatchUploadConcurrency()
+	createImageIndexes()
+	createLikeIndexes()
+	createAffinityIndexes()
+
+	go migrateLegacyLikes()
 
 	r.HandleFunc("/getImage", getImage).Methods("GET")
 	r.HandleFunc("/getImagesMetadata", getImagesMetadata).Methods("GET")
+	r.HandleFunc("/transformImage", transformImage).Methods("GET")
+	r.HandleFunc("/getDuplicateImages", getDuplicateImages).Methods("GET")
+	r.HandleFunc("/getTrendingTags", getTrendingTags).Methods("GET")
+	r.HandleFunc("/getLikers", getLikers).Methods("GET")
+	r.HandleFunc("/uploadObject", uploadObject).Methods("PUT")
+	r.Handle("/getUploadStatus", middleware.JWTMiddleware(http.HandlerFunc(getUploadStatus))).Methods("GET")
+	r.Handle("/getFeed", middleware.JWTMiddleware(http.HandlerFunc(getFeed))).Methods("GET")
 
 	s := r.Methods("DELETE", "PATCH", "POST").Subrouter()
 
 	s.Use(middleware.JWTMiddleware)
 
 	s.HandleFunc("/addImage", addNewImage).Methods("POST")
+	s.HandleFunc("/addImages", addNewImages).Methods("POST")
+	s.HandleFunc("/requestUpload", requestUpload).Methods("POST")
+	s.HandleFunc("/finalizeUpload", finalizeUpload).Methods("POST")
+	s.HandleFunc("/startResumableUpload", startResumableUpload).Methods("POST")
+	s.HandleFunc("/uploadChunk", uploadChunk).Methods("PATCH")
 	s.HandleFunc("/deleteImage", deleteImage).Methods("DELETE")
+	s.HandleFunc("/editImage", editImage).Methods("PATCH")
 	s.HandleFunc("/editImageACL", editImageACL).Methods("PATCH")
 	s.HandleFunc("/likeImage", likeImage).Methods("PATCH")
 	s.HandleFunc("/unlikeImage", unlikeImage).Methods("DELETE")
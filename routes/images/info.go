@@ -0,0 +1,59 @@
+package images
+
+import (
+	"github.com/kilowatt-/ImageRepository/imaging"
+	"github.com/kilowatt-/ImageRepository/model"
+	"net/http"
+)
+
+const landscape = "landscape"
+const portrait = "portrait"
+const square = "square"
+
+var orientationSet = map[string]bool{
+	landscape: true,
+	portrait:  true,
+	square:    true,
+}
+
+/**
+Extracts the technical metadata of an uploaded image from the file as it will be stored. The EXIF summary is read
+after metadata is stripped, so the capture time and camera are only recorded when the uploader kept the metadata.
+Width and height are the displayed dimensions, i.e. after the EXIF orientation has been applied.
+*/
+func extractImageInfo(stored []byte) model.ImageInfo {
+	contentType := http.DetectContentType(stored)
+	exif := imaging.ReadExif(stored, contentType)
+
+	info := model.ImageInfo{
+		ByteSize:    int64(len(stored)),
+		TakenAt:     exif.TakenAt,
+		CameraMake:  exif.CameraMake,
+		CameraModel: exif.CameraModel,
+	}
+
+	config, format, err := imaging.DecodeConfig(stored)
+
+	if err != nil {
+		return info
+	}
+
+	info.Format = format
+	info.Width, info.Height = config.Width, config.Height
+
+	// Orientations 5-8 are stored rotated by 90 degrees.
+	if exif.Orientation >= 5 {
+		info.Width, info.Height = info.Height, info.Width
+	}
+
+	switch {
+	case info.Width > info.Height:
+		info.Orientation = landscape
+	case info.Width < info.Height:
+		info.Orientation = portrait
+	default:
+		info.Orientation = square
+	}
+
+	return info
+}
@@ -0,0 +1,189 @@
+package images
+
+import (
+	"errors"
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/albums"
+	"github.com/kilowatt-/ImageRepository/routes/comments"
+	"github.com/kilowatt-/ImageRepository/routes/events"
+	"github.com/kilowatt-/ImageRepository/routes/groups"
+	"github.com/kilowatt-/ImageRepository/routes/notifications"
+	"github.com/kilowatt-/ImageRepository/routes/webhooks"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+)
+
+/**
+Creates an image: inserts its document as pending, stores its files, then commits the document.
+
+If any step fails, the steps already taken are undone before the error is returned. Anything that cannot be undone
+(e.g. because the process dies) is left pending and cleaned up by the reconciler.
+
+Returns the ID of the new image.
+*/
+func createImage(image model.Image, data []byte, contentType string, variants []encodedVariant) (string, error) {
+	image.Status = model.ImageStatusPending
+	image.BlobKey = contentHash(data)
+
+	insertChannel := make(chan *database.InsertResponse)
+
+	go insertImage(image, insertChannel)
+
+	insertResponse := <-insertChannel
+
+	if insertResponse.Err != nil {
+		return "", insertResponse.Err
+	}
+
+	hex, _ := primitive.ObjectIDFromHex(insertResponse.ID)
+
+	if err := completeImage(hex, image.BlobKey, data, contentType, variants); err != nil {
+		return "", err
+	}
+
+	return insertResponse.ID, nil
+}
+
+/**
+Stores the files of a pending image, then commits it. If any step fails, the image is abandoned.
+*/
+func completeImage(imageid primitive.ObjectID, blobKey string, data []byte, contentType string, variants []encodedVariant) error {
+	if err := acquireBlob(blobKey, imageid.Hex(), int64(len(data)), contentType); err != nil {
+		abandonImage(imageid, blobKey)
+		return err
+	}
+
+	if err := storeBlob(blobKey, data, contentType, variants); err != nil {
+		abandonImage(imageid, blobKey)
+		return err
+	}
+
+	commitChannel := make(chan *database.UpdateResponse)
+
+	go commitImage(imageid, commitChannel)
+
+	commitResponse := <-commitChannel
+
+	if commitResponse.Err != nil || commitResponse.Matched == 0 {
+		abandonImage(imageid, blobKey)
+
+		if commitResponse.Err != nil {
+			return commitResponse.Err
+		}
+		return errors.New("pending image " + imageid.Hex() + " disappeared before it was committed")
+	}
+
+	go publishImageCreated(imageid)
+
+	return nil
+}
+
+/**
+Sends an imageCreated event about a newly committed image to the subscribers who can see it, and an image.created
+event to its author's webhooks.
+*/
+func publishImageCreated(imageid primitive.ObjectID) {
+	res := database.FindOne("images", bson.D{{"_id", imageid}}, nil)
+
+	if res.Err != nil || res.Result == nil {
+		return
+	}
+
+	images := decodeImages([]bson.M{res.Result})
+	image := images[0]
+
+	members, err := groups.GetMemberIDs(image.AccessListGroupIDs)
+
+	if err != nil {
+		log.Println("could not look up group members of image " + image.ID + ": " + err.Error())
+	}
+
+	events.Publish(events.Event{
+		Type:     events.TypeImageCreated,
+		Data:     image,
+		Audience: events.ImageAudience(image.AccessLevel, image.AuthorID, append(image.AccessListIDs, members...)),
+	})
+
+	webhooks.Dispatch(image.AuthorID, model.WebhookEventImageCreated, image)
+}
+
+/**
+Undoes a failed createImage or upload: releases the blob reference, if the image had one, and removes the pending
+document.
+*/
+func abandonImage(imageid primitive.ObjectID, blobKey string) {
+	if blobKey != "" {
+		if err := releaseBlob(blobKey, imageid.Hex()); err != nil {
+			log.Println("could not release blob of abandoned image " + imageid.Hex() + ": " + err.Error())
+			return
+		}
+	}
+
+	channel := make(chan *database.DeleteResponse)
+
+	go discardImage(imageid, channel)
+
+	if res := <-channel; res.Err != nil {
+		log.Println("could not remove abandoned image " + imageid.Hex() + ": " + res.Err.Error())
+	}
+}
+
+/**
+Finishes deleting an image that has been marked as deleting: releases its files, removes it from any albums,
+deletes its likes and comments, then removes its document.
+
+If this fails, the image stays hidden in the deleting state and the reconciler retries.
+*/
+func finishDeletingImage(image *model.Image) error {
+	if err := deleteImageObjects(image); err != nil {
+		return err
+	}
+
+	albumChannel := make(chan *database.UpdateResponse)
+
+	go albums.RemoveImagesFromAlbums([]string{image.ID}, albumChannel)
+
+	if res := <-albumChannel; res.Err != nil {
+		return res.Err
+	}
+
+	if err := deleteImageLikes([]string{image.ID}); err != nil {
+		return err
+	}
+
+	commentChannel := make(chan *database.DeleteResponse)
+
+	go comments.DeleteImageComments([]string{image.ID}, commentChannel)
+
+	if res := <-commentChannel; res.Err != nil {
+		return res.Err
+	}
+
+	notificationChannel := make(chan *database.DeleteResponse)
+
+	go notifications.DeleteImageNotifications([]string{image.ID}, notificationChannel)
+
+	if res := <-notificationChannel; res.Err != nil {
+		return res.Err
+	}
+
+	hex, hexErr := primitive.ObjectIDFromHex(image.ID)
+
+	if hexErr != nil {
+		return hexErr
+	}
+
+	channel := make(chan *database.DeleteResponse)
+
+	go discardImage(hex, channel)
+
+	if res := <-channel; res.Err != nil {
+		return res.Err
+	}
+
+	go webhooks.Dispatch(image.AuthorID, model.WebhookEventImageDeleted, webhooks.ImageDeletedData{ImageID: image.ID})
+
+	return nil
+}
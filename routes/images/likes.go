@@ -0,0 +1,317 @@
+package images
+
+import (
+	"encoding/json"
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/middleware"
+	"github.com/kilowatt-/ImageRepository/routes/users"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultLikerLimit = 20
+const maxLikerLimit = 100
+
+// A user who likes an image.
+type liker struct {
+	ID         string    `json:"_id"`
+	Name       string    `json:"name,omitempty"`
+	UserHandle string    `json:"userHandle,omitempty"`
+	LikedAt    time.Time `json:"likedAt"`
+}
+
+type likerPage struct {
+	Likers     []liker `json:"likers"`
+	NextCursor string  `json:"nextCursor,omitempty"`
+}
+
+/**
+Creates the indexes that like queries rely on. Each user can like an image only once.
+*/
+func createLikeIndexes() {
+	if err := database.CreateIndex("likes", bson.D{{"imageID", 1}, {"userid", 1}}, options.Index().SetUnique(true)); err != nil {
+		log.Println("could not create like index: " + err.Error())
+	}
+
+	indexes := []bson.D{
+		{{"imageID", 1}, {"_id", -1}},
+		{{"userid", 1}, {"imageAuthorID", 1}},
+	}
+
+	for _, k := range indexes {
+		if err := database.CreateIndex("likes", k, nil); err != nil {
+			log.Println("could not create like index: " + err.Error())
+		}
+	}
+}
+
+/**
+Sets the likedByMe flag of each image that the given user likes. Does nothing for anonymous users.
+*/
+func setLikedByMe(userid string, images []*model.Image) {
+	if userid == "" || len(images) == 0 {
+		return
+	}
+
+	ids := make([]string, len(images))
+
+	for i, k := range images {
+		ids[i] = k.ID
+	}
+
+	filter := bson.D{{"userid", userid}, {"imageID", bson.D{{"$in", ids}}}}
+	res := database.Find("likes", filter, options.Find().SetProjection(bson.D{{"imageID", 1}}))
+
+	if res.Err != nil {
+		log.Println("could not look up likes: " + res.Err.Error())
+		return
+	}
+
+	liked := make(map[string]bool)
+
+	for _, k := range res.Result {
+		if imageID, ok := k["imageID"].(string); ok {
+			liked[imageID] = true
+		}
+	}
+
+	for _, k := range images {
+		k.LikedByMe = liked[k.ID]
+	}
+}
+
+// Deletes the likes of the given images. Called when images are deleted.
+func deleteImageLikes(imageIDs []string) error {
+	return database.Delete("likes", bson.D{{"imageID", bson.D{{"$in", imageIDs}}}}, nil).Err
+}
+
+/**
+Moves likes that are still stored in image documents into the likes collection, and adds them to the like counts of
+their images. Safe to run again if it is interrupted, and on several servers at once.
+*/
+func migrateLegacyLikes() {
+	filter := bson.D{{"likes.0", bson.D{{"$exists", true}}}}
+	projection := bson.D{{"authorid", 1}, {"likes", 1}, {"uploadDateTime", 1}}
+	found := database.Find("images", filter, options.Find().SetProjection(projection))
+
+	if found.Err != nil {
+		log.Println("could not migrate likes: " + found.Err.Error())
+		return
+	}
+
+	migrated := 0
+
+	for _, k := range decodeImages(found.Result) {
+		if err := migrateImageLikes(k); err != nil {
+			log.Println("could not migrate likes of image " + k.ID + ": " + err.Error())
+			continue
+		}
+
+		migrated++
+	}
+
+	if migrated > 0 {
+		log.Println("migrated likes of " + strconv.Itoa(migrated) + " images")
+	}
+}
+
+/**
+Moves the legacy likes of one image. Legacy likes were never counted in likeCount, which only counts likes given
+through the likes collection, so each moved like increases it by one.
+
+Each like is moved in two steps. First, a like record marked as migrated is inserted, unless the user has liked the
+image again since, in which case that like is already counted. Legacy likes have no date, so the record is dated at
+the image's upload, and its ID is made from that time, so that getLikers, which pages by ID, lists it among the
+image's earliest likes. Then the user is removed from the image's legacy likes
+and the count is increased, in one update that only matches while the user is still in the legacy likes. The count is
+never overwritten, so likes and unlikes during the migration are kept, and a like moved by an interrupted or
+concurrent run is counted exactly once.
+*/
+func migrateImageLikes(image *model.Image) error {
+	hex, _ := primitive.ObjectIDFromHex(image.ID)
+
+	for _, k := range image.Likes {
+		filter := bson.D{{"imageID", image.ID}, {"userid", k}}
+		update := bson.D{{"$setOnInsert", bson.D{
+			{"_id", primitive.NewObjectIDFromTimestamp(image.UploadDate)},
+			{"imageID", image.ID},
+			{"userid", k},
+			{"imageAuthorID", image.AuthorID},
+			{"createdAt", image.UploadDate},
+			{"migrated", true},
+		}}}
+
+		res := database.UpdateOne("likes", filter, update, options.Update().SetUpsert(true))
+
+		if res.Err != nil {
+			return res.Err
+		}
+
+		// Count the like if this run inserted its record, or an earlier run did but stopped before removing it from the image.
+		increment := 0
+
+		if res.Matched == 0 {
+			increment = 1
+		} else {
+			earlier := database.FindOne("likes", append(filter, bson.E{Key: "migrated", Value: true}), nil)
+
+			if earlier.Err != nil {
+				return earlier.Err
+			}
+
+			if earlier.Result != nil {
+				increment = 1
+			}
+		}
+
+		imageUpdate := bson.D{
+			{"$pull", bson.D{{"likes", k}}},
+			{"$inc", bson.D{{"likeCount", increment}}},
+		}
+
+		if res := database.UpdateOne("images", bson.D{{"_id", hex}, {"likes", k}}, imageUpdate, nil); res.Err != nil {
+			return res.Err
+		}
+	}
+
+	return nil
+}
+
+/**
+	[GET]
+
+	Gets the users who like an image visible to the user, most recent like first.
+
+	Accepted query parameters:
+		- id: the image ID.
+		- cursor: Optional. The nextCursor of the previous page.
+		- limit: integer. The number of users to return. Default 20, max 100.
+
+	Returns: (application/json)
+		- 200: The likers, each with their _id, name, userHandle and when they liked the image, and a nextCursor to get
+		  the next page with. nextCursor is left out on the last page.
+		- 400: An invalid image ID or cursor was passed in.
+		- 404: Image not found, or user not authorised to view image. (no difference.)
+		- 500: Internal server error.
+*/
+func getLikers(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromTokenNotStrictValidation(r)
+
+	hex, hexErr := getHexIDFromString(r.URL.Query().Get("id"))
+
+	if hexErr != nil {
+		http.Error(w, hexErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter := bson.D{{"imageID", hex.Hex()}}
+
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		cursorHex, cursorErr := primitive.ObjectIDFromHex(cursor)
+
+		if cursorErr != nil {
+			http.Error(w, "invalid cursor passed in: "+cursor, http.StatusBadRequest)
+			return
+		}
+
+		filter = append(filter, bson.E{Key: "_id", Value: bson.D{{"$lt", cursorHex}}})
+	}
+
+	var limit int64 = defaultLikerLimit
+
+	if limitQuery := r.URL.Query().Get("limit"); limitQuery != "" {
+		if conv, convErr := strconv.ParseInt(limitQuery, 10, 64); convErr == nil && conv > 0 {
+			limit = conv
+		}
+	}
+
+	if limit > maxLikerLimit {
+		limit = maxLikerLimit
+	}
+
+	authorID, findErr := common.GetVisibleImageAuthor(common.GetViewer(uid), *hex)
+
+	if findErr != nil {
+		log.Println(findErr)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if authorID == "" {
+		http.Error(w, imageNotFound, http.StatusNotFound)
+		return
+	}
+
+	// Fetch one like more than the limit, to find out whether there is a next page.
+	opts := options.Find().SetSort(bson.D{{"_id", -1}}).SetLimit(limit + 1)
+	res := database.Find("likes", filter, opts)
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	likes := []model.Like{}
+
+	for _, k := range res.Result {
+		like := model.Like{}
+
+		bsonBytes, _ := bson.Marshal(k)
+
+		_ = bson.Unmarshal(bsonBytes, &like)
+
+		likes = append(likes, like)
+	}
+
+	page := likerPage{Likers: []liker{}}
+
+	if int64(len(likes)) > limit {
+		likes = likes[:limit]
+		page.NextCursor = likes[limit-1].ID
+	}
+
+	userIDs := []primitive.ObjectID{}
+
+	for _, k := range likes {
+		if userHex, err := primitive.ObjectIDFromHex(k.UserID); err == nil {
+			userIDs = append(userIDs, userHex)
+		}
+	}
+
+	usersChannel := make(chan []users.FindUserResponse)
+
+	go users.GetUsersFromDatabase(bson.D{{"_id", bson.D{{"$in", userIDs}}}}, bson.D{{"name", 1}, {"userHandle", 1}}, usersChannel)
+
+	found := <-usersChannel
+
+	if len(found) == 1 && found[0].Err != nil {
+		log.Println(found[0].Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	userMap := make(map[string]model.User)
+
+	for _, k := range found {
+		userMap[k.User.ID] = k.User
+	}
+
+	for _, k := range likes {
+		user := userMap[k.UserID]
+		page.Likers = append(page.Likers, liker{ID: k.UserID, Name: user.Name, UserHandle: user.UserHandle, LikedAt: k.CreatedAt})
+	}
+
+	jsonResponse, _ := json.Marshal(page)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonResponse)
+}
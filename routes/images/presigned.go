@@ -0,0 +1,348 @@
+package images
+
+import (
+	"encoding/json"
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/middleware"
+	"github.com/kilowatt-/ImageRepository/storage"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files uploaded directly to storage are staged under this prefix until they are finalized.
+const uploadKeyPrefix = "uploads/"
+
+// How long an upload URL stays valid. Must be shorter than pendingImageTimeout, after which the image is abandoned.
+const uploadTicketLifetime = 10 * time.Minute
+
+type uploadTicketResponse struct {
+	ID        string            `json:"_id"`
+	UploadURL string            `json:"uploadURL"`
+	Method    string            `json:"method"`
+	Headers   map[string]string `json:"headers"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+}
+
+// Returns the staging key that the file of a pending upload is uploaded to.
+func uploadKey(imageID string) string {
+	return uploadKeyPrefix + imageID
+}
+
+// Returns the ID of the image that a staged upload or chunk belongs to.
+func uploadIDFromKey(key string) string {
+	return strings.SplitN(strings.TrimPrefix(key, uploadKeyPrefix), "/", 2)[0]
+}
+
+// Deletes the staged file or chunks of an upload.
+func deleteStagedUpload(imageID string) error {
+	key := uploadKey(imageID)
+
+	objects, err := storage.List(key)
+
+	if err != nil {
+		return err
+	}
+
+	for _, k := range objects {
+		if k.Key != key && !strings.HasPrefix(k.Key, key+"/") {
+			continue
+		}
+
+		if err := storage.Delete(k.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+Reads the staged file of a pending upload, assembling the chunks of a resumable upload.
+
+Returns an *uploadError if the file is incomplete or too large.
+*/
+func readStagedUpload(image *model.Image) ([]byte, error) {
+	if image.Upload.Resumable {
+		if image.Upload.Offset < image.Upload.Length {
+			return nil, &uploadError{http.StatusBadRequest, "upload is incomplete"}
+		}
+
+		return assembleChunks(image.Upload)
+	}
+
+	object, err := storage.Get(uploadKey(image.ID))
+
+	if err == storage.ErrNotFound {
+		return nil, &uploadError{http.StatusBadRequest, "file has not been uploaded"}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer object.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(object.Body, maxUploadSize+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > maxUploadSize {
+		return nil, &uploadError{http.StatusRequestEntityTooLarge, "file is larger than " + strconv.Itoa(maxUploadSize) + " bytes"}
+	}
+
+	return data, nil
+}
+
+/**
+	[POST] application/x-www-form-urlencoded
+
+	Requests an upload ticket: creates a pending image and returns a URL that its file can be uploaded to directly,
+	without passing through this server. Once the file is uploaded, the image is published with /finalizeUpload.
+
+	Accepts the same form fields as /addImage, except file, plus:
+		- contentType: the MIME type of the file that will be uploaded.
+
+	Returns: (application/json)
+		- 200: The image ID, and the URL, method and headers to upload the file with, and when the URL expires.
+		- 400: contentType is missing or not an accepted image type, or the tags are invalid or too many.
+		- 500: Internal server error.
+*/
+func requestUpload(w http.ResponseWriter, r *http.Request) {
+	contentType := r.FormValue("contentType")
+
+	if !validateAcceptableMIMEType(contentType) {
+		http.Error(w, uploadNonImageFileTypeErr, http.StatusBadRequest)
+		return
+	}
+
+	image, formErr := imageFromForm(r, middleware.GetUserIDFromToken(r))
+
+	if formErr != nil {
+		http.Error(w, formErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	expiresAt := time.Now().Add(uploadTicketLifetime)
+
+	image.Status = model.ImageStatusPending
+	image.Upload = &model.PendingUpload{
+		ContentType:  contentType,
+		KeepMetadata: keepMetadataFromForm(r),
+		Duplicates:   r.FormValue("duplicates"),
+		ExpiresAt:    expiresAt,
+	}
+
+	insertChannel := make(chan *database.InsertResponse)
+
+	go insertImage(image, insertChannel)
+
+	insertResponse := <-insertChannel
+
+	if insertResponse.Err != nil {
+		log.Println(insertResponse.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	uploadURL, presignErr := storage.PresignPut(uploadKey(insertResponse.ID), contentType, uploadTicketLifetime)
+
+	if presignErr != nil {
+		log.Println(presignErr)
+
+		hex, _ := primitive.ObjectIDFromHex(insertResponse.ID)
+		discardChannel := make(chan *database.DeleteResponse)
+
+		go discardImage(hex, discardChannel)
+
+		<-discardChannel
+
+		common.SendInternalServerError(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	jsonResponse, _ := json.Marshal(uploadTicketResponse{
+		ID:        insertResponse.ID,
+		UploadURL: uploadURL,
+		Method:    http.MethodPut,
+		Headers:   map[string]string{"Content-Type": contentType},
+		ExpiresAt: expiresAt,
+	})
+	_, _ = w.Write(jsonResponse)
+}
+
+// Abandons a pending upload whose file was refused, deleting the staged file. The upload never had a blob to release.
+func rejectUpload(imageid primitive.ObjectID) {
+	channel := make(chan *database.DeleteResponse)
+
+	go discardImage(imageid, channel)
+
+	if res := <-channel; res.Err != nil {
+		log.Println("could not remove rejected upload " + imageid.Hex() + ": " + res.Err.Error())
+	}
+
+	if err := deleteStagedUpload(imageid.Hex()); err != nil {
+		log.Println(err)
+	}
+}
+
+/**
+	[POST]
+
+	Finalizes an upload requested with /requestUpload or /startResumableUpload: validates and processes the uploaded
+	file in the same way as /addImage, then publishes the image. If the file is refused, the upload is cancelled and a
+	new one must be requested.
+
+	JSON body parameters:
+		- _id: the image ID returned by /requestUpload or /startResumableUpload.
+
+	Returns: (application/json)
+		- 200: The image ID, and any near-identical images if the upload was requested with duplicates=warn.
+		- 400: The file has not been uploaded yet or is incomplete, or it is not an accepted image type.
+		- 404: No unfinalized upload with this ID belongs to the user.
+		- 409: The upload was requested with duplicates=reject, and the user already has a near-identical image.
+		- 413: The file is larger than 10MB.
+		- 500: Internal server error.
+*/
+func finalizeUpload(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	hex, err := getHexImageIDFromRequest(r)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	findChannel := make(chan imageDatabaseResponse)
+
+	go getPendingUpload(uid, *hex, findChannel)
+
+	found := <-findChannel
+
+	if found.err != nil {
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if len(found.images) == 0 {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+
+	image := found.images[0]
+
+	data, readErr := readStagedUpload(image)
+
+	if readErr != nil {
+		// An incomplete upload can still be completed, but an oversized one cannot.
+		if refused, ok := readErr.(*uploadError); ok && refused.status == http.StatusRequestEntityTooLarge {
+			rejectUpload(*hex)
+		}
+
+		sendUploadError(w, readErr)
+		return
+	}
+
+	prepared, prepareErr := prepareImage(image, data, image.Upload.KeepMetadata, image.Upload.Duplicates)
+
+	if prepareErr != nil {
+		if _, refused := prepareErr.(*uploadError); refused {
+			rejectUpload(*hex)
+		}
+
+		sendUploadError(w, prepareErr)
+		return
+	}
+
+	image.BlobKey = contentHash(prepared.data)
+	image.UploadDate = time.Now()
+
+	updateChannel := make(chan *database.UpdateResponse)
+
+	go setUploadedImageContent(*hex, image, updateChannel)
+
+	updateResponse := <-updateChannel
+
+	if updateResponse.Err != nil {
+		log.Println(updateResponse.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	// Another request finalized the upload first, or it timed out and was abandoned.
+	if updateResponse.Matched == 0 {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+
+	if completeErr := completeImage(*hex, image.BlobKey, prepared.data, prepared.contentType, prepared.variants); completeErr != nil {
+		log.Println(completeErr)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if deleteErr := deleteStagedUpload(image.ID); deleteErr != nil {
+		log.Println("could not delete staged upload of image " + image.ID + ": " + deleteErr.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	jsonResponse, _ := json.Marshal(addImageResponse{ID: image.ID, Duplicates: prepared.nearDuplicates})
+	_, _ = w.Write(jsonResponse)
+}
+
+/**
+	[PUT]
+
+	Receives a file uploaded to a URL issued by the local storage backend. Authenticated by the URL's signature rather
+	than a JWT. Not used with S3, whose upload URLs point at S3 itself.
+
+	Accepted query parameters:
+		- key, expires, signature: set by the upload URL.
+
+	Returns:
+		- 200: File stored.
+		- 403: The signature is invalid or has expired.
+		- 413: The file is larger than 10MB.
+		- 500: Internal server error.
+*/
+func uploadObject(w http.ResponseWriter, r *http.Request) {
+	key, verifyErr := storage.VerifySignedPut(r.URL.Query())
+
+	if verifyErr != nil {
+		http.Error(w, verifyErr.Error(), http.StatusForbidden)
+		return
+	}
+
+	if r.ContentLength > maxUploadSize {
+		http.Error(w, "file is larger than "+strconv.Itoa(maxUploadSize)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Read one byte more than allowed, so that oversized files without a Content-Length can be detected.
+	if err := storage.Put(key, io.LimitReader(r.Body, maxUploadSize+1), r.Header.Get("Content-Type")); err != nil {
+		log.Println(err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if info, statErr := storage.Stat(key); statErr == nil && info.Size > maxUploadSize {
+		_ = storage.Delete(key)
+		http.Error(w, "file is larger than "+strconv.Itoa(maxUploadSize)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -2,25 +2,48 @@ package images
 
 import (
 	"errors"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/albums"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/middleware"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 )
 
+var errAlbumNotFound = errors.New("album not found")
+
+// Returned when the album named by the album parameter could not be looked up.
+var errAlbumLookupFailed = errors.New("could not look up album")
+
+// An image query built from the parameters passed in a request.
+type imageQuery struct {
+	filter bson.D
+	limit  int64
+	// The album whose images are queried, if any. Its images are returned in album order rather than newest first,
+	// skipping the first offset of them.
+	album  *model.Album
+	offset int64
+}
+
 /**
 Builds the image query based on the parameters passed in the request.
 
-Returns a BSON Document representing the database query to be built, and a number that represents the limit.
+Returns errAlbumNotFound or errAlbumLookupFailed if an album was passed in and could not be found; any other error
+means that a parameter is invalid.
 */
-func buildImageQuery(r *http.Request) (*bson.D, int64, error) {
-	loggedInUser := getUserIDFromTokenNotStrictValidation(r)
+func buildImageQuery(r *http.Request) (*imageQuery, error) {
+	loggedInUser := middleware.GetUserIDFromTokenNotStrictValidation(r)
 
 	before := time.Time{}
 	after := time.Time{}
 	var limit int64 = 10
+	var offset int64 = 0
+	var album *model.Album
 	user := []string{}
 	ids := []primitive.ObjectID{}
 
@@ -34,7 +57,7 @@ func buildImageQuery(r *http.Request) (*bson.D, int64, error) {
 			hex, err := primitive.ObjectIDFromHex(k)
 
 			if err != nil {
-				return nil, limit, errors.New("invalid image ID passed in: " + k)
+				return nil, errors.New("invalid image ID passed in: " + k)
 			}
 
 			ids = append(ids, hex)
@@ -45,6 +68,9 @@ func buildImageQuery(r *http.Request) (*bson.D, int64, error) {
 		limit = int64(len(ids))
 		subFilters = append(subFilters, &bson.D{{"_id", bson.D{{"$in", ids}}}})
 	} else {
+		// Shared by the album lookup and the image filter, so that the user's groups are looked up once.
+		viewer := common.GetViewer(loggedInUser)
+
 		if beforeQuery, beforeOK := r.URL.Query()["before"]; beforeOK && len(beforeQuery) > 0 && len(beforeQuery[0]) > 0 {
 			if conv, convErr := strconv.ParseInt(beforeQuery[0], 10, 64); convErr == nil {
 				before = time.Unix(conv, 0)
@@ -63,6 +89,67 @@ func buildImageQuery(r *http.Request) (*bson.D, int64, error) {
 		if userQuery, userOK := r.URL.Query()["user"]; userOK && len(userQuery) > 0 && len(userQuery[0]) > 0 {
 			user = strings.Split(userQuery[0], ",")
 		}
+		if orientationQuery, orientationOK := r.URL.Query()["orientation"]; orientationOK && len(orientationQuery) > 0 && len(orientationQuery[0]) > 0 {
+			if !orientationSet[orientationQuery[0]] {
+				return nil, errors.New("invalid orientation passed in: " + orientationQuery[0])
+			}
+
+			subFilters = append(subFilters, bson.D{{"info.orientation", orientationQuery[0]}})
+		}
+		if albumQuery, albumOK := r.URL.Query()["album"]; albumOK && len(albumQuery) > 0 && len(albumQuery[0]) > 0 {
+			albumHex, hexErr := primitive.ObjectIDFromHex(albumQuery[0])
+
+			if hexErr != nil {
+				return nil, errors.New("invalid album ID passed in: " + albumQuery[0])
+			}
+
+			albumChannel := make(chan albums.FindAlbumResponse)
+
+			go albums.GetVisibleAlbum(viewer, albumHex, albumChannel)
+
+			albumResponse := <-albumChannel
+
+			if albumResponse.Err != nil {
+				log.Println(albumResponse.Err)
+				return nil, errAlbumLookupFailed
+			}
+
+			if albumResponse.Album == nil {
+				return nil, errAlbumNotFound
+			}
+
+			album = albumResponse.Album
+			albumImageIDs := []primitive.ObjectID{}
+
+			for _, k := range album.ImageIDs {
+				if hex, err := primitive.ObjectIDFromHex(k); err == nil {
+					albumImageIDs = append(albumImageIDs, hex)
+				}
+			}
+
+			subFilters = append(subFilters, bson.D{{"_id", bson.D{{"$in", albumImageIDs}}}})
+
+			if offsetQuery, offsetOK := r.URL.Query()["offset"]; offsetOK && len(offsetQuery) > 0 && len(offsetQuery[0]) > 0 {
+				if conv, convErr := strconv.ParseInt(offsetQuery[0], 10, 64); convErr == nil && conv > 0 {
+					offset = conv
+				}
+			}
+		}
+		if tagFilter, tagErr := buildTagFilter(r); tagErr != nil {
+			return nil, tagErr
+		} else if tagFilter != nil {
+			subFilters = append(subFilters, tagFilter)
+		}
+		if takenBeforeQuery, takenBeforeOK := r.URL.Query()["takenBefore"]; takenBeforeOK && len(takenBeforeQuery) > 0 && len(takenBeforeQuery[0]) > 0 {
+			if conv, convErr := strconv.ParseInt(takenBeforeQuery[0], 10, 64); convErr == nil {
+				subFilters = append(subFilters, bson.D{{"info.takenAt", bson.D{{"$lt", primitive.NewDateTimeFromTime(time.Unix(conv, 0))}}}})
+			}
+		}
+		if takenAfterQuery, takenAfterOK := r.URL.Query()["takenAfter"]; takenAfterOK && len(takenAfterQuery) > 0 && len(takenAfterQuery[0]) > 0 {
+			if conv, convErr := strconv.ParseInt(takenAfterQuery[0], 10, 64); convErr == nil {
+				subFilters = append(subFilters, bson.D{{"info.takenAt", bson.D{{"$gt", primitive.NewDateTimeFromTime(time.Unix(conv, 0))}}}})
+			}
+		}
 
 		if !before.IsZero() {
 			subFilters = append(subFilters, bson.D{{"uploadDateTime", bson.D{{"$lt", primitive.NewDateTimeFromTime(before)}}}})
@@ -72,7 +159,7 @@ func buildImageQuery(r *http.Request) (*bson.D, int64, error) {
 			subFilters = append(subFilters, bson.D{{"uploadDateTime", bson.D{{"$gt", primitive.NewDateTimeFromTime(after)}}}})
 		}
 
-		visibilityFilters := buildVisibilityFilters(loggedInUser)
+		visibilityFilters := common.BuildVisibilityFilters(viewer)
 
 		if len(user) > 0 {
 			subFilters = append(subFilters, bson.D{{"$and", []interface{}{
@@ -84,6 +171,42 @@ func buildImageQuery(r *http.Request) (*bson.D, int64, error) {
 		}
 	}
 
-	return &bson.D{{"$and", subFilters}}, limit, nil
+	return &imageQuery{
+		filter: bson.D{{"$and", subFilters}},
+		limit:  limit,
+		album:  album,
+		offset: offset,
+	}, nil
+}
+
+/**
+Puts the images of an album query in album order, then applies the query's offset and limit.
+*/
+func orderByAlbum(images []*model.Image, query *imageQuery) []*model.Image {
+	byID := make(map[string]*model.Image, len(images))
+
+	for _, k := range images {
+		byID[k.ID] = k
+	}
+
+	ordered := []*model.Image{}
+
+	for _, k := range query.album.ImageIDs {
+		if image, ok := byID[k]; ok {
+			ordered = append(ordered, image)
+		}
+	}
+
+	if query.offset >= int64(len(ordered)) {
+		return []*model.Image{}
+	}
+
+	ordered = ordered[query.offset:]
+
+	if query.limit > 0 && query.limit < int64(len(ordered)) {
+		ordered = ordered[:query.limit]
+	}
+
+	return ordered
 }
 
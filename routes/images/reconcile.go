@@ -0,0 +1,347 @@
+package images
+
+import (
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultReconcileInterval = 30 * time.Minute
+
+// Pending images older than this are assumed to belong to a request that died.
+const pendingImageTimeout = 15 * time.Minute
+
+// Objects younger than this are never treated as orphans, since their records may still be being written.
+const orphanObjectGracePeriod = time.Hour
+
+var contentHashPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+var objectIDPattern = regexp.MustCompile("^[0-9a-f]{24}$")
+
+/**
+Starts the background reconciler, which repairs the inconsistencies between image documents and blob storage that
+are left behind when a request fails part way through:
+	- pending images whose request died are removed, along with their blob references;
+	- images stuck in the deleting state have their deletion finished;
+	- blobs whose deletion was started but never finished have their objects and record deleted;
+	- blob references to images that no longer exist are removed, and committed images missing from their blob's
+	  references are added back;
+	- stored objects that no blob record or image refers to, and staged uploads whose image is no longer waiting for
+	  them, are deleted.
+
+Runs once at startup and then every RECONCILE_INTERVAL_MINUTES minutes (default 30).
+*/
+func StartReconciler() {
+	interval := defaultReconcileInterval
+
+	if minutesString, exists := os.LookupEnv("RECONCILE_INTERVAL_MINUTES"); exists {
+		if minutes, err := strconv.Atoi(minutesString); err == nil && minutes > 0 {
+			interval = time.Duration(minutes) * time.Minute
+		} else {
+			log.Println("invalid RECONCILE_INTERVAL_MINUTES; using default")
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			reconcile()
+			<-ticker.C
+		}
+	}()
+}
+
+func reconcile() {
+	reconcileAbandonedImages()
+	reconcileDeletingImages()
+	reconcileDeletingBlobs()
+	reconcileBlobReferences()
+	reconcileOrphanObjects()
+}
+
+// Decodes raw image documents.
+func decodeImages(results []bson.M) []*model.Image {
+	images := make([]*model.Image, 0, len(results))
+
+	for _, k := range results {
+		image := model.Image{}
+
+		bsonBytes, _ := bson.Marshal(k)
+
+		_ = bson.Unmarshal(bsonBytes, &image)
+
+		images = append(images, &image)
+	}
+
+	return images
+}
+
+func reconcileAbandonedImages() {
+	cutoff := primitive.NewDateTimeFromTime(time.Now().Add(-pendingImageTimeout))
+
+	// Images waiting for a direct or resumable upload are given until their upload expires.
+	filter := bson.D{{"$and", []bson.D{
+		{{"status", model.ImageStatusPending}},
+		{{"$or", []bson.D{
+			{{"upload", bson.D{{"$exists", false}}}, {"uploadDateTime", bson.D{{"$lt", cutoff}}}},
+			{{"upload.expiresAt", bson.D{{"$lt", cutoff}}}},
+		}}},
+	}}}
+
+	res := database.Find("images", filter, options.Find().SetProjection(bson.D{{"blobKey", 1}}))
+
+	if res.Err != nil {
+		log.Println("reconciler: " + res.Err.Error())
+		return
+	}
+
+	for _, k := range decodeImages(res.Result) {
+		hex, _ := primitive.ObjectIDFromHex(k.ID)
+
+		log.Println("reconciler: removing abandoned image " + k.ID)
+		abandonImage(hex, k.BlobKey)
+	}
+}
+
+func reconcileDeletingImages() {
+	filter := bson.D{{"status", model.ImageStatusDeleting}}
+
+	res := database.Find("images", filter, options.Find().SetProjection(bson.D{{"blobKey", 1}, {"authorid", 1}}))
+
+	if res.Err != nil {
+		log.Println("reconciler: " + res.Err.Error())
+		return
+	}
+
+	for _, k := range decodeImages(res.Result) {
+		log.Println("reconciler: finishing deletion of image " + k.ID)
+
+		if err := finishDeletingImage(k); err != nil {
+			log.Println("reconciler: " + err.Error())
+		}
+	}
+}
+
+// Finishes the deletion of blobs that have been marked as deleting for longer than staleBlobDeletion.
+func reconcileDeletingBlobs() {
+	filter := bson.D{{"deleting", true}, {"deletingAt", bson.D{{"$lt", time.Now().Add(-staleBlobDeletion)}}}}
+	res := database.Find(blobsCollection, filter, options.Find().SetProjection(bson.D{{"_id", 1}}))
+
+	if res.Err != nil {
+		log.Println("reconciler: " + res.Err.Error())
+		return
+	}
+
+	for _, k := range res.Result {
+		hash, _ := k["_id"].(string)
+
+		log.Println("reconciler: finishing deletion of blob " + hash)
+
+		if err := finishBlobDeletion(hash); err != nil {
+			log.Println("reconciler: " + err.Error())
+		}
+	}
+}
+
+// Loads the references of every blob record, keyed by hash.
+func getBlobReferences() (map[string]map[string]bool, error) {
+	records, err := getBlobRecords()
+
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := make(map[string]map[string]bool)
+
+	for _, k := range records {
+		blobs[k.ID] = make(map[string]bool)
+
+		for _, ref := range k.Refs {
+			blobs[k.ID][ref] = true
+		}
+	}
+
+	return blobs, nil
+}
+
+func reconcileBlobReferences() {
+	blobs, err := getBlobReferences()
+
+	if err != nil {
+		log.Println("reconciler: " + err.Error())
+		return
+	}
+
+	res := database.Find("images", bson.D{}, options.Find().SetProjection(bson.D{{"blobKey", 1}, {"status", 1}}))
+
+	if res.Err != nil {
+		log.Println("reconciler: " + res.Err.Error())
+		return
+	}
+
+	images := decodeImages(res.Result)
+	existing := make(map[string]bool)
+
+	for _, k := range images {
+		existing[k.ID] = true
+
+		// Broken images are left to the audit command.
+		if k.BlobKey == "" || k.Status == model.ImageStatusPending || k.Status == model.ImageStatusDeleting || k.Status == model.ImageStatusBroken {
+			continue
+		}
+
+		// A committed image must be referenced by its blob.
+		if !blobs[k.BlobKey][k.ID] {
+			info, statErr := storage.Stat(k.BlobKey)
+
+			if statErr != nil {
+				log.Println("reconciler: image " + k.ID + " has no stored file; run the audit command to repair it")
+				continue
+			}
+
+			log.Println("reconciler: restoring blob reference of image " + k.ID)
+
+			if err := acquireBlob(k.BlobKey, k.ID, info.Size, info.ContentType); err != nil {
+				log.Println("reconciler: " + err.Error())
+			}
+		}
+	}
+
+	for hash, refs := range blobs {
+		missing := []string{}
+
+		for ref := range refs {
+			if !existing[ref] {
+				missing = append(missing, ref)
+			}
+		}
+
+		if len(missing) == 0 && len(refs) > 0 {
+			continue
+		}
+
+		log.Println("reconciler: removing dangling references to blob " + hash)
+
+		update := bson.D{{"$pullAll", bson.D{{"refs", missing}}}}
+
+		if res := database.UpdateOne(blobsCollection, bson.D{{"_id", hash}}, update, nil); res.Err != nil {
+			log.Println("reconciler: " + res.Err.Error())
+			continue
+		}
+
+		if err := deleteBlobIfUnreferenced(hash); err != nil {
+			log.Println("reconciler: " + err.Error())
+		}
+	}
+}
+
+/**
+Returns the image key that a stored object belongs to: the content hash or legacy image ID of an original, variant
+or derived image. Returns false for keys that do not belong to an image.
+*/
+func ownerOfObject(key string) (string, bool) {
+	owner := key
+
+	if strings.HasPrefix(key, derivedKeyPrefix) {
+		owner = strings.SplitN(strings.TrimPrefix(key, derivedKeyPrefix), "/", 2)[0]
+	} else if i := strings.Index(key, "-"); i >= 0 {
+		owner = key[:i]
+	}
+
+	if contentHashPattern.MatchString(owner) || objectIDPattern.MatchString(owner) {
+		return owner, true
+	}
+
+	return "", false
+}
+
+func reconcileOrphanObjects() {
+	blobs, err := getBlobReferences()
+
+	if err != nil {
+		log.Println("reconciler: " + err.Error())
+		return
+	}
+
+	// Images uploaded before content addressing are stored under their ID.
+	res := database.Find("images", bson.D{{"blobKey", bson.D{{"$exists", false}}}}, options.Find().SetProjection(bson.D{{"_id", 1}}))
+
+	if res.Err != nil {
+		log.Println("reconciler: " + res.Err.Error())
+		return
+	}
+
+	legacyImages := make(map[string]bool)
+
+	for _, k := range decodeImages(res.Result) {
+		legacyImages[k.ID] = true
+	}
+
+	pendingRes := database.Find("images", bson.D{{"upload", bson.D{{"$exists", true}}}}, options.Find().SetProjection(bson.D{{"_id", 1}}))
+
+	if pendingRes.Err != nil {
+		log.Println("reconciler: " + pendingRes.Err.Error())
+		return
+	}
+
+	pendingUploads := make(map[string]bool)
+
+	for _, k := range decodeImages(pendingRes.Result) {
+		pendingUploads[k.ID] = true
+	}
+
+	objects, err := storage.List("")
+
+	if err != nil {
+		log.Println("reconciler: " + err.Error())
+		return
+	}
+
+	cutoff := time.Now().Add(-orphanObjectGracePeriod)
+
+	for _, k := range objects {
+		if k.LastModified.After(cutoff) {
+			continue
+		}
+
+		// Staged uploads are kept for as long as their image is waiting for them.
+		if strings.HasPrefix(k.Key, uploadKeyPrefix) {
+			if pendingUploads[uploadIDFromKey(k.Key)] {
+				continue
+			}
+
+			log.Println("reconciler: deleting abandoned upload " + k.Key)
+
+			if err := storage.Delete(k.Key); err != nil {
+				log.Println("reconciler: " + err.Error())
+			}
+			continue
+		}
+
+		owner, ok := ownerOfObject(k.Key)
+
+		if !ok {
+			continue
+		}
+
+		if _, referenced := blobs[owner]; referenced || legacyImages[owner] {
+			continue
+		}
+
+		log.Println("reconciler: deleting orphaned object " + k.Key)
+
+		if err := storage.Delete(k.Key); err != nil {
+			log.Println("reconciler: " + err.Error())
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package images
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/middleware"
+	"github.com/kilowatt-/ImageRepository/storage"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How long a resumable upload is kept after its last chunk was received.
+const resumableUploadLifetime = 24 * time.Hour
+
+var errChunksMissing = errors.New("stored chunks do not add up to the length of the upload")
+
+type resumableUploadResponse struct {
+	ID        string    `json:"_id"`
+	Offset    int64     `json:"offset"`
+	Length    int64     `json:"length"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func writeResumableUploadResponse(w http.ResponseWriter, image *model.Image) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(image.Upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(image.Upload.Length, 10))
+	w.WriteHeader(http.StatusOK)
+	jsonResponse, _ := json.Marshal(resumableUploadResponse{
+		ID:        image.ID,
+		Offset:    image.Upload.Offset,
+		Length:    image.Upload.Length,
+		ExpiresAt: image.Upload.ExpiresAt,
+	})
+	_, _ = w.Write(jsonResponse)
+}
+
+/**
+Returns a new staging key for a chunk of a resumable upload that starts at the given offset.
+
+Every request stores its chunk under its own key, so a request that loses a race cannot overwrite an accepted chunk.
+*/
+func chunkKey(imageID string, offset int64) string {
+	return fmt.Sprintf("%s/%012d-%s", uploadKey(imageID), offset, primitive.NewObjectID().Hex())
+}
+
+/**
+Reads the accepted chunks of a resumable upload and joins them into the complete file.
+*/
+func assembleChunks(upload *model.PendingUpload) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, upload.Length))
+
+	for _, k := range upload.Chunks {
+		object, getErr := storage.Get(k)
+
+		if getErr != nil {
+			return nil, getErr
+		}
+
+		_, copyErr := io.Copy(buf, object.Body)
+		object.Body.Close()
+
+		if copyErr != nil {
+			return nil, copyErr
+		}
+	}
+
+	if int64(buf.Len()) != upload.Length {
+		return nil, errChunksMissing
+	}
+
+	return buf.Bytes(), nil
+}
+
+/**
+	[POST] application/x-www-form-urlencoded
+
+	Starts a resumable upload, for clients on unreliable connections. Creates a pending image whose file is then sent
+	in chunks with /uploadChunk; if the connection drops, the client asks /getUploadStatus how much was received and
+	continues from there. Once every byte has been received, the image is published with /finalizeUpload.
+
+	An upload expires 24 hours after its last chunk was received.
+
+	Accepts the same form fields as /addImage, except file, plus:
+		- contentType: the MIME type of the file that will be uploaded.
+		- length: the size of the file in bytes. At most 10MB.
+
+	Returns: (application/json)
+		- 200: The image ID, the offset (0) and length of the upload, and when it expires.
+		- 400: contentType is missing or not an accepted image type, length is missing or invalid, or the tags are invalid
+		  or too many.
+		- 413: length is larger than 10MB.
+		- 500: Internal server error.
+*/
+func startResumableUpload(w http.ResponseWriter, r *http.Request) {
+	contentType := r.FormValue("contentType")
+
+	if !validateAcceptableMIMEType(contentType) {
+		http.Error(w, uploadNonImageFileTypeErr, http.StatusBadRequest)
+		return
+	}
+
+	length, convErr := strconv.ParseInt(r.FormValue("length"), 10, 64)
+
+	if convErr != nil || length <= 0 {
+		http.Error(w, "length must be a positive integer", http.StatusBadRequest)
+		return
+	}
+
+	if length > maxUploadSize {
+		http.Error(w, "file is larger than "+strconv.Itoa(maxUploadSize)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	image, formErr := imageFromForm(r, middleware.GetUserIDFromToken(r))
+
+	if formErr != nil {
+		http.Error(w, formErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+
+	image.Status = model.ImageStatusPending
+	image.Upload = &model.PendingUpload{
+		ContentType:  contentType,
+		KeepMetadata: keepMetadataFromForm(r),
+		Duplicates:   r.FormValue("duplicates"),
+		ExpiresAt:    time.Now().Add(resumableUploadLifetime),
+		Resumable:    true,
+		Length:       length,
+	}
+
+	insertChannel := make(chan *database.InsertResponse)
+
+	go insertImage(image, insertChannel)
+
+	insertResponse := <-insertChannel
+
+	if insertResponse.Err != nil {
+		log.Println(insertResponse.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	image.ID = insertResponse.ID
+
+	writeResumableUploadResponse(w, &image)
+}
+
+// Gets the user's unfinalized resumable upload named by the id query parameter, responding with an error if there is none.
+func getResumableUploadFromQuery(w http.ResponseWriter, r *http.Request) (*model.Image, bool) {
+	hex, err := getHexIDFromString(r.URL.Query().Get("id"))
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	channel := make(chan imageDatabaseResponse)
+
+	go getPendingUpload(middleware.GetUserIDFromToken(r), *hex, channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		common.SendInternalServerError(w)
+		return nil, false
+	}
+
+	if len(res.images) == 0 || !res.images[0].Upload.Resumable {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return res.images[0], true
+}
+
+/**
+	[GET]
+
+	Gets the progress of a resumable upload, so that an interrupted client knows where to resume from.
+
+	Accepted query parameters:
+		- id: the image ID returned by /startResumableUpload.
+
+	Returns: (application/json)
+		- 200: The number of bytes received so far (offset), the length of the upload, and when it expires. The offset
+		  and length are also sent in the Upload-Offset and Upload-Length headers.
+		- 400: Invalid ID.
+		- 404: No unfinalized resumable upload with this ID belongs to the user.
+		- 500: Internal server error.
+*/
+func getUploadStatus(w http.ResponseWriter, r *http.Request) {
+	image, ok := getResumableUploadFromQuery(w, r)
+
+	if !ok {
+		return
+	}
+
+	writeResumableUploadResponse(w, image)
+}
+
+/**
+	[PATCH] application/offset+octet-stream
+
+	Appends a chunk to a resumable upload. The chunk must start exactly where the data received so far ends; if a
+	previous request failed part way through, nothing it sent is kept, and the client should resend from the offset
+	reported by /getUploadStatus.
+
+	Accepted query parameters:
+		- id: the image ID returned by /startResumableUpload.
+		- offset: the offset of the first byte of the chunk. Can also be sent in the Upload-Offset header.
+
+	Returns: (application/json)
+		- 200: The new offset, the length of the upload, and when it now expires.
+		- 400: Invalid ID or offset, or the chunk is empty.
+		- 404: No unfinalized resumable upload with this ID belongs to the user.
+		- 409: The offset does not match the data received so far, or another chunk was appended at the same time.
+		- 413: The chunk extends past the length of the upload.
+		- 500: Internal server error.
+*/
+func uploadChunk(w http.ResponseWriter, r *http.Request) {
+	image, ok := getResumableUploadFromQuery(w, r)
+
+	if !ok {
+		return
+	}
+
+	offsetString := r.URL.Query().Get("offset")
+
+	if offsetString == "" {
+		offsetString = r.Header.Get("Upload-Offset")
+	}
+
+	offset, convErr := strconv.ParseInt(offsetString, 10, 64)
+
+	if convErr != nil || offset < 0 {
+		http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	if offset != image.Upload.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(image.Upload.Offset, 10))
+		http.Error(w, "offset does not match the data received so far", http.StatusConflict)
+		return
+	}
+
+	remaining := image.Upload.Length - offset
+
+	// Read one byte more than allowed, so that oversized chunks can be detected.
+	chunk, readErr := ioutil.ReadAll(io.LimitReader(r.Body, remaining+1))
+
+	if readErr != nil {
+		http.Error(w, "could not read chunk: "+readErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if int64(len(chunk)) > remaining {
+		http.Error(w, "chunk extends past the length of the upload", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if len(chunk) == 0 {
+		http.Error(w, "empty chunk", http.StatusBadRequest)
+		return
+	}
+
+	key := chunkKey(image.ID, offset)
+
+	if err := storage.Put(key, bytes.NewReader(chunk), "application/octet-stream"); err != nil {
+		log.Println(err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	hex, _ := getHexIDFromString(image.ID)
+	newOffset := offset + int64(len(chunk))
+	expiresAt := time.Now().Add(resumableUploadLifetime)
+
+	channel := make(chan *database.UpdateResponse)
+
+	go appendUploadChunk(*hex, offset, newOffset, key, expiresAt, channel)
+
+	res := <-channel
+
+	if res.Err != nil || res.Matched == 0 {
+		if deleteErr := storage.Delete(key); deleteErr != nil {
+			log.Println(deleteErr)
+		}
+	}
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	// Another request appended a chunk at this offset first.
+	if res.Matched == 0 {
+		http.Error(w, "offset does not match the data received so far", http.StatusConflict)
+		return
+	}
+
+	image.Upload.Offset = newOffset
+	image.Upload.ExpiresAt = expiresAt
+
+	writeResumableUploadResponse(w, image)
+}
@@ -0,0 +1,272 @@
+package images
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/middleware"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Largest number of tags an image can have, counting the hashtags in its caption.
+const maxTagsPerImage = 30
+
+// Longest tag, in characters.
+const maxTagLength = 50
+
+const defaultTrendingWindowHours = 24
+const maxTrendingWindowHours = 24 * 30
+const defaultTrendingLimit = 10
+const maxTrendingLimit = 100
+
+// Matches a hashtag in a caption. The # must start a word, so that e.g. URL fragments and "a#b" are not hashtags.
+var hashtagPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_&#/])#([\p{L}\p{N}_]+)`)
+
+type trendingTag struct {
+	Tag   string `json:"tag" bson:"_id"`
+	Count int64  `json:"count" bson:"count"`
+}
+
+/**
+Normalizes a tag: removes a leading #, and lowercases it.
+
+Returns false if the tag is empty, too long, contains anything but letters, digits and underscores, or is only digits.
+*/
+func normalizeTag(tag string) (string, bool) {
+	tag = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+
+	if tag == "" || utf8.RuneCountInString(tag) > maxTagLength {
+		return "", false
+	}
+
+	onlyDigits := true
+
+	for _, k := range tag {
+		if !unicode.IsLetter(k) && !unicode.IsDigit(k) && k != '_' {
+			return "", false
+		}
+
+		onlyDigits = onlyDigits && unicode.IsDigit(k)
+	}
+
+	return tag, !onlyDigits
+}
+
+// Normalizes a list of tags, dropping invalid ones and duplicates.
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool)
+	normalized := []string{}
+
+	for _, k := range tags {
+		if tag, ok := normalizeTag(k); ok && !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+
+	return normalized
+}
+
+// Extracts the hashtags from a caption, normalized, in the order they appear.
+func extractHashtags(caption string) []string {
+	hashtags := []string{}
+
+	for _, k := range hashtagPattern.FindAllStringSubmatch(caption, -1) {
+		hashtags = append(hashtags, k[1])
+	}
+
+	return normalizeTags(hashtags)
+}
+
+/**
+Normalizes the tags that a user passed in, dropping duplicates.
+
+Returns an error naming the first invalid tag, if any.
+*/
+func normalizeExplicitTags(tags []string) ([]string, error) {
+	for _, k := range tags {
+		if _, ok := normalizeTag(k); !ok {
+			return nil, errors.New("invalid tag passed in: " + k)
+		}
+	}
+
+	return normalizeTags(tags), nil
+}
+
+/**
+Sets an image's explicit tags, and rebuilds its tags from them and the hashtags in its caption. Must be called again
+whenever the caption changes.
+
+Returns an error, leaving the image's tags unchanged, if an explicit tag is invalid or the image would have more than
+maxTagsPerImage tags.
+*/
+func setImageTags(image *model.Image, explicitTags []string) error {
+	explicit, err := normalizeExplicitTags(explicitTags)
+
+	if err != nil {
+		return err
+	}
+
+	tags := normalizeTags(append(extractHashtags(image.Caption), explicit...))
+
+	if len(tags) > maxTagsPerImage {
+		return errors.New("an image can have at most " + strconv.Itoa(maxTagsPerImage) + " tags, including the hashtags in its caption")
+	}
+
+	image.ExplicitTags = explicit
+	image.Tags = tags
+
+	return nil
+}
+
+// Reads the tags form field: a JSON array of tags.
+func tagsFromForm(r *http.Request) ([]string, error) {
+	var tags []string
+
+	if tagsString := r.FormValue("tags"); tagsString != "" {
+		if err := json.Unmarshal([]byte(tagsString), &tags); err != nil {
+			return nil, errors.New("tags must be a JSON array of strings")
+		}
+	}
+
+	return tags, nil
+}
+
+/**
+Builds the filter for the tag and tagMode query parameters: images with any of the tags, or all of them if tagMode is
+"all".
+
+Returns nil if no tags were passed in.
+*/
+func buildTagFilter(r *http.Request) (bson.D, error) {
+	tagQuery := r.URL.Query().Get("tag")
+
+	if tagQuery == "" {
+		return nil, nil
+	}
+
+	tags := []string{}
+
+	for _, k := range strings.Split(tagQuery, ",") {
+		tag, ok := normalizeTag(k)
+
+		if !ok {
+			return nil, errors.New("invalid tag passed in: " + k)
+		}
+
+		tags = append(tags, tag)
+	}
+
+	switch r.URL.Query().Get("tagMode") {
+	case "", "any":
+		return bson.D{{"tags", bson.D{{"$in", tags}}}}, nil
+	case "all":
+		return bson.D{{"tags", bson.D{{"$all", tags}}}}, nil
+	default:
+		return nil, errors.New("invalid tagMode passed in: " + r.URL.Query().Get("tagMode"))
+	}
+}
+
+/**
+	[GET]
+
+	Gets the most used tags on images uploaded in a recent time window, most used first. Only images visible to the
+	user are counted.
+
+	Accepted query parameters:
+		- hours: integer. The length of the time window, ending now. Default 24, max 720 (30 days).
+		- limit: integer. The number of tags to return. Default 10, max 100.
+
+	Returns: (application/json)
+		- 200: List of tags, each with the number of images that have it.
+		- 400: hours or limit is not a positive integer.
+		- 500: Internal server error.
+*/
+func getTrendingTags(w http.ResponseWriter, r *http.Request) {
+	hours := defaultTrendingWindowHours
+	limit := defaultTrendingLimit
+
+	if hoursQuery := r.URL.Query().Get("hours"); hoursQuery != "" {
+		conv, convErr := strconv.Atoi(hoursQuery)
+
+		if convErr != nil || conv <= 0 {
+			http.Error(w, "hours must be a positive integer", http.StatusBadRequest)
+			return
+		}
+
+		hours = conv
+	}
+
+	if limitQuery := r.URL.Query().Get("limit"); limitQuery != "" {
+		conv, convErr := strconv.Atoi(limitQuery)
+
+		if convErr != nil || conv <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+
+		limit = conv
+	}
+
+	if hours > maxTrendingWindowHours {
+		hours = maxTrendingWindowHours
+	}
+
+	if limit > maxTrendingLimit {
+		limit = maxTrendingLimit
+	}
+
+	since := time.Now().Add(-time.Duration(hours) * time.Hour)
+	visibilityFilters := common.BuildVisibilityFilters(common.GetViewer(middleware.GetUserIDFromTokenNotStrictValidation(r)))
+
+	filter := withCommitted(bson.D{{"$and", []bson.D{
+		{{"uploadDateTime", bson.D{{"$gte", primitive.NewDateTimeFromTime(since)}}}},
+		{{"tags.0", bson.D{{"$exists", true}}}},
+		{{"$or", visibilityFilters}},
+	}}})
+
+	pipeline := []bson.D{
+		{{"$match", filter}},
+		{{"$unwind", "$tags"}},
+		{{"$group", bson.D{{"_id", "$tags"}, {"count", bson.D{{"$sum", 1}}}}}},
+		{{"$sort", bson.D{{"count", -1}, {"_id", 1}}}},
+		{{"$limit", limit}},
+	}
+
+	res := database.Aggregate("images", pipeline, nil)
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	tags := []trendingTag{}
+
+	for _, k := range res.Result {
+		tag := trendingTag{}
+
+		bsonBytes, _ := bson.Marshal(k)
+
+		_ = bson.Unmarshal(bsonBytes, &tag)
+
+		tags = append(tags, tag)
+	}
+
+	jsonResponse, _ := json.Marshal(tags)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonResponse)
+}
@@ -0,0 +1,310 @@
+package images
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/kilowatt-/ImageRepository/imaging"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/storage"
+	"image"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Largest width or height a transformed image may be rendered at.
+const maxTransformDimension = imaging.MaxFitDimension
+
+const derivedKeyPrefix = "derived/"
+
+/**
+Most transformed copies cached for one stored file. Transforms past the limit are rendered for every request instead,
+so that iterating over every possible parameter cannot fill the bucket.
+*/
+const maxDerivedPerImage = 32
+
+type transformOptions struct {
+	width  int
+	height int
+	cover  bool
+	crop   *image.Rectangle
+	rotate int
+	format string
+}
+
+// A stable string form of the options. Equal options always produce the same string.
+func (t *transformOptions) canonical() string {
+	crop := "none"
+
+	if t.crop != nil {
+		crop = fmt.Sprintf("%d,%d,%d,%d", t.crop.Min.X, t.crop.Min.Y, t.crop.Dx(), t.crop.Dy())
+	}
+
+	return fmt.Sprintf("w=%d;h=%d;cover=%t;crop=%s;rotate=%d;format=%s", t.width, t.height, t.cover, crop, t.rotate, t.format)
+}
+
+// Returns the prefix under which all derived images of an image are cached.
+func derivedPrefix(imageKey string) string {
+	return derivedKeyPrefix + imageKey + "/"
+}
+
+// Returns the cache key of the image rendered with the given options.
+func derivedKey(imageKey string, opts *transformOptions) string {
+	sum := sha256.Sum256([]byte(opts.canonical()))
+
+	return derivedPrefix(imageKey) + hex.EncodeToString(sum[:])
+}
+
+func parseDimension(r *http.Request, name string) (int, error) {
+	if query, ok := r.URL.Query()[name]; ok && len(query) > 0 && len(query[0]) > 0 {
+		conv, err := strconv.Atoi(query[0])
+
+		if err != nil || conv <= 0 || conv > maxTransformDimension {
+			return 0, errors.New("invalid " + name + " parameter")
+		}
+
+		return conv, nil
+	}
+
+	return 0, nil
+}
+
+/**
+Parses the transform parameters of a transformImage request.
+*/
+func parseTransformOptions(r *http.Request) (*transformOptions, error) {
+	opts := &transformOptions{}
+
+	var err error
+
+	if opts.width, err = parseDimension(r, "width"); err != nil {
+		return nil, err
+	}
+
+	if opts.height, err = parseDimension(r, "height"); err != nil {
+		return nil, err
+	}
+
+	if fitQuery, ok := r.URL.Query()["fit"]; ok && len(fitQuery) > 0 && len(fitQuery[0]) > 0 {
+		switch fitQuery[0] {
+		case "cover":
+			opts.cover = true
+		case "contain":
+			opts.cover = false
+		default:
+			return nil, errors.New("fit must be cover or contain")
+		}
+	}
+
+	if cropQuery, ok := r.URL.Query()["crop"]; ok && len(cropQuery) > 0 && len(cropQuery[0]) > 0 {
+		parts := strings.Split(cropQuery[0], ",")
+
+		if len(parts) != 4 {
+			return nil, errors.New("crop must be x,y,width,height")
+		}
+
+		values := make([]int, 4)
+
+		for i, k := range parts {
+			conv, convErr := strconv.Atoi(strings.TrimSpace(k))
+
+			if convErr != nil || conv < 0 {
+				return nil, errors.New("crop must be x,y,width,height")
+			}
+
+			values[i] = conv
+		}
+
+		if values[2] == 0 || values[3] == 0 {
+			return nil, errors.New("crop width and height must be positive")
+		}
+
+		rect := image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3])
+		opts.crop = &rect
+	}
+
+	if rotateQuery, ok := r.URL.Query()["rotate"]; ok && len(rotateQuery) > 0 && len(rotateQuery[0]) > 0 {
+		conv, convErr := strconv.Atoi(rotateQuery[0])
+
+		if convErr != nil || (conv != 0 && conv != 90 && conv != 180 && conv != 270) {
+			return nil, errors.New("rotate must be 0, 90, 180 or 270")
+		}
+
+		opts.rotate = conv
+	}
+
+	if formatQuery, ok := r.URL.Query()["format"]; ok && len(formatQuery) > 0 && len(formatQuery[0]) > 0 {
+		switch formatQuery[0] {
+		case "jpeg", "jpg":
+			opts.format = "jpeg"
+		case "png", "gif":
+			opts.format = formatQuery[0]
+		default:
+			return nil, errors.New("format must be jpeg, png or gif")
+		}
+	}
+
+	return opts, nil
+}
+
+/**
+Renders the original image bytes with the given options: crop first, then rotate, then resize.
+
+The image is turned the right way up according to its EXIF orientation first, so crop coordinates refer to the image
+as it is displayed.
+
+Returns the encoded image and its content type.
+*/
+func renderTransform(data []byte, opts *transformOptions) ([]byte, string, error) {
+	img, sourceFormat, err := decodeOriented(data)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if opts.crop != nil {
+		if img, err = imaging.Crop(img, *opts.crop); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if img, err = imaging.Rotate(img, opts.rotate); err != nil {
+		return nil, "", err
+	}
+
+	if img, err = imaging.Fit(img, opts.width, opts.height, opts.cover); err != nil {
+		return nil, "", err
+	}
+
+	format := opts.format
+
+	if format == "" {
+		format = imaging.OutputFormatFor(sourceFormat)
+	}
+
+	encoded, err := imaging.Encode(img, format)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return encoded, imaging.ContentTypeFor(format), nil
+}
+
+/**
+[GET]
+Gets a transformed copy of an image, if it is visible to the user. Rendered images are cached in blob storage, so
+repeated requests with the same parameters are served from the cache. At most maxDerivedPerImage transforms of each
+image are cached; any others are rendered for every request.
+
+Accepted query parameters:
+	- id: Image ID.
+	- width: integer. Optional. Target width in pixels (max 4096).
+	- height: integer. Optional. Target height in pixels (max 4096).
+	- fit: cover/contain. Optional. How the image fills the width x height box when both are given. Default contain.
+	- crop: x,y,width,height. Optional. Region of the original image to keep, in pixels, measured on the image as it is
+	  displayed (after its EXIF orientation is applied). Applied before resizing.
+	- rotate: 0/90/180/270. Optional. Clockwise rotation, applied after cropping.
+	- format: jpeg/png/gif. Optional. Output format. Defaults to jpeg for jpeg originals and png otherwise.
+
+Supports the same conditional requests, Range requests and caching headers as getImage.
+
+Returns: (image/*)
+	- 200 OK: With the transformed image.
+	- 206 Partial Content: With the requested byte ranges.
+	- 304 Not Modified: The client's cached copy is still valid.
+	- 400: If id is not present, an invalid ID is passed in, a parameter is invalid, the crop region is outside the image, the image has too many pixels to transform, or the resized image would be larger than 4096 pixels on a side (including a side derived from the aspect ratio).
+	- 404: If image is not found, or user is not authorised to view this image. (there is no difference).
+	- 500: Internal server error.
+*/
+func transformImage(w http.ResponseWriter, r *http.Request) {
+	opts, optsErr := parseTransformOptions(r)
+
+	if optsErr != nil {
+		http.Error(w, optsErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	img, ok := getVisibleImageFromQuery(w, r)
+
+	if !ok {
+		return
+	}
+
+	key := derivedKey(imageKey(img), opts)
+
+	if respondNotModified(w, r, img, key) {
+		return
+	}
+
+	if cached, err := getObjectForRequest(r, key); err == nil {
+		serveImageObject(w, r, img, key, cached)
+		return
+	} else if err != storage.ErrNotFound {
+		log.Println(err)
+	}
+
+	original, dlErr := storage.Get(imageKey(img))
+
+	if dlErr != nil {
+		if dlErr == storage.ErrNotFound {
+			http.Error(w, "Image not found", http.StatusNotFound)
+		} else {
+			log.Println(dlErr)
+			common.SendInternalServerError(w)
+		}
+		return
+	}
+
+	data, readErr := ioutil.ReadAll(original.Body)
+	original.Body.Close()
+
+	if readErr != nil {
+		log.Println(readErr)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	rendered, contentType, renderErr := renderTransform(data, opts)
+
+	if renderErr != nil {
+		if renderErr == imaging.ErrCropOutOfBounds || renderErr == imaging.ErrTooManyPixels || renderErr == imaging.ErrFitTooLarge {
+			http.Error(w, renderErr.Error(), http.StatusBadRequest)
+		} else {
+			log.Println(renderErr)
+			common.SendInternalServerError(w)
+		}
+		return
+	}
+
+	cacheDerived(imageKey(img), key, rendered, contentType)
+
+	serveImageBytes(w, r, img, key, rendered, contentType)
+}
+
+/**
+Caches a rendered transform, unless the file already has maxDerivedPerImage cached transforms. Concurrent requests can
+each see room for one more, so the limit can be overshot by a few.
+*/
+func cacheDerived(imageKey string, key string, rendered []byte, contentType string) {
+	cached, err := storage.List(derivedPrefix(imageKey))
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if len(cached) >= maxDerivedPerImage {
+		return
+	}
+
+	// A failed cache write only costs a re-render on the next request.
+	if err := storage.Put(key, bytes.NewReader(rendered), contentType); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,165 @@
+package images
+
+import (
+	"encoding/json"
+	"github.com/kilowatt-/ImageRepository/imaging"
+	"github.com/kilowatt-/ImageRepository/model"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const uploadNonImageFileTypeErr = "Uploaded non-image file type"
+
+// Largest image file that can be uploaded, in bytes.
+const maxUploadSize = 10 << 20
+
+// An upload that was refused, and the status code to respond with.
+type uploadError struct {
+	status  int
+	message string
+}
+
+func (e *uploadError) Error() string {
+	return e.message
+}
+
+// An uploaded file after validation and processing, ready to be stored.
+type preparedImage struct {
+	data           []byte
+	contentType    string
+	variants       []encodedVariant
+	nearDuplicates []string
+}
+
+/**
+Builds a new image from the caption, accessLevel, accessListIDs and tags form fields.
+
+Returns an error if the tags are invalid or too many.
+*/
+func imageFromForm(r *http.Request, authorID string) (model.Image, error) {
+	var accessListIDs []string
+
+	jsonParseErr := json.Unmarshal([]byte(r.FormValue("accessListIDs")), &accessListIDs)
+
+	if jsonParseErr != nil {
+		log.Println("passed empty access List IDs")
+		accessListIDs = []string{}
+	}
+
+	tags, tagsErr := tagsFromForm(r)
+
+	if tagsErr != nil {
+		return model.Image{}, tagsErr
+	}
+
+	return newImage(authorID, r.FormValue("caption"), r.FormValue("accessLevel"), accessListIDs, tags)
+}
+
+/**
+Builds a new image, tagged with the given tags and the hashtags in its caption. Invalid access levels default to public.
+
+Returns an error if the tags are invalid or too many.
+*/
+func newImage(authorID string, caption string, accessLevel string, accessListIDs []string, tags []string) (model.Image, error) {
+	if accessLevel != "public" && accessLevel != "private" {
+		log.Println("invalid access level passed in; defaulting to public")
+		accessLevel = "public"
+	}
+
+	if accessListIDs == nil {
+		accessListIDs = []string{}
+	}
+
+	image := model.Image{
+		AuthorID:      authorID,
+		AccessLevel:   accessLevel,
+		Caption:       caption,
+		UploadDate:    time.Now(),
+		AccessListIDs: accessListIDs,
+		Variants:      []model.ImageVariant{},
+	}
+
+	if err := setImageTags(&image, tags); err != nil {
+		return model.Image{}, err
+	}
+
+	return image, nil
+}
+
+// Reads the keepMetadata form field.
+func keepMetadataFromForm(r *http.Request) bool {
+	return r.FormValue("keepMetadata") == "Y" || r.FormValue("keepMetadata") == "y"
+}
+
+/**
+Validates and processes an uploaded file for the given image: checks its sniffed MIME type, strips its metadata unless
+keepMetadata is set, and fills in the image's info, perceptual hash and variants.
+
+If duplicatePolicy is "reject" and the author already has a near-identical image, the upload is refused; if it is
+"warn", the near-identical images are listed in the result.
+
+Returns an *uploadError if the file is refused, or any other error if it could not be processed.
+*/
+func prepareImage(image *model.Image, original []byte, keepMetadata bool, duplicatePolicy string) (*preparedImage, error) {
+	sniffedContentType := http.DetectContentType(original)
+
+	if !validateAcceptableMIMEType(sniffedContentType) {
+		return nil, &uploadError{http.StatusBadRequest, uploadNonImageFileTypeErr}
+	}
+
+	data := original
+
+	if !keepMetadata {
+		stripped, stripErr := imaging.StripMetadata(original, sniffedContentType)
+
+		if stripErr != nil {
+			return nil, &uploadError{http.StatusBadRequest, "Could not remove image metadata: " + stripErr.Error()}
+		}
+
+		data = stripped
+	}
+
+	prepared := &preparedImage{
+		data:           data,
+		contentType:    sniffedContentType,
+		variants:       []encodedVariant{},
+		nearDuplicates: []string{},
+	}
+
+	image.Info = extractImageInfo(data)
+
+	if decoded, format, decodeErr := decodeOriented(data); decodeErr == nil {
+		hash := imaging.DifferenceHash(decoded)
+		image.PerceptualHash = formatHash(hash)
+
+		if duplicatePolicy == duplicatesReject || duplicatePolicy == duplicatesWarn {
+			matches, findErr := findNearDuplicates(image.AuthorID, hash, duplicateDistance)
+
+			if findErr != nil {
+				return nil, findErr
+			}
+
+			prepared.nearDuplicates = matches
+		}
+
+		if len(prepared.nearDuplicates) > 0 && duplicatePolicy == duplicatesReject {
+			return nil, &uploadError{http.StatusConflict, "near-identical image already uploaded: " + strings.Join(prepared.nearDuplicates, ",")}
+		}
+
+		prepared.variants = generateVariants(decoded, format)
+	} else if decodeErr == imaging.ErrTooManyPixels {
+		return nil, &uploadError{http.StatusBadRequest, decodeErr.Error()}
+	} else {
+		log.Println("could not decode image: " + decodeErr.Error())
+	}
+
+	image.Variants = []model.ImageVariant{}
+
+	for _, k := range prepared.variants {
+		image.Variants = append(image.Variants, k.variant)
+	}
+
+	return prepared, nil
+}
@@ -0,0 +1,127 @@
+package images
+
+import (
+	"github.com/kilowatt-/ImageRepository/imaging"
+	"github.com/kilowatt-/ImageRepository/model"
+	"image"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var defaultVariantSizes = []int{150, 640, 1280}
+
+// Long-edge sizes, in pixels, of the variants generated on upload. Sorted ascending.
+var variantSizes = defaultVariantSizes
+
+// A variant that has been rendered but not stored yet.
+type encodedVariant struct {
+	variant model.ImageVariant
+	data    []byte
+}
+
+/**
+Loads the variant sizes from IMAGE_VARIANT_SIZES, a comma-separated list of long-edge pixel sizes.
+
+Falls back to the defaults if the variable is missing or invalid.
+*/
+func loadVariantSizes() {
+	sizesString, exists := os.LookupEnv("IMAGE_VARIANT_SIZES")
+
+	if !exists {
+		return
+	}
+
+	sizes := []int{}
+
+	for _, k := range strings.Split(sizesString, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(k))
+
+		if err != nil || size <= 0 {
+			log.Println("invalid IMAGE_VARIANT_SIZES; using defaults")
+			return
+		}
+
+		sizes = append(sizes, size)
+	}
+
+	sort.Ints(sizes)
+	variantSizes = sizes
+}
+
+// Returns the storage key of the given variant of an image.
+func variantKey(imageKey string, size int) string {
+	return imageKey + "-" + strconv.Itoa(size)
+}
+
+/**
+Decodes an image and turns it the right way up according to its EXIF orientation.
+
+Returns the image and the format name reported by the decoder.
+*/
+func decodeOriented(data []byte) (image.Image, string, error) {
+	img, format, err := imaging.Decode(data)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return imaging.ApplyOrientation(img, imaging.ReadExif(data, http.DetectContentType(data)).Orientation), format, nil
+}
+
+/**
+Renders a variant for every configured size that is smaller than the decoded image. img should come from
+decodeOriented, since variants are stored without EXIF data and must already be the right way up.
+*/
+func generateVariants(img image.Image, format string) []encodedVariant {
+	variants := []encodedVariant{}
+	outputFormat := imaging.OutputFormatFor(format)
+
+	for _, size := range variantSizes {
+		if size >= imaging.LongEdge(img) {
+			break
+		}
+
+		resized := imaging.Resize(img, size)
+		encoded, encodeErr := imaging.Encode(resized, outputFormat)
+
+		if encodeErr != nil {
+			log.Println(encodeErr)
+			continue
+		}
+
+		variants = append(variants, encodedVariant{
+			variant: model.ImageVariant{
+				Size:        size,
+				Width:       resized.Bounds().Dx(),
+				Height:      resized.Bounds().Dy(),
+				ContentType: imaging.ContentTypeFor(outputFormat),
+			},
+			data: encoded,
+		})
+	}
+
+	return variants
+}
+
+/**
+Picks the smallest variant whose long edge is at least the requested size.
+
+Returns false if no variant is large enough, in which case the original should be served.
+*/
+func pickVariant(image *model.Image, size int) (model.ImageVariant, bool) {
+	best := model.ImageVariant{}
+	found := false
+
+	for _, k := range image.Variants {
+		if k.Size >= size && (!found || k.Size < best.Size) {
+			best = k
+			found = true
+		}
+	}
+
+	return best, found
+}
@@ -111,3 +111,37 @@ func CreateLoginToken(user model.User) (string, time.Time, error) {
 	return token, expiry, nil
 }
 
+
+/**
+Gets user ID from the token.
+
+This is required for endpoints which might require a user ID, but are not checked by the middleware because they
+are not strictly necessary. JWT Middleware is only run on functions where the user MUST be authenticated.
+*/
+func GetUserIDFromTokenNotStrictValidation(r *http.Request) string {
+	cookie, err := r.Cookie("token")
+	if err == nil {
+		token := cookie.Value
+		valid, vErr := VerifyJWT(token)
+
+		if valid && vErr == nil {
+			return GetUserIDFromToken(r)
+		}
+	}
+
+	return ""
+}
+
+/**
+Gets user ID from a token that has already been validated by JWTMiddleware.
+*/
+func GetUserIDFromToken(r *http.Request) string {
+	cookie, _ := r.Cookie("token")
+	token := cookie.Value
+
+	parsed, _, _ := new(jwt.Parser).ParseUnverified(token, &jwt.MapClaims{})
+
+	claims := parsed.Claims.(*jwt.MapClaims)
+
+	return (*claims)["id"].(string)
+}
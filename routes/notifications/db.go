@@ -0,0 +1,214 @@
+package notifications
+
+import (
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/users"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+const defaultRetentionDays = 90
+
+// How long notifications are kept, read or not.
+var retention = defaultRetentionDays * 24 * time.Hour
+
+type notificationDatabaseResponse struct {
+	notifications []*model.Notification
+	err           error
+}
+
+/**
+Loads the retention period from NOTIFICATION_RETENTION_DAYS. Falls back to the default if it is missing or invalid.
+*/
+func loadRetention() {
+	daysString, exists := os.LookupEnv("NOTIFICATION_RETENTION_DAYS")
+
+	if !exists {
+		return
+	}
+
+	days, err := strconv.Atoi(daysString)
+
+	if err != nil || days <= 0 {
+		log.Println("invalid NOTIFICATION_RETENTION_DAYS; using default")
+		return
+	}
+
+	retention = time.Duration(days) * 24 * time.Hour
+}
+
+/**
+Creates the indexes that notification queries rely on. MongoDB removes notifications once they are older than the
+retention period. The TTL index is not changed if it already exists, so changing the retention period requires
+dropping it first.
+*/
+func createNotificationIndexes() {
+	ttl := options.Index().SetExpireAfterSeconds(int32(retention / time.Second))
+
+	if err := database.CreateIndex("notifications", bson.D{{"createdAt", 1}}, ttl); err != nil {
+		log.Println("could not create notification index: " + err.Error())
+	}
+
+	indexes := []bson.D{
+		{{"userid", 1}, {"read", 1}, {"_id", -1}},
+		{{"userid", 1}, {"type", 1}, {"actorID", 1}, {"imageID", 1}},
+		{{"imageID", 1}},
+	}
+
+	for _, k := range indexes {
+		if err := database.CreateIndex("notifications", k, nil); err != nil {
+			log.Println("could not create notification index: " + err.Error())
+		}
+	}
+}
+
+/**
+Notifies a user of something another user did. Does nothing if the user did it themselves.
+
+A repeated action, such as liking an image again after unliking it, refreshes the earlier notification and marks it
+unread instead of adding another one. Errors are logged, since a failed notification should never fail the action
+that caused it.
+*/
+func Notify(notification model.Notification) {
+	if notification.UserID == notification.ActorID {
+		return
+	}
+
+	filter := bson.D{
+		{"userid", notification.UserID},
+		{"type", notification.Type},
+		{"actorID", notification.ActorID},
+		{"imageID", notification.ImageID},
+	}
+
+	update := bson.D{{"$set", bson.D{
+		{"read", false},
+		{"createdAt", time.Now()},
+	}}}
+
+	if res := database.UpdateOne("notifications", filter, update, options.Update().SetUpsert(true)); res.Err != nil {
+		log.Println("could not notify user " + notification.UserID + ": " + res.Err.Error())
+	}
+}
+
+/**
+Withdraws an unread notification, for example when an image is unliked before its author has seen the like.
+*/
+func Withdraw(userid string, notificationType string, actorID string, imageID string) {
+	filter := bson.D{
+		{"userid", userid},
+		{"type", notificationType},
+		{"actorID", actorID},
+		{"imageID", imageID},
+		{"read", false},
+	}
+
+	if res := database.DeleteOne("notifications", filter, nil); res.Err != nil {
+		log.Println("could not withdraw notification: " + res.Err.Error())
+	}
+}
+
+/**
+Deletes every notification about the given images. Called when images are deleted.
+*/
+func DeleteImageNotifications(imageIDs []string, channel chan *database.DeleteResponse) {
+	channel <- database.Delete("notifications", bson.D{{"imageID", bson.D{{"$in", imageIDs}}}}, nil)
+}
+
+func getNotificationsFromDatabase(filter bson.D, opts *options.FindOptions, channel chan notificationDatabaseResponse) {
+	res := database.Find("notifications", filter, opts)
+
+	if res.Err != nil {
+		channel <- notificationDatabaseResponse{notifications: nil, err: res.Err}
+		return
+	}
+
+	notificationList := []*model.Notification{}
+
+	for _, k := range res.Result {
+		notification := model.Notification{}
+
+		bsonBytes, _ := bson.Marshal(k)
+
+		_ = bson.Unmarshal(bsonBytes, &notification)
+
+		notificationList = append(notificationList, &notification)
+	}
+
+	channel <- notificationDatabaseResponse{notifications: notificationList, err: nil}
+}
+
+// Counts the user's unread notifications.
+func countUnread(userid string) (int64, error) {
+	pipeline := []bson.D{
+		{{"$match", bson.D{{"userid", userid}, {"read", false}}}},
+		{{"$count", "count"}},
+	}
+
+	res := database.Aggregate("notifications", pipeline, nil)
+
+	if res.Err != nil || len(res.Result) == 0 {
+		return 0, res.Err
+	}
+
+	switch n := res.Result[0]["count"].(type) {
+	case int32:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	}
+
+	return 0, nil
+}
+
+// Marks the user's notifications read. Marks all of them if ids is nil.
+func markRead(userid string, ids []primitive.ObjectID, channel chan *database.UpdateResponse) {
+	filter := bson.D{{"userid", userid}, {"read", false}}
+
+	if ids != nil {
+		filter = append(filter, bson.E{Key: "_id", Value: bson.D{{"$in", ids}}})
+	}
+
+	channel <- database.Update("notifications", filter, bson.D{{"$set", bson.D{{"read", true}}}}, nil)
+}
+
+// Appends actor to each notification in the list.
+func appendActorsToNotifications(notifications []*model.Notification) {
+	idSet := make(map[string]bool)
+	userIDs := []primitive.ObjectID{}
+
+	for _, k := range notifications {
+		if hex, err := primitive.ObjectIDFromHex(k.ActorID); err == nil && !idSet[k.ActorID] {
+			idSet[k.ActorID] = true
+			userIDs = append(userIDs, hex)
+		}
+	}
+
+	filter := bson.D{{"_id", bson.D{{"$in", userIDs}}}}
+	projection := bson.D{{"name", 1}, {"userHandle", 1}}
+
+	c := make(chan []users.FindUserResponse)
+	go users.GetUsersFromDatabase(filter, projection, c)
+
+	res := <-c
+
+	if len(res) == 1 && res[0].Err != nil {
+		return
+	}
+
+	userMap := make(map[string]model.User)
+
+	for _, k := range res {
+		userMap[k.User.ID] = k.User
+	}
+
+	for _, k := range notifications {
+		k.SetActor(userMap[k.ActorID])
+	}
+}
@@ -0,0 +1,227 @@
+package notifications
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/middleware"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const defaultNotificationLimit = 20
+const maxNotificationLimit = 100
+
+// Most notifications that can be marked read in one request.
+const maxMarkReadIDs = 100
+
+type notificationPage struct {
+	Notifications []*model.Notification `json:"notifications"`
+	NextCursor    string                `json:"nextCursor,omitempty"`
+}
+
+type unreadCountResponse struct {
+	Count int64 `json:"count"`
+}
+
+type markReadBody struct {
+	IDs []string `json:"ids"`
+}
+
+/**
+	[GET]
+
+	Gets the user's notifications, most recent first.
+
+	Accepted query parameters:
+		- unread: Y/y. Optional. Only return unread notifications.
+		- cursor: Optional. The nextCursor of the previous page.
+		- limit: integer. The number of notifications to return. Default 20, max 100.
+
+	Returns: (application/json)
+		- 200: The notifications, each with the user who caused it (actor), and a nextCursor to get the next page with.
+		  nextCursor is left out on the last page.
+		- 400: An invalid cursor was passed in.
+		- 500: Internal server error.
+*/
+func getNotifications(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	filter := bson.D{{"userid", uid}}
+
+	if strings.ToLower(r.URL.Query().Get("unread")) == "y" {
+		filter = append(filter, bson.E{Key: "read", Value: false})
+	}
+
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		hex, hexErr := primitive.ObjectIDFromHex(cursor)
+
+		if hexErr != nil {
+			http.Error(w, "invalid cursor passed in: "+cursor, http.StatusBadRequest)
+			return
+		}
+
+		filter = append(filter, bson.E{Key: "_id", Value: bson.D{{"$lt", hex}}})
+	}
+
+	var limit int64 = defaultNotificationLimit
+
+	if limitQuery := r.URL.Query().Get("limit"); limitQuery != "" {
+		if conv, convErr := strconv.ParseInt(limitQuery, 10, 64); convErr == nil && conv > 0 {
+			limit = conv
+		}
+	}
+
+	if limit > maxNotificationLimit {
+		limit = maxNotificationLimit
+	}
+
+	// Fetch one notification more than the limit, to find out whether there is a next page.
+	opts := options.Find().SetSort(bson.D{{"_id", -1}}).SetLimit(limit + 1)
+	channel := make(chan notificationDatabaseResponse)
+
+	go getNotificationsFromDatabase(filter, opts, channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		log.Println(res.err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	page := notificationPage{Notifications: res.notifications}
+
+	if int64(len(page.Notifications)) > limit {
+		page.Notifications = page.Notifications[:limit]
+		page.NextCursor = page.Notifications[limit-1].ID
+	}
+
+	appendActorsToNotifications(page.Notifications)
+
+	jsonResponse, _ := json.Marshal(page)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonResponse)
+}
+
+/**
+	[GET]
+
+	Gets the number of the user's unread notifications.
+
+	Returns: (application/json)
+		- 200: The count.
+		- 500: Internal server error.
+*/
+func getUnreadCount(w http.ResponseWriter, r *http.Request) {
+	count, err := countUnread(middleware.GetUserIDFromToken(r))
+
+	if err != nil {
+		log.Println(err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	jsonResponse, _ := json.Marshal(unreadCountResponse{Count: count})
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonResponse)
+}
+
+/**
+	[PATCH]
+
+	Marks some of the user's notifications read. IDs of notifications that do not exist, belong to someone else, or
+	are already read are ignored.
+
+	JSON body parameters:
+		- ids: An array of notification IDs. At most 100.
+
+	Returns:
+		- 200: Notifications marked read.
+		- 400: No IDs, too many IDs, or an invalid ID was passed in.
+		- 500: Internal server error.
+*/
+func markNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	body := &markReadBody{}
+
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(body.IDs) == 0 || len(body.IDs) > maxMarkReadIDs {
+		http.Error(w, "between 1 and "+strconv.Itoa(maxMarkReadIDs)+" ids must be passed in", http.StatusBadRequest)
+		return
+	}
+
+	ids := make([]primitive.ObjectID, len(body.IDs))
+
+	for i, k := range body.IDs {
+		hex, hexErr := primitive.ObjectIDFromHex(k)
+
+		if hexErr != nil {
+			http.Error(w, "invalid notification ID passed in: "+k, http.StatusBadRequest)
+			return
+		}
+
+		ids[i] = hex
+	}
+
+	channel := make(chan *database.UpdateResponse)
+
+	go markRead(middleware.GetUserIDFromToken(r), ids, channel)
+
+	if res := <-channel; res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+	[PATCH]
+
+	Marks all of the user's notifications read.
+
+	Returns:
+		- 200: Notifications marked read.
+		- 500: Internal server error.
+*/
+func markAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	channel := make(chan *database.UpdateResponse)
+
+	go markRead(middleware.GetUserIDFromToken(r), nil, channel)
+
+	if res := <-channel; res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func ServeNotificationRoutes(r *mux.Router) {
+	loadRetention()
+	createNotificationIndexes()
+
+	r.Use(middleware.JWTMiddleware)
+
+	r.HandleFunc("/getNotifications", getNotifications).Methods("GET")
+	r.HandleFunc("/getUnreadCount", getUnreadCount).Methods("GET")
+	r.HandleFunc("/markNotificationsRead", markNotificationsRead).Methods("PATCH")
+	r.HandleFunc("/markAllNotificationsRead", markAllNotificationsRead).Methods("PATCH")
+}
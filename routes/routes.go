@@ -2,8 +2,14 @@ package routes
 
 import (
 	"github.com/gorilla/mux"
+	"github.com/kilowatt-/ImageRepository/routes/albums"
+	"github.com/kilowatt-/ImageRepository/routes/comments"
+	"github.com/kilowatt-/ImageRepository/routes/events"
+	"github.com/kilowatt-/ImageRepository/routes/groups"
 	"github.com/kilowatt-/ImageRepository/routes/images"
+	"github.com/kilowatt-/ImageRepository/routes/notifications"
 	"github.com/kilowatt-/ImageRepository/routes/users"
+	"github.com/kilowatt-/ImageRepository/routes/webhooks"
 	"net/http"
 )
 
@@ -17,6 +23,12 @@ func serveCatchAllAPIRoutes(r *mux.Router) {
 func RegisterRoutes(r *mux.Router) {
 	users.ServeUserRoutes(r.PathPrefix("/users").Subrouter())
 	images.ServeImageRoutes(r.PathPrefix("/images").Subrouter())
+	albums.ServeAlbumRoutes(r.PathPrefix("/albums").Subrouter())
+	comments.ServeCommentRoutes(r.PathPrefix("/comments").Subrouter())
+	notifications.ServeNotificationRoutes(r.PathPrefix("/notifications").Subrouter())
+	events.ServeEventRoutes(r.PathPrefix("/events").Subrouter())
+	webhooks.ServeWebhookRoutes(r.PathPrefix("/webhooks").Subrouter())
+	groups.ServeGroupRoutes(r.PathPrefix("/groups").Subrouter())
 	r.HandleFunc("/", func(w http.ResponseWriter, request *http.Request) {
 		w.WriteHeader(200);
 		w.Write([]byte("Welcome to Outstagram API"));
@@ -5,8 +5,10 @@ import (
 	"github.com/kilowatt-/ImageRepository/database"
 	"github.com/kilowatt-/ImageRepository/model"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
+	"log"
 )
 
 const UserNotFound = "user not found"
@@ -91,3 +93,106 @@ func GetUserWithLogin(email string, password string, channel chan FindUserRespon
 	}
 }
 
+
+type followDatabaseResponse struct {
+	follows []*model.Follow
+	err     error
+}
+
+/**
+Creates the indexes that follow queries rely on. A user can follow another user only once.
+*/
+func createFollowIndexes() {
+	if err := database.CreateIndex("follows", bson.D{{"followerID", 1}, {"followeeID", 1}}, options.Index().SetUnique(true)); err != nil {
+		log.Println("could not create follow index: " + err.Error())
+	}
+
+	indexes := []bson.D{
+		{{"followeeID", 1}, {"status", 1}, {"_id", -1}},
+		{{"followerID", 1}, {"status", 1}, {"_id", -1}},
+	}
+
+	for _, k := range indexes {
+		if err := database.CreateIndex("follows", k, nil); err != nil {
+			log.Println("could not create follow index: " + err.Error())
+		}
+	}
+}
+
+func getFollowsFromDatabase(filter bson.D, opts *options.FindOptions, channel chan followDatabaseResponse) {
+	res := database.Find("follows", filter, opts)
+
+	if res.Err != nil {
+		channel <- followDatabaseResponse{follows: nil, err: res.Err}
+		return
+	}
+
+	followList := []*model.Follow{}
+
+	for _, k := range res.Result {
+		follow := model.Follow{}
+
+		bsonBytes, _ := bson.Marshal(k)
+
+		_ = bson.Unmarshal(bsonBytes, &follow)
+
+		followList = append(followList, &follow)
+	}
+
+	channel <- followDatabaseResponse{follows: followList, err: nil}
+}
+
+// Gets the follow from one user to another, in any state.
+func getFollow(followerID string, followeeID string, channel chan followDatabaseResponse) {
+	getFollowsFromDatabase(bson.D{{"followerID", followerID}, {"followeeID", followeeID}}, nil, channel)
+}
+
+/**
+Inserts a follow unless one already exists between the two users. Matched is 1 if one already exists.
+*/
+func insertFollow(follow model.Follow, channel chan *database.UpdateResponse) {
+	filter := bson.D{{"followerID", follow.FollowerID}, {"followeeID", follow.FolloweeID}}
+	update := bson.D{{"$setOnInsert", follow}}
+
+	channel <- database.UpdateOne("follows", filter, update, options.Update().SetUpsert(true))
+}
+
+// Accepts a pending follow request.
+func acceptFollow(followerID string, followeeID string, channel chan *database.UpdateResponse) {
+	filter := bson.D{{"followerID", followerID}, {"followeeID", followeeID}, {"status", model.FollowStatusPending}}
+	update := bson.D{{"$set", bson.D{{"status", model.FollowStatusAccepted}}}}
+
+	channel <- database.UpdateOne("follows", filter, update, nil)
+}
+
+// Deletes the follow from one user to another if it is in the given state.
+func deleteFollow(followerID string, followeeID string, status string, channel chan *database.DeleteResponse) {
+	filter := bson.D{{"followerID", followerID}, {"followeeID", followeeID}, {"status", status}}
+
+	channel <- database.DeleteOne("follows", filter, nil)
+}
+
+/**
+Changes the following count of the follower and the follower count of the followee by delta, after a follow was
+accepted or removed.
+*/
+func updateFollowCounts(followerID string, followeeID string, delta int64) error {
+	followerHex, _ := primitive.ObjectIDFromHex(followerID)
+	followeeHex, _ := primitive.ObjectIDFromHex(followeeID)
+
+	if res := database.UpdateOne("users", bson.D{{"_id", followerHex}}, bson.D{{"$inc", bson.D{{"followingCount", delta}}}}, nil); res.Err != nil {
+		return res.Err
+	}
+
+	return database.UpdateOne("users", bson.D{{"_id", followeeHex}}, bson.D{{"$inc", bson.D{{"followerCount", delta}}}}, nil).Err
+}
+
+func setUserPrivate(userid primitive.ObjectID, private bool, channel chan *database.UpdateResponse) {
+	update := bson.D{{"$set", bson.D{{"private", private}}}}
+
+	if !private {
+		update = bson.D{{"$unset", bson.D{{"private", ""}}}}
+	}
+
+	channel <- database.UpdateOne("users", bson.D{{"_id", userid}}, update, nil)
+}
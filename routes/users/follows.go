@@ -0,0 +1,725 @@
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/events"
+	"github.com/kilowatt-/ImageRepository/routes/middleware"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const followNotFound = "follow not found"
+
+const defaultFollowLimit = 20
+const maxFollowLimit = 100
+
+// The JSON body of the follow endpoints. Each endpoint documents which fields it uses.
+type followBody struct {
+	ID      string `json:"_id,omitempty"`
+	Private *bool  `json:"private,omitempty"`
+}
+
+// A user in a follower, following or follow request list.
+type followListUser struct {
+	ID         string    `json:"_id"`
+	Name       string    `json:"name,omitempty"`
+	UserHandle string    `json:"userHandle,omitempty"`
+	Since      time.Time `json:"since"`
+}
+
+type followPage struct {
+	Users      []followListUser `json:"users"`
+	NextCursor string           `json:"nextCursor,omitempty"`
+}
+
+type followStatusResponse struct {
+	Following  string `json:"following"`
+	FollowedBy string `json:"followedBy"`
+}
+
+// Decodes the JSON body of a follow request, which must name a user.
+func decodeFollowBody(r *http.Request) (*followBody, *primitive.ObjectID, error) {
+	body := &followBody{}
+
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		return nil, nil, err
+	}
+
+	if body.ID == "" {
+		return nil, nil, errors.New("user id not passed in")
+	}
+
+	hex, hexErr := primitive.ObjectIDFromHex(body.ID)
+
+	if hexErr != nil {
+		return nil, nil, errors.New("invalid user ID passed in: " + body.ID)
+	}
+
+	return body, &hex, nil
+}
+
+// Gets a user by ID, responding with an error if there is none.
+func getUserOrRespond(w http.ResponseWriter, userid primitive.ObjectID) (*model.User, bool) {
+	channel := make(chan []FindUserResponse)
+
+	go GetUsersFromDatabase(bson.D{{"_id", userid}}, bson.D{{"private", 1}}, channel)
+
+	res := <-channel
+
+	if len(res) == 1 && res[0].Err != nil {
+		log.Println(res[0].Err)
+		common.SendInternalServerError(w)
+		return nil, false
+	}
+
+	if len(res) == 0 {
+		http.Error(w, UserNotFound, http.StatusNotFound)
+		return nil, false
+	}
+
+	return &res[0].User, true
+}
+
+// Gets the follow from one user to another, or nil if there is none.
+func getFollowStatus(followerID string, followeeID string) (*model.Follow, error) {
+	channel := make(chan followDatabaseResponse)
+
+	go getFollow(followerID, followeeID, channel)
+
+	res := <-channel
+
+	if res.err != nil || len(res.follows) == 0 {
+		return nil, res.err
+	}
+
+	return res.follows[0], nil
+}
+
+/**
+Reports whether a user can see who a user follows and is followed by. The lists of private accounts are only visible
+to the account itself and its accepted followers.
+*/
+func canSeeFollowLists(viewerID string, user *model.User) (bool, error) {
+	if !user.Private || viewerID == user.ID {
+		return true, nil
+	}
+
+	if viewerID == "" {
+		return false, nil
+	}
+
+	follow, err := getFollowStatus(viewerID, user.ID)
+
+	if err != nil {
+		return false, err
+	}
+
+	return follow != nil && follow.Status == model.FollowStatusAccepted, nil
+}
+
+// Parses the cursor and limit query parameters of a follow list.
+func parseFollowPaging(r *http.Request) (bson.D, int64, error) {
+	var limit int64 = defaultFollowLimit
+
+	if limitQuery := r.URL.Query().Get("limit"); limitQuery != "" {
+		if conv, convErr := strconv.ParseInt(limitQuery, 10, 64); convErr == nil && conv > 0 {
+			limit = conv
+		}
+	}
+
+	if limit > maxFollowLimit {
+		limit = maxFollowLimit
+	}
+
+	cursor := r.URL.Query().Get("cursor")
+
+	if cursor == "" {
+		return nil, limit, nil
+	}
+
+	hex, hexErr := primitive.ObjectIDFromHex(cursor)
+
+	if hexErr != nil {
+		return nil, limit, errors.New("invalid cursor passed in: " + cursor)
+	}
+
+	return bson.D{{"_id", bson.D{{"$lt", hex}}}}, limit, nil
+}
+
+/**
+Responds with a page of follows matching the filter, most recent first, listing the user on the given side of each
+follow (followerID or followeeID).
+*/
+func writeFollowPage(w http.ResponseWriter, filter bson.D, cursorFilter bson.D, limit int64, listedSide string) {
+	if cursorFilter != nil {
+		filter = append(filter, cursorFilter...)
+	}
+
+	// Fetch one follow more than the limit, to find out whether there is a next page.
+	opts := options.Find().SetSort(bson.D{{"_id", -1}}).SetLimit(limit + 1)
+	channel := make(chan followDatabaseResponse)
+
+	go getFollowsFromDatabase(filter, opts, channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		log.Println(res.err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	follows := res.follows
+	page := followPage{Users: []followListUser{}}
+
+	if int64(len(follows)) > limit {
+		follows = follows[:limit]
+		page.NextCursor = follows[limit-1].ID
+	}
+
+	listedID := func(follow *model.Follow) string {
+		if listedSide == "followerID" {
+			return follow.FollowerID
+		}
+		return follow.FolloweeID
+	}
+
+	userIDs := []primitive.ObjectID{}
+
+	for _, k := range follows {
+		if hex, err := primitive.ObjectIDFromHex(listedID(k)); err == nil {
+			userIDs = append(userIDs, hex)
+		}
+	}
+
+	usersChannel := make(chan []FindUserResponse)
+
+	go GetUsersFromDatabase(bson.D{{"_id", bson.D{{"$in", userIDs}}}}, bson.D{{"name", 1}, {"userHandle", 1}}, usersChannel)
+
+	found := <-usersChannel
+
+	if len(found) == 1 && found[0].Err != nil {
+		log.Println(found[0].Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	userMap := make(map[string]model.User)
+
+	for _, k := range found {
+		userMap[k.User.ID] = k.User
+	}
+
+	for _, k := range follows {
+		user := userMap[listedID(k)]
+		page.Users = append(page.Users, followListUser{ID: listedID(k), Name: user.Name, UserHandle: user.UserHandle, Since: k.CreatedAt})
+	}
+
+	jsonResponse, _ := json.Marshal(page)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonResponse)
+}
+
+/**
+[POST]
+Follows a user. Following a private account sends a follow request, which takes effect once the user accepts it.
+
+JSON body parameters:
+	- _id: the ID of the user to follow.
+
+Returns:
+	- 200: User followed.
+	- 202: Follow request sent.
+	- 400: Invalid ID, or the user tried to follow themselves.
+	- 404: User not found.
+	- 409: Already following the user, or already requested to.
+	- 500: Internal server error.
+*/
+func followUser(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	_, hex, decodeErr := decodeFollowBody(r)
+
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if hex.Hex() == uid {
+		http.Error(w, "users cannot follow themselves", http.StatusBadRequest)
+		return
+	}
+
+	followee, ok := getUserOrRespond(w, *hex)
+
+	if !ok {
+		return
+	}
+
+	follow := model.Follow{
+		FollowerID: uid,
+		FolloweeID: followee.ID,
+		Status:     model.FollowStatusAccepted,
+		CreatedAt:  time.Now(),
+	}
+
+	if followee.Private {
+		follow.Status = model.FollowStatusPending
+	}
+
+	channel := make(chan *database.UpdateResponse)
+
+	go insertFollow(follow, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if res.Matched > 0 {
+		http.Error(w, "already following or requested to follow user", http.StatusConflict)
+		return
+	}
+
+	events.Publish(events.Event{
+		Type:     events.TypeFollowed,
+		Data:     events.FollowData{UserID: uid, Status: follow.Status},
+		Audience: events.UserAudience(followee.ID),
+	})
+
+	if follow.Status == model.FollowStatusPending {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if err := updateFollowCounts(uid, followee.ID, 1); err != nil {
+		log.Println("could not update follow counts: " + err.Error())
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+[DELETE]
+Unfollows a user, or withdraws a follow request.
+
+JSON body parameters:
+	- _id: the ID of the user to unfollow.
+
+Returns:
+	- 200: User unfollowed, or follow request withdrawn.
+	- 400: Invalid ID.
+	- 404: Not following the user.
+	- 500: Internal server error.
+*/
+func unfollowUser(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	_, hex, decodeErr := decodeFollowBody(r)
+
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	removeFollow(w, uid, hex.Hex(), model.FollowStatusAccepted, model.FollowStatusPending)
+}
+
+/**
+[DELETE]
+Removes a user from the user's followers.
+
+JSON body parameters:
+	- _id: the ID of the follower to remove.
+
+Returns:
+	- 200: Follower removed.
+	- 400: Invalid ID.
+	- 404: The user is not a follower.
+	- 500: Internal server error.
+*/
+func removeFollower(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	_, hex, decodeErr := decodeFollowBody(r)
+
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	removeFollow(w, hex.Hex(), uid, model.FollowStatusAccepted)
+}
+
+/**
+[DELETE]
+Rejects a follow request to the user.
+
+JSON body parameters:
+	- _id: the ID of the user who sent the request.
+
+Returns:
+	- 200: Request rejected.
+	- 400: Invalid ID.
+	- 404: No follow request from this user.
+	- 500: Internal server error.
+*/
+func rejectFollowRequest(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	_, hex, decodeErr := decodeFollowBody(r)
+
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	removeFollow(w, hex.Hex(), uid, model.FollowStatusPending)
+}
+
+/**
+Deletes the follow between two users if it is in one of the given states, updating the follow counts if it was
+accepted, and responds.
+*/
+func removeFollow(w http.ResponseWriter, followerID string, followeeID string, statuses ...string) {
+	channel := make(chan *database.DeleteResponse)
+
+	for _, status := range statuses {
+		go deleteFollow(followerID, followeeID, status, channel)
+
+		res := <-channel
+
+		if res.Err != nil {
+			log.Println(res.Err)
+			common.SendInternalServerError(w)
+			return
+		}
+
+		if res.NumberDeleted == 0 {
+			continue
+		}
+
+		if status == model.FollowStatusAccepted {
+			if err := updateFollowCounts(followerID, followeeID, -1); err != nil {
+				log.Println("could not update follow counts: " + err.Error())
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	http.Error(w, followNotFound, http.StatusNotFound)
+}
+
+/**
+Accepts a pending follow request, and updates the follow counts.
+
+Returns false if there is no such request.
+*/
+func acceptFollowRequestFrom(followerID string, followeeID string) (bool, error) {
+	channel := make(chan *database.UpdateResponse)
+
+	go acceptFollow(followerID, followeeID, channel)
+
+	res := <-channel
+
+	if res.Err != nil || res.Matched == 0 {
+		return false, res.Err
+	}
+
+	if err := updateFollowCounts(followerID, followeeID, 1); err != nil {
+		log.Println("could not update follow counts: " + err.Error())
+	}
+
+	return true, nil
+}
+
+/**
+[POST]
+Accepts a follow request to the user.
+
+JSON body parameters:
+	- _id: the ID of the user who sent the request.
+
+Returns:
+	- 200: Request accepted.
+	- 400: Invalid ID.
+	- 404: No follow request from this user.
+	- 500: Internal server error.
+*/
+func acceptFollowRequest(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	_, hex, decodeErr := decodeFollowBody(r)
+
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	accepted, err := acceptFollowRequestFrom(hex.Hex(), uid)
+
+	if err != nil {
+		log.Println(err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if !accepted {
+		http.Error(w, followNotFound, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+[PATCH]
+Makes the user's account private or public. Following a private account requires the account to accept a follow
+request. Making an account public accepts all of its pending follow requests.
+
+JSON body parameters:
+	- private: boolean.
+
+Returns:
+	- 200: Account updated.
+	- 400: private was not passed in.
+	- 500: Internal server error.
+*/
+func setAccountPrivacy(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	body := &followBody{}
+
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil || body.Private == nil {
+		http.Error(w, "private not passed in", http.StatusBadRequest)
+		return
+	}
+
+	hex, _ := primitive.ObjectIDFromHex(uid)
+	channel := make(chan *database.UpdateResponse)
+
+	go setUserPrivate(hex, *body.Private, channel)
+
+	if res := <-channel; res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if !*body.Private {
+		requestsChannel := make(chan followDatabaseResponse)
+
+		go getFollowsFromDatabase(bson.D{{"followeeID", uid}, {"status", model.FollowStatusPending}}, nil, requestsChannel)
+
+		requests := <-requestsChannel
+
+		if requests.err != nil {
+			log.Println(requests.err)
+			common.SendInternalServerError(w)
+			return
+		}
+
+		for _, k := range requests.follows {
+			if _, err := acceptFollowRequestFrom(k.FollowerID, uid); err != nil {
+				log.Println("could not accept follow request from " + k.FollowerID + ": " + err.Error())
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Gets the user named by the id query parameter if the viewer can see their follow lists, responding with an error otherwise.
+func getListedUserOrRespond(w http.ResponseWriter, r *http.Request) (*model.User, bool) {
+	hex, hexErr := primitive.ObjectIDFromHex(r.URL.Query().Get("id"))
+
+	if hexErr != nil {
+		http.Error(w, "invalid user ID passed in", http.StatusBadRequest)
+		return nil, false
+	}
+
+	user, ok := getUserOrRespond(w, hex)
+
+	if !ok {
+		return nil, false
+	}
+
+	visible, err := canSeeFollowLists(middleware.GetUserIDFromTokenNotStrictValidation(r), user)
+
+	if err != nil {
+		log.Println(err)
+		common.SendInternalServerError(w)
+		return nil, false
+	}
+
+	if !visible {
+		http.Error(w, "user's follow lists are private", http.StatusForbidden)
+		return nil, false
+	}
+
+	return user, true
+}
+
+/**
+[GET]
+Gets the followers of a user, most recent first. The followers of a private account are only visible to the account
+and its followers.
+
+Accepted query parameters:
+	- id: the user ID.
+	- cursor: Optional. The nextCursor of the previous page.
+	- limit: {int} The number of users to return. Default 20, max 100.
+
+Returns:
+	- 200: The users, each with their _id, name, userHandle and when they started following (since), and a nextCursor
+	  to get the next page with. nextCursor is left out on the last page.
+	- 400: Invalid ID or cursor.
+	- 403: The account is private, and the user does not follow it.
+	- 404: User not found.
+	- 500: Internal server error.
+*/
+func getFollowers(w http.ResponseWriter, r *http.Request) {
+	cursorFilter, limit, pagingErr := parseFollowPaging(r)
+
+	if pagingErr != nil {
+		http.Error(w, pagingErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := getListedUserOrRespond(w, r)
+
+	if !ok {
+		return
+	}
+
+	filter := bson.D{{"followeeID", user.ID}, {"status", model.FollowStatusAccepted}}
+
+	writeFollowPage(w, filter, cursorFilter, limit, "followerID")
+}
+
+/**
+[GET]
+Gets the users that a user follows, most recent first. The follows of a private account are only visible to the
+account and its followers.
+
+Accepted query parameters:
+	- id: the user ID.
+	- cursor: Optional. The nextCursor of the previous page.
+	- limit: {int} The number of users to return. Default 20, max 100.
+
+Returns:
+	- 200: The users, each with their _id, name, userHandle and when they were followed (since), and a nextCursor to
+	  get the next page with. nextCursor is left out on the last page.
+	- 400: Invalid ID or cursor.
+	- 403: The account is private, and the user does not follow it.
+	- 404: User not found.
+	- 500: Internal server error.
+*/
+func getFollowing(w http.ResponseWriter, r *http.Request) {
+	cursorFilter, limit, pagingErr := parseFollowPaging(r)
+
+	if pagingErr != nil {
+		http.Error(w, pagingErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := getListedUserOrRespond(w, r)
+
+	if !ok {
+		return
+	}
+
+	filter := bson.D{{"followerID", user.ID}, {"status", model.FollowStatusAccepted}}
+
+	writeFollowPage(w, filter, cursorFilter, limit, "followeeID")
+}
+
+/**
+[GET]
+Gets the pending follow requests to the user, most recent first.
+
+Accepted query parameters:
+	- cursor: Optional. The nextCursor of the previous page.
+	- limit: {int} The number of users to return. Default 20, max 100.
+
+Returns:
+	- 200: The users who sent requests, each with their _id, name, userHandle and when they sent it (since), and a
+	  nextCursor to get the next page with. nextCursor is left out on the last page.
+	- 400: Invalid cursor.
+	- 500: Internal server error.
+*/
+func getFollowRequests(w http.ResponseWriter, r *http.Request) {
+	cursorFilter, limit, pagingErr := parseFollowPaging(r)
+
+	if pagingErr != nil {
+		http.Error(w, pagingErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter := bson.D{{"followeeID", middleware.GetUserIDFromToken(r)}, {"status", model.FollowStatusPending}}
+
+	writeFollowPage(w, filter, cursorFilter, limit, "followerID")
+}
+
+/**
+[GET]
+Gets whether the user follows another user, and whether that user follows them.
+
+Accepted query parameters:
+	- id: the other user's ID.
+
+Returns:
+	- 200: following and followedBy, each "accepted", "pending" or an empty string.
+	- 400: Invalid ID.
+	- 500: Internal server error.
+*/
+func getFollowRelation(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	hex, hexErr := primitive.ObjectIDFromHex(r.URL.Query().Get("id"))
+
+	if hexErr != nil {
+		http.Error(w, "invalid user ID passed in", http.StatusBadRequest)
+		return
+	}
+
+	response := followStatusResponse{}
+
+	following, followingErr := getFollowStatus(uid, hex.Hex())
+	followedBy, followedByErr := getFollowStatus(hex.Hex(), uid)
+
+	if followingErr != nil || followedByErr != nil {
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if following != nil {
+		response.Following = following.Status
+	}
+
+	if followedBy != nil {
+		response.FollowedBy = followedBy.Status
+	}
+
+	jsonResponse, _ := json.Marshal(response)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonResponse)
+}
@@ -88,7 +88,7 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	projection := bson.D{{"userHandle", 1}, {"name", 1}}
+	projection := bson.D{{"userHandle", 1}, {"name", 1}, {"private", 1}, {"followerCount", 1}, {"followingCount", 1}}
 
 	channel := make(chan []FindUserResponse)
 
@@ -266,4 +266,17 @@ func ServeUserRoutes(r *mux.Router) {
 	r.HandleFunc("/signup", handleSignUp).Methods("POST")
 	r.HandleFunc("/login", handleLogin).Methods("POST")
 	r.HandleFunc("/getUsers", getUsers).Methods("GET")
+
+	createFollowIndexes()
+
+	r.HandleFunc("/getFollowers", getFollowers).Methods("GET")
+	r.HandleFunc("/getFollowing", getFollowing).Methods("GET")
+	r.Handle("/getFollowRequests", middleware.JWTMiddleware(http.HandlerFunc(getFollowRequests))).Methods("GET")
+	r.Handle("/getFollowStatus", middleware.JWTMiddleware(http.HandlerFunc(getFollowRelation))).Methods("GET")
+	r.Handle("/follow", middleware.JWTMiddleware(http.HandlerFunc(followUser))).Methods("POST")
+	r.Handle("/unfollow", middleware.JWTMiddleware(http.HandlerFunc(unfollowUser))).Methods("DELETE")
+	r.Handle("/acceptFollowRequest", middleware.JWTMiddleware(http.HandlerFunc(acceptFollowRequest))).Methods("POST")
+	r.Handle("/rejectFollowRequest", middleware.JWTMiddleware(http.HandlerFunc(rejectFollowRequest))).Methods("DELETE")
+	r.Handle("/removeFollower", middleware.JWTMiddleware(http.HandlerFunc(removeFollower))).Methods("DELETE")
+	r.Handle("/setAccountPrivacy", middleware.JWTMiddleware(http.HandlerFunc(setAccountPrivacy))).Methods("PATCH")
 }
@@ -0,0 +1,96 @@
+package webhooks
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errBlockedAddress = errors.New("webhook endpoints cannot be on loopback, private, link-local, multicast or unspecified addresses")
+
+// Address ranges that are private to a network, which net.IP has no check for.
+var privateNetworks = parseNetworks(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"fc00::/7",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+
+	for _, k := range cidrs {
+		_, network, _ := net.ParseCIDR(k)
+		networks = append(networks, network)
+	}
+
+	return networks
+}
+
+/**
+Reports whether webhooks must not be sent to an address, because it reaches this server or the network it runs in
+rather than the public internet. A variable, so that tests can deliver to servers on the loopback address.
+*/
+var isBlockedIP = func(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return true
+	}
+
+	for _, k := range privateNetworks {
+		if k.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+Resolves a webhook host and checks every address it resolves to.
+
+Returns errBlockedAddress if any of them is blocked, or an error if the host cannot be resolved.
+*/
+func checkHost(host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if isBlockedIP(ip) {
+			return errBlockedAddress
+		}
+
+		return nil
+	}
+
+	ips, err := net.LookupIP(host)
+
+	if err != nil || len(ips) == 0 {
+		return errors.New("url host could not be resolved: " + host)
+	}
+
+	for _, k := range ips {
+		if isBlockedIP(k) {
+			return errBlockedAddress
+		}
+	}
+
+	return nil
+}
+
+/**
+Refuses connections to blocked addresses. Used as the dialer's Control hook, which runs after the host is resolved, so
+a host that resolved to a public address when its webhook was registered cannot later be pointed at a blocked one.
+*/
+func refuseBlockedAddresses(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+
+	if ip == nil || isBlockedIP(ip) {
+		return errBlockedAddress
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package webhooks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsBlockedIP(t *testing.T) {
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"100.64.0.1", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"224.0.0.1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"172.32.0.1", false},
+		{"8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+	}
+
+	for _, k := range tests {
+		if got := isBlockedIP(net.ParseIP(k.ip)); got != k.blocked {
+			t.Errorf("isBlockedIP(%s) = %t; want %t", k.ip, got, k.blocked)
+		}
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://8.8.8.8/hook", true},
+		{"http://[2001:4860:4860::8888]:8080/hook", true},
+		{"ftp://8.8.8.8/hook", false},
+		{"/hook", false},
+		{"http://127.0.0.1/hook", false},
+		{"http://[::1]:8080/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://192.168.0.10/hook", false},
+	}
+
+	for _, k := range tests {
+		if err := validateURL(k.url); (err == nil) != k.valid {
+			t.Errorf("validateURL(%s) returned %v; want valid %t", k.url, err, k.valid)
+		}
+	}
+}
+
+func TestRefuseBlockedAddresses(t *testing.T) {
+	if err := refuseBlockedAddresses("tcp4", "127.0.0.1:80", nil); err != errBlockedAddress {
+		t.Errorf("dialing a loopback address returned %v; want errBlockedAddress", err)
+	}
+
+	if err := refuseBlockedAddresses("tcp4", "8.8.8.8:443", nil); err != nil {
+		t.Errorf("dialing a public address returned %v", err)
+	}
+}
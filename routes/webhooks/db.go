@@ -0,0 +1,150 @@
+package webhooks
+
+import (
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"time"
+)
+
+// How long deliveries are kept in the delivery log.
+const deliveryRetention = 30 * 24 * time.Hour
+
+type webhookDatabaseResponse struct {
+	webhooks []*model.Webhook
+	err      error
+}
+
+type deliveryDatabaseResponse struct {
+	deliveries []*model.WebhookDelivery
+	err        error
+}
+
+/**
+Creates the indexes that webhook and delivery queries rely on. Deliveries are removed once they are older than
+deliveryRetention.
+*/
+func createWebhookIndexes() {
+	if err := database.CreateIndex("webhooks", bson.D{{"userid", 1}, {"events", 1}}, nil); err != nil {
+		log.Println("could not create webhook index: " + err.Error())
+	}
+
+	ttl := options.Index().SetExpireAfterSeconds(int32(deliveryRetention / time.Second))
+
+	if err := database.CreateIndex("webhookDeliveries", bson.D{{"createdAt", 1}}, ttl); err != nil {
+		log.Println("could not create webhook delivery index: " + err.Error())
+	}
+
+	indexes := []bson.D{
+		{{"status", 1}, {"nextAttemptAt", 1}},
+		{{"webhookID", 1}, {"_id", -1}},
+	}
+
+	for _, k := range indexes {
+		if err := database.CreateIndex("webhookDeliveries", k, nil); err != nil {
+			log.Println("could not create webhook delivery index: " + err.Error())
+		}
+	}
+}
+
+func getWebhooksFromDatabase(filter bson.D, opts *options.FindOptions, channel chan webhookDatabaseResponse) {
+	res := database.Find("webhooks", filter, opts)
+
+	if res.Err != nil {
+		channel <- webhookDatabaseResponse{webhooks: nil, err: res.Err}
+		return
+	}
+
+	webhookList := []*model.Webhook{}
+
+	for _, k := range res.Result {
+		webhook := model.Webhook{}
+
+		bsonBytes, _ := bson.Marshal(k)
+
+		_ = bson.Unmarshal(bsonBytes, &webhook)
+
+		webhookList = append(webhookList, &webhook)
+	}
+
+	channel <- webhookDatabaseResponse{webhooks: webhookList, err: nil}
+}
+
+// Gets one of the user's webhooks.
+func getOwnWebhook(userid string, webhookid primitive.ObjectID, channel chan webhookDatabaseResponse) {
+	getWebhooksFromDatabase(bson.D{{"_id", webhookid}, {"userid", userid}}, nil, channel)
+}
+
+func countWebhooks(userid string) (int64, error) {
+	pipeline := []bson.D{
+		{{"$match", bson.D{{"userid", userid}}}},
+		{{"$count", "count"}},
+	}
+
+	res := database.Aggregate("webhooks", pipeline, nil)
+
+	if res.Err != nil || len(res.Result) == 0 {
+		return 0, res.Err
+	}
+
+	switch n := res.Result[0]["count"].(type) {
+	case int32:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	}
+
+	return 0, nil
+}
+
+func insertWebhook(webhook model.Webhook, channel chan *database.InsertResponse) {
+	channel <- database.InsertOne("webhooks", webhook, nil)
+}
+
+func updateOwnWebhook(userid string, webhookid primitive.ObjectID, set bson.D, channel chan *database.UpdateResponse) {
+	filter := bson.D{{"_id", webhookid}, {"userid", userid}}
+
+	channel <- database.UpdateOne("webhooks", filter, bson.D{{"$set", set}}, nil)
+}
+
+// Deletes one of the user's webhooks, and its delivery log.
+func deleteOwnWebhook(userid string, webhookid primitive.ObjectID, channel chan *database.DeleteResponse) {
+	res := database.DeleteOne("webhooks", bson.D{{"_id", webhookid}, {"userid", userid}}, nil)
+
+	if res.Err != nil || res.NumberDeleted == 0 {
+		channel <- res
+		return
+	}
+
+	if deleted := database.Delete("webhookDeliveries", bson.D{{"webhookID", webhookid.Hex()}}, nil); deleted.Err != nil {
+		log.Println("could not delete deliveries of webhook " + webhookid.Hex() + ": " + deleted.Err.Error())
+	}
+
+	channel <- res
+}
+
+func getDeliveriesFromDatabase(filter bson.D, opts *options.FindOptions, channel chan deliveryDatabaseResponse) {
+	res := database.Find("webhookDeliveries", filter, opts)
+
+	if res.Err != nil {
+		channel <- deliveryDatabaseResponse{deliveries: nil, err: res.Err}
+		return
+	}
+
+	deliveryList := []*model.WebhookDelivery{}
+
+	for _, k := range res.Result {
+		delivery := model.WebhookDelivery{}
+
+		bsonBytes, _ := bson.Marshal(k)
+
+		_ = bson.Unmarshal(bsonBytes, &delivery)
+
+		deliveryList = append(deliveryList, &delivery)
+	}
+
+	channel <- deliveryDatabaseResponse{deliveries: deliveryList, err: nil}
+}
@@ -0,0 +1,437 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often the dispatcher looks for deliveries that are due.
+const dispatchInterval = 5 * time.Second
+
+// Most deliveries attempted in one run of the dispatcher.
+const dispatchBatchSize = 50
+
+const defaultDispatchWorkers = 8
+
+// Number of deliveries the dispatcher sends at the same time, so that one slow endpoint does not hold up the others.
+var dispatchWorkers = defaultDispatchWorkers
+
+// A delivery is given up on after this many failed attempts.
+const maxDeliveryAttempts = 8
+
+// The wait before the first retry. It doubles after every failed attempt, up to maxRetryDelay.
+const baseRetryDelay = 30 * time.Second
+const maxRetryDelay = 6 * time.Hour
+
+// How long a claimed delivery is hidden from other dispatchers, in case this one dies while sending it.
+const claimTimeout = 2 * time.Minute
+
+const deliveryTimeout = 10 * time.Second
+
+// Largest part of a failed response body kept in the delivery log.
+const maxLoggedResponseBytes = 512
+
+/**
+Sends deliveries. It connects only to addresses that isBlockedIP allows, checked after each name lookup, and neither
+follows redirects nor uses a proxy, so an endpoint cannot send a delivery on to an address it could not register.
+*/
+var deliveryClient = &http.Client{
+	Timeout: deliveryTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   deliveryTimeout,
+			KeepAlive: 30 * time.Second,
+			Control:   refuseBlockedAddresses,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   deliveryTimeout,
+		ExpectContinueTimeout: time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// The JSON body sent to webhooks.
+type payload struct {
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+// The data of image.deleted events.
+type ImageDeletedData struct {
+	ImageID string `json:"imageID"`
+}
+
+// The data of image.liked events.
+type ImageLikedData struct {
+	ImageID string `json:"imageID"`
+	UserID  string `json:"userid"`
+}
+
+// The data of acl.changed events.
+type ACLChangedData struct {
+	ImageID       string   `json:"imageID"`
+	Added         []string `json:"added"`
+	Removed       []string `json:"removed"`
+	AddedGroups   []string `json:"addedGroups"`
+	RemovedGroups []string `json:"removedGroups"`
+}
+
+/**
+Queues an event about one of the given user's images for every active webhook of the user that subscribes to it, and
+every operator webhook that does. The dispatcher sends the deliveries in the background. Errors are logged, since a
+failed webhook should never fail the action that caused it.
+*/
+func Dispatch(userid string, event string, data interface{}) {
+	channel := make(chan webhookDatabaseResponse)
+
+	go getWebhooksFromDatabase(bson.D{{"userid", userid}, {"events", event}, {"active", true}}, nil, channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		log.Println("could not look up webhooks: " + res.err.Error())
+		return
+	}
+
+	webhooks := append(res.webhooks, operatorWebhooksFor(event)...)
+
+	if len(webhooks) == 0 {
+		return
+	}
+
+	now := time.Now()
+	body, _ := json.Marshal(payload{Event: event, CreatedAt: now, Data: data})
+
+	for _, k := range webhooks {
+		delivery := model.WebhookDelivery{
+			WebhookID:     k.ID,
+			UserID:        userid,
+			Event:         event,
+			Payload:       string(body),
+			Status:        model.WebhookDeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}
+
+		if inserted := database.InsertOne("webhookDeliveries", delivery, nil); inserted.Err != nil {
+			log.Println("could not queue delivery to webhook " + k.ID + ": " + inserted.Err.Error())
+		}
+	}
+}
+
+/**
+Signs a payload with a webhook's secret. The signature is the hex HMAC-SHA256 of the timestamp, a period, and the
+body, so that a captured request cannot be replayed with a new timestamp.
+*/
+func sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/**
+Loads the number of dispatcher workers from WEBHOOK_DISPATCH_WORKERS. Falls back to the default if it is missing or
+invalid.
+*/
+func loadDispatchWorkers() {
+	workersString, exists := os.LookupEnv("WEBHOOK_DISPATCH_WORKERS")
+
+	if !exists {
+		return
+	}
+
+	workers, err := strconv.Atoi(workersString)
+
+	if err != nil || workers <= 0 {
+		log.Println("invalid WEBHOOK_DISPATCH_WORKERS; using default")
+		return
+	}
+
+	dispatchWorkers = workers
+}
+
+/**
+Starts the background dispatcher, which sends queued deliveries every few seconds. Failed deliveries are retried with
+exponential backoff. Deliveries are stored, so those still queued when the server stops are sent after it restarts.
+*/
+func StartWebhookDispatcher() {
+	loadDispatchWorkers()
+	loadOperatorWebhooks()
+
+	go func() {
+		ticker := time.NewTicker(dispatchInterval)
+		defer ticker.Stop()
+
+		for {
+			dispatchDueDeliveries()
+			<-ticker.C
+		}
+	}()
+}
+
+func dispatchDueDeliveries() {
+	filter := bson.D{{"status", model.WebhookDeliveryPending}, {"nextAttemptAt", bson.D{{"$lte", time.Now()}}}}
+	opts := options.Find().SetSort(bson.D{{"nextAttemptAt", 1}}).SetLimit(dispatchBatchSize)
+	channel := make(chan deliveryDatabaseResponse)
+
+	go getDeliveriesFromDatabase(filter, opts, channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		log.Println("could not look up webhook deliveries: " + res.err.Error())
+		return
+	}
+
+	queue := make(chan *model.WebhookDelivery)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < dispatchWorkers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			// Each delivery is claimed when a worker picks it up, so deliveries waiting for a worker stay free for other
+			// dispatchers.
+			for k := range queue {
+				if claimDelivery(k) {
+					attemptDelivery(k)
+				}
+			}
+		}()
+	}
+
+	for _, k := range res.deliveries {
+		queue <- k
+	}
+
+	close(queue)
+	wg.Wait()
+}
+
+/**
+Claims a due delivery by moving its next attempt past claimTimeout, so that other dispatchers skip it. The new next
+attempt is kept in the delivery, to renew the claim with. Returns false if another dispatcher claimed it first.
+*/
+func claimDelivery(delivery *model.WebhookDelivery) bool {
+	hex, _ := primitive.ObjectIDFromHex(delivery.ID)
+	filter := bson.D{
+		{"_id", hex},
+		{"status", model.WebhookDeliveryPending},
+		{"nextAttemptAt", bson.D{{"$lte", time.Now()}}},
+	}
+
+	return moveClaim(delivery, filter)
+}
+
+/**
+Renews this dispatcher's claim on a delivery right before it is sent, so that the whole claimTimeout is left for
+sending it. Returns false if the claim ran out and another dispatcher claimed the delivery since.
+*/
+func renewClaim(delivery *model.WebhookDelivery) bool {
+	hex, _ := primitive.ObjectIDFromHex(delivery.ID)
+	filter := bson.D{
+		{"_id", hex},
+		{"status", model.WebhookDeliveryPending},
+		{"nextAttemptAt", delivery.NextAttemptAt},
+	}
+
+	return moveClaim(delivery, filter)
+}
+
+func moveClaim(delivery *model.WebhookDelivery, filter bson.D) bool {
+	// Stored times only keep milliseconds, so the claim is truncated to match the stored value when it is renewed.
+	claimedUntil := time.Now().Add(claimTimeout).Truncate(time.Millisecond)
+	update := bson.D{{"$set", bson.D{{"nextAttemptAt", claimedUntil}}}}
+
+	res := database.UpdateOne("webhookDeliveries", filter, update, nil)
+
+	if res.Err != nil {
+		log.Println("could not claim webhook delivery " + delivery.ID + ": " + res.Err.Error())
+		return false
+	}
+
+	if res.Modified == 0 {
+		return false
+	}
+
+	delivery.NextAttemptAt = claimedUntil
+
+	return true
+}
+
+// The wait before the given retry: baseRetryDelay, doubled for every earlier failed attempt.
+func retryDelay(attempts int) time.Duration {
+	delay := baseRetryDelay
+
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+
+	return delay
+}
+
+// Sends a claimed delivery once, and records the outcome.
+func attemptDelivery(delivery *model.WebhookDelivery) {
+	webhook, findErr := getDeliveryWebhook(delivery)
+
+	if findErr != nil {
+		log.Println("could not look up webhook " + delivery.WebhookID + ": " + findErr.Error())
+		return
+	}
+
+	now := time.Now()
+	set := bson.D{{"lastAttemptAt", now}}
+
+	if webhook == nil || !webhook.Active {
+		set = append(set, bson.E{Key: "status", Value: model.WebhookDeliveryFailed}, bson.E{Key: "lastError", Value: "webhook removed or deactivated"})
+		recordAttempt(delivery.ID, set, false)
+		return
+	}
+
+	if !renewClaim(delivery) {
+		return
+	}
+
+	statusCode, err := send(webhook, delivery)
+
+	recordAttempt(delivery.ID, append(set, attemptOutcome(delivery.Attempts+1, statusCode, err, now)...), true)
+}
+
+/**
+Works out the fields to set on a delivery after it was sent: delivered if the send succeeded, and otherwise either
+scheduled for a retry or, after maxDeliveryAttempts, failed.
+*/
+func attemptOutcome(attempts int, statusCode int, err error, now time.Time) bson.D {
+	set := bson.D{}
+
+	if statusCode != 0 {
+		set = append(set, bson.E{Key: "lastStatusCode", Value: statusCode})
+	}
+
+	if err == nil {
+		return append(set, bson.E{Key: "status", Value: model.WebhookDeliveryDelivered}, bson.E{Key: "deliveredAt", Value: now})
+	}
+
+	set = append(set, bson.E{Key: "lastError", Value: err.Error()})
+
+	if attempts >= maxDeliveryAttempts {
+		return append(set, bson.E{Key: "status", Value: model.WebhookDeliveryFailed})
+	}
+
+	return append(set, bson.E{Key: "nextAttemptAt", Value: now.Add(retryDelay(attempts))})
+}
+
+// Gets the webhook a delivery is for, or nil if it was removed.
+func getDeliveryWebhook(delivery *model.WebhookDelivery) (*model.Webhook, error) {
+	if isOperatorWebhook(delivery.WebhookID) {
+		return getOperatorWebhook(delivery.WebhookID), nil
+	}
+
+	webhookID, _ := primitive.ObjectIDFromHex(delivery.WebhookID)
+	channel := make(chan webhookDatabaseResponse)
+
+	go getOwnWebhook(delivery.UserID, webhookID, channel)
+
+	found := <-channel
+
+	if found.err != nil || len(found.webhooks) == 0 {
+		return nil, found.err
+	}
+
+	return found.webhooks[0], nil
+}
+
+func recordAttempt(deliveryID string, set bson.D, attempted bool) {
+	hex, _ := primitive.ObjectIDFromHex(deliveryID)
+	update := bson.D{{"$set", set}}
+
+	if attempted {
+		update = append(update, bson.E{Key: "$inc", Value: bson.D{{"attempts", 1}}})
+	}
+
+	if res := database.UpdateOne("webhookDeliveries", bson.D{{"_id", hex}}, update, nil); res.Err != nil {
+		log.Println("could not record webhook delivery " + deliveryID + ": " + res.Err.Error())
+	}
+}
+
+/**
+Posts a delivery's payload to its webhook. Any 2xx response counts as delivered, and anything else, including a
+redirect, as failed.
+
+Returns the response status code (0 if there was no response), and an error if the delivery failed.
+*/
+func send(webhook *model.Webhook, delivery *model.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", delivery.ID)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", sign(webhook.Secret, timestamp, body))
+
+	client := deliveryClient
+
+	if isOperatorWebhook(webhook.ID) {
+		client = operatorClient
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return resp.StatusCode, nil
+	}
+
+	// The body of a redirect is not kept, as it may come from wherever the endpoint tried to send the delivery on to.
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		return resp.StatusCode, errors.New("endpoint responded " + resp.Status + "; redirects are not followed")
+	}
+
+	snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxLoggedResponseBytes))
+
+	return resp.StatusCode, errors.New("endpoint responded " + resp.Status + ": " + string(snippet))
+}
@@ -0,0 +1,233 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/kilowatt-/ImageRepository/model"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Lets deliveries reach test servers, which listen on the loopback address, until the test ends.
+func allowLoopback(t *testing.T) {
+	blocked := isBlockedIP
+	isBlockedIP = func(net.IP) bool { return false }
+
+	t.Cleanup(func() { isBlockedIP = blocked })
+}
+
+// Checks a request's signature the way the README tells receivers to.
+func verifySignature(secret string, r *http.Request, body []byte) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(r.Header.Get("X-Webhook-Timestamp") + "."))
+	mac.Write(body)
+
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	return hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Webhook-Signature")))
+}
+
+func testDelivery() *model.WebhookDelivery {
+	return &model.WebhookDelivery{
+		ID:      "5f8b0c0e1c9d440000a1b2c3",
+		Event:   model.WebhookEventImageLiked,
+		Payload: `{"event":"image.liked","data":{"imageID":"1","userid":"2"}}`,
+	}
+}
+
+func TestSign(t *testing.T) {
+	signature := sign("secret", "1600000000", []byte(`{"event":"image.created"}`))
+
+	if !strings.HasPrefix(signature, "sha256=") {
+		t.Fatalf("signature %q does not start with sha256=", signature)
+	}
+
+	if digest := strings.TrimPrefix(signature, "sha256="); len(digest) != 64 {
+		t.Fatalf("digest %q is not 64 hex digits", digest)
+	} else if _, err := hex.DecodeString(digest); err != nil {
+		t.Fatalf("digest %q is not hex: %v", digest, err)
+	}
+
+	if other := sign("secret", "1600000001", []byte(`{"event":"image.created"}`)); other == signature {
+		t.Fatal("signature does not depend on the timestamp")
+	}
+
+	if other := sign("other", "1600000000", []byte(`{"event":"image.created"}`)); other == signature {
+		t.Fatal("signature does not depend on the secret")
+	}
+}
+
+func TestSendIsVerifiedByReceiver(t *testing.T) {
+	allowLoopback(t)
+
+	webhook := &model.Webhook{Secret: "secret"}
+	delivery := testDelivery()
+	received := make(chan bool, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if r.Header.Get("X-Webhook-Event") != delivery.Event || r.Header.Get("X-Webhook-Delivery") != delivery.ID {
+			t.Errorf("unexpected event headers: %v", r.Header)
+		}
+
+		if string(body) != delivery.Payload {
+			t.Errorf("body %q is not the payload", body)
+		}
+
+		received <- verifySignature(webhook.Secret, r, body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	webhook.URL = server.URL
+
+	statusCode, err := send(webhook, delivery)
+
+	if err != nil || statusCode != http.StatusNoContent {
+		t.Fatalf("send returned %d, %v; want 204 and no error", statusCode, err)
+	}
+
+	if !<-received {
+		t.Fatal("receiver could not verify the signature")
+	}
+}
+
+func TestSendFailsOnNon2xx(t *testing.T) {
+	allowLoopback(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("database down"))
+	}))
+	defer server.Close()
+
+	statusCode, err := send(&model.Webhook{URL: server.URL, Secret: "secret"}, testDelivery())
+
+	if statusCode != http.StatusInternalServerError {
+		t.Fatalf("send returned status %d; want 500", statusCode)
+	}
+
+	if err == nil || !strings.Contains(err.Error(), "database down") {
+		t.Fatalf("send returned error %v; want one with the response body", err)
+	}
+}
+
+func TestSendDoesNotFollowRedirects(t *testing.T) {
+	allowLoopback(t)
+
+	followed := false
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		followed = true
+	}))
+	defer target.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusFound)
+	}))
+	defer server.Close()
+
+	statusCode, err := send(&model.Webhook{URL: server.URL, Secret: "secret"}, testDelivery())
+
+	if statusCode != http.StatusFound || err == nil {
+		t.Fatalf("send returned %d, %v; want 302 and an error", statusCode, err)
+	}
+
+	if followed {
+		t.Fatal("send followed the redirect")
+	}
+
+	if strings.Contains(err.Error(), "<a href") {
+		t.Fatalf("error %q keeps the redirect's body", err)
+	}
+}
+
+func TestSendRefusesBlockedAddresses(t *testing.T) {
+	reached := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer server.Close()
+
+	statusCode, err := send(&model.Webhook{URL: server.URL, Secret: "secret"}, testDelivery())
+
+	if statusCode != 0 || err == nil {
+		t.Fatalf("send returned %d, %v; want 0 and an error", statusCode, err)
+	}
+
+	if reached {
+		t.Fatal("send connected to a loopback address")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{4, 4 * time.Minute},
+		{10, 256 * time.Minute},
+		{11, maxRetryDelay},
+		{100, maxRetryDelay},
+	}
+
+	for _, k := range tests {
+		if got := retryDelay(k.attempts); got != k.want {
+			t.Errorf("retryDelay(%d) = %v; want %v", k.attempts, got, k.want)
+		}
+	}
+}
+
+// Gets a field of an outcome, or nil if it is not set.
+func outcomeField(attempts int, statusCode int, err error, now time.Time, key string) interface{} {
+	for _, k := range attemptOutcome(attempts, statusCode, err, now) {
+		if k.Key == key {
+			return k.Value
+		}
+	}
+
+	return nil
+}
+
+func TestAttemptOutcome(t *testing.T) {
+	now := time.Now()
+	failed := errors.New("endpoint responded 500 Internal Server Error")
+
+	if status := outcomeField(1, http.StatusOK, nil, now, "status"); status != model.WebhookDeliveryDelivered {
+		t.Errorf("successful attempt has status %v; want delivered", status)
+	}
+
+	for attempts := 1; attempts < maxDeliveryAttempts; attempts++ {
+		if status := outcomeField(attempts, http.StatusInternalServerError, failed, now, "status"); status != nil {
+			t.Errorf("failed attempt %d sets status %v; want it left pending", attempts, status)
+		}
+
+		if next := outcomeField(attempts, http.StatusInternalServerError, failed, now, "nextAttemptAt"); next != now.Add(retryDelay(attempts)) {
+			t.Errorf("failed attempt %d retries at %v; want %v", attempts, next, now.Add(retryDelay(attempts)))
+		}
+	}
+
+	if status := outcomeField(maxDeliveryAttempts, 0, failed, now, "status"); status != model.WebhookDeliveryFailed {
+		t.Errorf("attempt %d has status %v; want failed", maxDeliveryAttempts, status)
+	}
+
+	if next := outcomeField(maxDeliveryAttempts, 0, failed, now, "nextAttemptAt"); next != nil {
+		t.Errorf("last attempt schedules a retry at %v", next)
+	}
+
+	if code := outcomeField(maxDeliveryAttempts, 0, failed, now, "lastStatusCode"); code != nil {
+		t.Errorf("attempt without a response sets lastStatusCode %v", code)
+	}
+}
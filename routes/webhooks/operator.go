@@ -0,0 +1,129 @@
+package webhooks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/kilowatt-/ImageRepository/model"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Operator webhook IDs start with this, so they are never mistaken for the ObjectIDs of users' webhooks.
+const operatorWebhookPrefix = "operator-"
+
+// The operator's webhooks, from the environment. Sent the events about every user's images.
+var operatorWebhooks = []*model.Webhook{}
+
+/**
+Sends deliveries to operator webhooks. The operator configures these endpoints, so unlike deliveryClient it may
+connect to private addresses, but it does not follow redirects either.
+*/
+var operatorClient = &http.Client{
+	Timeout: deliveryTimeout,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+/**
+Loads the operator's webhooks from OPERATOR_WEBHOOK_URLS, a comma-separated list of URLs, signed with
+OPERATOR_WEBHOOK_SECRET. OPERATOR_WEBHOOK_EVENTS optionally limits the events they are sent, also comma-separated;
+by default they are sent every event. Invalid URLs and events are logged and skipped.
+
+Each webhook's ID is derived from its URL, so queued deliveries still find their webhook after a restart.
+*/
+func loadOperatorWebhooks() {
+	urlsString, exists := os.LookupEnv("OPERATOR_WEBHOOK_URLS")
+
+	if !exists || strings.TrimSpace(urlsString) == "" {
+		return
+	}
+
+	secret, secretExists := os.LookupEnv("OPERATOR_WEBHOOK_SECRET")
+
+	if !secretExists || secret == "" {
+		log.Println("OPERATOR_WEBHOOK_SECRET is not set; operator webhooks are disabled")
+		return
+	}
+
+	events := []string{}
+
+	for k := range supportedEvents {
+		events = append(events, k)
+	}
+
+	if eventsString, eventsExist := os.LookupEnv("OPERATOR_WEBHOOK_EVENTS"); eventsExist && strings.TrimSpace(eventsString) != "" {
+		events = []string{}
+
+		for _, k := range strings.Split(eventsString, ",") {
+			event := strings.TrimSpace(k)
+
+			if !supportedEvents[event] {
+				log.Println("unsupported event in OPERATOR_WEBHOOK_EVENTS: " + event)
+				continue
+			}
+
+			events = append(events, event)
+		}
+	}
+
+	webhooks := []*model.Webhook{}
+
+	for _, k := range strings.Split(urlsString, ",") {
+		rawURL := strings.TrimSpace(k)
+		parsed, err := url.Parse(rawURL)
+
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+			log.Println("invalid URL in OPERATOR_WEBHOOK_URLS: " + rawURL)
+			continue
+		}
+
+		sum := sha256.Sum256([]byte(rawURL))
+
+		webhooks = append(webhooks, &model.Webhook{
+			ID:        operatorWebhookPrefix + hex.EncodeToString(sum[:8]),
+			URL:       rawURL,
+			Events:    events,
+			Secret:    secret,
+			Active:    true,
+			CreatedAt: time.Now(),
+		})
+	}
+
+	operatorWebhooks = webhooks
+}
+
+func isOperatorWebhook(webhookID string) bool {
+	return strings.HasPrefix(webhookID, operatorWebhookPrefix)
+}
+
+// Gets the operator webhooks that subscribe to an event.
+func operatorWebhooksFor(event string) []*model.Webhook {
+	subscribed := []*model.Webhook{}
+
+	for _, k := range operatorWebhooks {
+		for _, e := range k.Events {
+			if e == event {
+				subscribed = append(subscribed, k)
+				break
+			}
+		}
+	}
+
+	return subscribed
+}
+
+// Gets an operator webhook by its ID, or nil if it is no longer configured.
+func getOperatorWebhook(webhookID string) *model.Webhook {
+	for _, k := range operatorWebhooks {
+		if k.ID == webhookID {
+			return k
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,473 @@
+package webhooks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/kilowatt-/ImageRepository/database"
+	"github.com/kilowatt-/ImageRepository/model"
+	"github.com/kilowatt-/ImageRepository/routes/common"
+	"github.com/kilowatt-/ImageRepository/routes/middleware"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const webhookNotFound = "webhook not found"
+
+// Most webhooks one user can register.
+const maxWebhooksPerUser = 10
+
+const defaultDeliveryLimit = 20
+const maxDeliveryLimit = 100
+
+var supportedEvents = map[string]bool{
+	model.WebhookEventImageCreated: true,
+	model.WebhookEventImageDeleted: true,
+	model.WebhookEventImageLiked:   true,
+	model.WebhookEventACLChanged:   true,
+}
+
+// The JSON body of the webhook endpoints. Each endpoint documents which fields it uses.
+type webhookBody struct {
+	ID     string    `json:"_id,omitempty"`
+	URL    *string   `json:"url,omitempty"`
+	Events *[]string `json:"events,omitempty"`
+	Active *bool     `json:"active,omitempty"`
+}
+
+type deliveryPage struct {
+	Deliveries []*model.WebhookDelivery `json:"deliveries"`
+	NextCursor string                   `json:"nextCursor,omitempty"`
+}
+
+// Checks that a webhook URL is an absolute http or https URL whose host resolves only to public addresses.
+func validateURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+
+	return checkHost(parsed.Hostname())
+}
+
+// Checks that events is a non-empty list of supported events, and removes duplicates.
+func validateEvents(events []string) ([]string, error) {
+	seen := make(map[string]bool)
+	validated := []string{}
+
+	for _, k := range events {
+		if !supportedEvents[k] {
+			return nil, errors.New("unsupported event: " + k)
+		}
+
+		if !seen[k] {
+			seen[k] = true
+			validated = append(validated, k)
+		}
+	}
+
+	if len(validated) == 0 {
+		return nil, errors.New("at least one event must be passed in")
+	}
+
+	return validated, nil
+}
+
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+/**
+	[GET]
+
+	Gets the user's webhooks. Their secrets are left out.
+
+	Returns: (application/json)
+		- 200: The webhooks.
+		- 500: Internal server error.
+*/
+func getWebhooks(w http.ResponseWriter, r *http.Request) {
+	channel := make(chan webhookDatabaseResponse)
+
+	go getWebhooksFromDatabase(bson.D{{"userid", middleware.GetUserIDFromToken(r)}}, nil, channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		log.Println(res.err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	for _, k := range res.webhooks {
+		k.Secret = ""
+	}
+
+	jsonResponse, _ := json.Marshal(res.webhooks)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonResponse)
+}
+
+/**
+	[POST]
+
+	Registers a webhook that is sent the given events about the user's images.
+
+	JSON body parameters:
+		- url: the absolute http or https URL that events are posted to. Its host must resolve to public addresses only.
+		- events: an array of events: image.created, image.deleted, image.liked and/or acl.changed.
+
+	Returns: (application/json)
+		- 200: The webhook, including the secret that its payloads are signed with. The secret is not returned again.
+		- 400: Invalid body, URL or events, or the user already has 10 webhooks.
+		- 500: Internal server error.
+*/
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	body := &webhookBody{}
+
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if body.URL == nil || body.Events == nil {
+		http.Error(w, "url and events must be passed in", http.StatusBadRequest)
+		return
+	}
+
+	if err := validateURL(*body.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, eventsErr := validateEvents(*body.Events)
+
+	if eventsErr != nil {
+		http.Error(w, eventsErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	count, countErr := countWebhooks(uid)
+
+	if countErr != nil {
+		log.Println(countErr)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if count >= maxWebhooksPerUser {
+		http.Error(w, "a user can have at most "+strconv.Itoa(maxWebhooksPerUser)+" webhooks", http.StatusBadRequest)
+		return
+	}
+
+	secret, secretErr := generateSecret()
+
+	if secretErr != nil {
+		log.Println(secretErr)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	webhook := model.Webhook{
+		UserID:    uid,
+		URL:       *body.URL,
+		Events:    events,
+		Secret:    secret,
+		Active:    true,
+		CreatedAt: time.Now(),
+	}
+
+	channel := make(chan *database.InsertResponse)
+
+	go insertWebhook(webhook, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	webhook.ID = res.ID
+
+	jsonResponse, _ := json.Marshal(webhook)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonResponse)
+}
+
+/**
+	[PATCH]
+
+	Edits one of the user's webhooks. Deliveries that are still queued when a webhook is deactivated are given up on.
+
+	JSON body parameters:
+		- _id: the webhook ID.
+		- url: Optional. The new URL.
+		- events: Optional. The new array of events.
+		- active: Optional. false to stop sending events to the webhook, true to start again.
+
+	Returns:
+		- 200: Webhook edited.
+		- 400: Invalid body, ID, URL or events, or nothing to edit.
+		- 404: Webhook not found.
+		- 500: Internal server error.
+*/
+func editWebhook(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	body := &webhookBody{}
+
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hex, hexErr := primitive.ObjectIDFromHex(body.ID)
+
+	if hexErr != nil {
+		http.Error(w, "invalid webhook ID passed in: "+body.ID, http.StatusBadRequest)
+		return
+	}
+
+	set := bson.D{}
+
+	if body.URL != nil {
+		if err := validateURL(*body.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		set = append(set, bson.E{Key: "url", Value: *body.URL})
+	}
+
+	if body.Events != nil {
+		events, err := validateEvents(*body.Events)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		set = append(set, bson.E{Key: "events", Value: events})
+	}
+
+	if body.Active != nil {
+		set = append(set, bson.E{Key: "active", Value: *body.Active})
+	}
+
+	if len(set) == 0 {
+		http.Error(w, "nothing to edit", http.StatusBadRequest)
+		return
+	}
+
+	channel := make(chan *database.UpdateResponse)
+
+	go updateOwnWebhook(uid, hex, set, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if res.Matched == 0 {
+		http.Error(w, webhookNotFound, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+	[DELETE]
+
+	Deletes one of the user's webhooks, along with its delivery log.
+
+	JSON body parameters:
+		- _id: the webhook ID.
+
+	Returns:
+		- 200: Webhook deleted.
+		- 400: Invalid body or ID.
+		- 404: Webhook not found.
+		- 500: Internal server error.
+*/
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	body := &webhookBody{}
+
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hex, hexErr := primitive.ObjectIDFromHex(body.ID)
+
+	if hexErr != nil {
+		http.Error(w, "invalid webhook ID passed in: "+body.ID, http.StatusBadRequest)
+		return
+	}
+
+	channel := make(chan *database.DeleteResponse)
+
+	go deleteOwnWebhook(uid, hex, channel)
+
+	res := <-channel
+
+	if res.Err != nil {
+		log.Println(res.Err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if res.NumberDeleted == 0 {
+		http.Error(w, webhookNotFound, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+	[GET]
+
+	Gets the delivery log of one of the user's webhooks, most recent first. Deliveries are kept for 30 days.
+
+	Accepted query parameters:
+		- id: the webhook ID.
+		- status: Optional. pending/delivered/failed. Only return deliveries with this status.
+		- cursor: Optional. The nextCursor of the previous page.
+		- limit: integer. The number of deliveries to return. Default 20, max 100.
+
+	Returns: (application/json)
+		- 200: The deliveries, each with its payload, status, number of attempts, and the status code and error of the
+		  last attempt, and a nextCursor to get the next page with. nextCursor is left out on the last page.
+		- 400: Invalid ID, status or cursor.
+		- 404: Webhook not found.
+		- 500: Internal server error.
+*/
+func getDeliveries(w http.ResponseWriter, r *http.Request) {
+	uid := middleware.GetUserIDFromToken(r)
+
+	hex, hexErr := primitive.ObjectIDFromHex(r.URL.Query().Get("id"))
+
+	if hexErr != nil {
+		http.Error(w, "invalid webhook ID passed in", http.StatusBadRequest)
+		return
+	}
+
+	filter := bson.D{{"webhookID", hex.Hex()}}
+
+	if status := r.URL.Query().Get("status"); status != "" {
+		if status != model.WebhookDeliveryPending && status != model.WebhookDeliveryDelivered && status != model.WebhookDeliveryFailed {
+			http.Error(w, "invalid status passed in: "+status, http.StatusBadRequest)
+			return
+		}
+
+		filter = append(filter, bson.E{Key: "status", Value: status})
+	}
+
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		cursorHex, cursorErr := primitive.ObjectIDFromHex(cursor)
+
+		if cursorErr != nil {
+			http.Error(w, "invalid cursor passed in: "+cursor, http.StatusBadRequest)
+			return
+		}
+
+		filter = append(filter, bson.E{Key: "_id", Value: bson.D{{"$lt", cursorHex}}})
+	}
+
+	var limit int64 = defaultDeliveryLimit
+
+	if limitQuery := r.URL.Query().Get("limit"); limitQuery != "" {
+		if conv, convErr := strconv.ParseInt(limitQuery, 10, 64); convErr == nil && conv > 0 {
+			limit = conv
+		}
+	}
+
+	if limit > maxDeliveryLimit {
+		limit = maxDeliveryLimit
+	}
+
+	webhookChannel := make(chan webhookDatabaseResponse)
+
+	go getOwnWebhook(uid, hex, webhookChannel)
+
+	found := <-webhookChannel
+
+	if found.err != nil {
+		log.Println(found.err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	if len(found.webhooks) == 0 {
+		http.Error(w, webhookNotFound, http.StatusNotFound)
+		return
+	}
+
+	// Fetch one delivery more than the limit, to find out whether there is a next page.
+	opts := options.Find().SetSort(bson.D{{"_id", -1}}).SetLimit(limit + 1)
+	channel := make(chan deliveryDatabaseResponse)
+
+	go getDeliveriesFromDatabase(filter, opts, channel)
+
+	res := <-channel
+
+	if res.err != nil {
+		log.Println(res.err)
+		common.SendInternalServerError(w)
+		return
+	}
+
+	page := deliveryPage{Deliveries: res.deliveries}
+
+	if int64(len(page.Deliveries)) > limit {
+		page.Deliveries = page.Deliveries[:limit]
+		page.NextCursor = page.Deliveries[limit-1].ID
+	}
+
+	jsonResponse, _ := json.Marshal(page)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonResponse)
+}
+
+func ServeWebhookRoutes(r *mux.Router) {
+	createWebhookIndexes()
+
+	r.Use(middleware.JWTMiddleware)
+
+	r.HandleFunc("/getWebhooks", getWebhooks).Methods("GET")
+	r.HandleFunc("/getDeliveries", getDeliveries).Methods("GET")
+	r.HandleFunc("/createWebhook", createWebhook).Methods("POST")
+	r.HandleFunc("/editWebhook", editWebhook).Methods("PATCH")
+	r.HandleFunc("/deleteWebhook", deleteWebhook).Methods("DELETE")
+}
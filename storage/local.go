@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const localTempPrefix = ".tmp-"
+
+/**
+Stores objects as plain files under a root directory. Intended for development and CI.
+
+Presigned uploads go to uploadURL, an endpoint on this server that checks the signature with VerifySignedPut and then
+stores the request body.
+*/
+type localStore struct {
+	root       string
+	uploadURL  string
+	signingKey []byte
+}
+
+func newLocalStore(root string, uploadURL string, signingKey []byte) (*localStore, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	return &localStore{root: root, uploadURL: uploadURL, signingKey: signingKey}, nil
+}
+
+// Maps a key to its file path, rejecting keys that would escape the root directory.
+func (l *localStore) pathForKey(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+
+	if key == "" || cleaned == "/" || cleaned[1:] != key || strings.Contains(key, localTempPrefix) {
+		return "", errors.New("invalid object key: " + key)
+	}
+
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+// The local backend does not persist content types, so they are sniffed from the first bytes of the file.
+func sniffContentType(file *os.File) (string, error) {
+	header := make([]byte, 512)
+
+	n, err := file.Read(header)
+
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return http.DetectContentType(header[:n]), nil
+}
+
+func (l *localStore) Put(key string, body io.Reader, contentType string) error {
+	filePath, err := l.pathForKey(key)
+
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(filePath)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see a partially written object.
+	tmp, err := ioutil.TempFile(dir, localTempPrefix)
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filePath)
+}
+
+// Signs a key and expiry time.
+func (l *localStore) sign(key string, expires string) string {
+	mac := hmac.New(sha256.New, l.signingKey)
+	mac.Write([]byte(key + "\n" + expires))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (l *localStore) PresignPut(key string, contentType string, lifetime time.Duration) (string, error) {
+	if _, err := l.pathForKey(key); err != nil {
+		return "", err
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(lifetime).Unix(), 10)
+
+	query := url.Values{}
+	query.Set("key", key)
+	query.Set("expires", expires)
+	query.Set("signature", l.sign(key, expires))
+
+	return l.uploadURL + "?" + query.Encode(), nil
+}
+
+/**
+Checks the query parameters of an upload URL issued by the local backend's PresignPut.
+
+Returns the key that may be uploaded, or ErrInvalidSignature if the URL was not issued by this server or has expired.
+*/
+func VerifySignedPut(query url.Values) (string, error) {
+	local, ok := store.(*localStore)
+
+	if !ok {
+		return "", ErrInvalidSignature
+	}
+
+	key, expires, signature := query.Get("key"), query.Get("expires"), query.Get("signature")
+
+	if !hmac.Equal([]byte(signature), []byte(local.sign(key, expires))) {
+		return "", ErrInvalidSignature
+	}
+
+	expiry, err := strconv.ParseInt(expires, 10, 64)
+
+	if err != nil || time.Now().Unix() > expiry {
+		return "", ErrInvalidSignature
+	}
+
+	return key, nil
+}
+
+func (l *localStore) Get(key string) (*Object, error) {
+	filePath, err := l.pathForKey(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filePath)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	info, err := file.Stat()
+
+	if err == nil && info.IsDir() {
+		err = ErrNotFound
+	}
+
+	var contentType string
+
+	if err == nil {
+		contentType, err = sniffContentType(file)
+	}
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &Object{
+		ObjectInfo: ObjectInfo{
+			Key:          key,
+			Size:         info.Size(),
+			ContentType:  contentType,
+			LastModified: info.ModTime(),
+		},
+		Body: file,
+	}, nil
+}
+
+// Closes the file that a limited reader reads from.
+type limitedFile struct {
+	io.Reader
+	file *os.File
+}
+
+func (l *limitedFile) Close() error {
+	return l.file.Close()
+}
+
+func (l *localStore) GetRange(key string, offset int64, length int64) (*Object, error) {
+	object, err := l.Get(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file := object.Body.(*os.File)
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	object.Body = &limitedFile{Reader: io.LimitReader(file, length), file: file}
+
+	return object, nil
+}
+
+func (l *localStore) Delete(key string) error {
+	filePath, err := l.pathForKey(key)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (l *localStore) Stat(key string) (*ObjectInfo, error) {
+	object, err := l.Get(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	object.Body.Close()
+
+	return &object.ObjectInfo, nil
+}
+
+func (l *localStore) List(prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+
+	err := filepath.Walk(l.root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || strings.HasPrefix(info.Name(), localTempPrefix) {
+			return nil
+		}
+
+		rel, relErr := filepath.Rel(l.root, filePath)
+
+		if relErr != nil {
+			return relErr
+		}
+
+		key := filepath.ToSlash(rel)
+
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{
+				Key:          key,
+				Size:         info.Size(),
+				LastModified: info.ModTime(),
+			})
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
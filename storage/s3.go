@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type s3Store struct {
+	bucket   string
+	client   *s3.S3
+	uploader *s3manager.Uploader
+}
+
+/**
+Initializes the AWS session, S3 client and S3 uploader for the given bucket.
+*/
+func newS3Store(bucket string) *s3Store {
+	awsSession := session.Must(session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable}))
+
+	return &s3Store{
+		bucket:   bucket,
+		client:   s3.New(awsSession),
+		uploader: s3manager.NewUploader(awsSession),
+	}
+}
+
+// Maps S3's missing-object errors to ErrNotFound.
+func translateS3Error(err error) error {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return ErrNotFound
+		}
+	}
+
+	return err
+}
+
+func (s *s3Store) Put(key string, body io.Reader, contentType string) error {
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+
+	_, err := s.uploader.Upload(input)
+
+	return err
+}
+
+func (s *s3Store) PresignPut(key string, contentType string, lifetime time.Duration) (string, error) {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+
+	// The content type is part of the signature, so the client must send the same Content-Type header.
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+
+	request, _ := s.client.PutObjectRequest(input)
+
+	return request.Presign(lifetime)
+}
+
+func (s *s3Store) Get(key string) (*Object, error) {
+	output, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+
+	if err != nil {
+		return nil, translateS3Error(err)
+	}
+
+	return &Object{
+		ObjectInfo: ObjectInfo{
+			Key:          key,
+			Size:         aws.Int64Value(output.ContentLength),
+			ContentType:  aws.StringValue(output.ContentType),
+			LastModified: aws.TimeValue(output.LastModified),
+		},
+		Body: output.Body,
+	}, nil
+}
+
+func (s *s3Store) GetRange(key string, offset int64, length int64) (*Object, error) {
+	output, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String("bytes=" + strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(offset+length-1, 10)),
+	})
+
+	if err != nil {
+		return nil, translateS3Error(err)
+	}
+
+	// The Content-Range header ("bytes first-last/total") carries the size of the whole object.
+	size := aws.Int64Value(output.ContentLength)
+	contentRange := aws.StringValue(output.ContentRange)
+
+	if slash := strings.LastIndex(contentRange, "/"); slash >= 0 {
+		if total, convErr := strconv.ParseInt(contentRange[slash+1:], 10, 64); convErr == nil {
+			size = total
+		}
+	}
+
+	return &Object{
+		ObjectInfo: ObjectInfo{
+			Key:          key,
+			Size:         size,
+			ContentType:  aws.StringValue(output.ContentType),
+			LastModified: aws.TimeValue(output.LastModified),
+		},
+		Body: output.Body,
+	}, nil
+}
+
+func (s *s3Store) Delete(key string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+
+	return translateS3Error(err)
+}
+
+func (s *s3Store) Stat(key string) (*ObjectInfo, error) {
+	output, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+
+	if err != nil {
+		return nil, translateS3Error(err)
+	}
+
+	return &ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(output.ContentLength),
+		ContentType:  aws.StringValue(output.ContentType),
+		LastModified: aws.TimeValue(output.LastModified),
+	}, nil
+}
+
+func (s *s3Store) List(prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+
+	err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, k := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.StringValue(k.Key),
+				Size:         aws.Int64Value(k.Size),
+				LastModified: aws.TimeValue(k.LastModified),
+			})
+		}
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
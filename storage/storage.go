@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const S3Backend = "s3"
+const LocalBackend = "local"
+
+const defaultBucketName = "imgrepository-cdn"
+const defaultLocalDirectory = "./data/blobs"
+const defaultLocalUploadURL = "http://localhost:3000/images/uploadObject"
+
+var ErrNotFound = errors.New("object not found")
+var ErrInvalidSignature = errors.New("invalid or expired upload signature")
+var errNotInitialized = errors.New("blob storage not initialized yet")
+
+// Metadata about a stored object.
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"contentType,omitempty"`
+	LastModified time.Time `json:"lastModified,omitempty"`
+}
+
+// A stored object. The caller is responsible for closing Body.
+type Object struct {
+	ObjectInfo
+	Body io.ReadCloser
+}
+
+/**
+Store is implemented by every blob storage backend.
+
+Keys are slash-separated strings; implementations must return ErrNotFound when a key does not exist, except from
+Delete, which succeeds for a missing key so that deletes can be safely retried.
+
+PresignPut returns a URL that anyone holding it can upload the object to with an HTTP PUT, until the URL expires.
+
+GetRange returns length bytes of the object starting at offset, without reading the rest of it. The returned
+ObjectInfo describes the whole object.
+*/
+type Store interface {
+	Put(key string, body io.Reader, contentType string) error
+	PresignPut(key string, contentType string, lifetime time.Duration) (string, error)
+	Get(key string) (*Object, error)
+	GetRange(key string, offset int64, length int64) (*Object, error)
+	Delete(key string) error
+	Stat(key string) (*ObjectInfo, error)
+	List(prefix string) ([]ObjectInfo, error)
+}
+
+var store Store
+
+/**
+Returns the storage backend selected by the STORAGE_BACKEND environment variable. Defaults to S3.
+*/
+func BackendFromEnvironment() string {
+	if backend, exists := os.LookupEnv("STORAGE_BACKEND"); exists && backend == LocalBackend {
+		return LocalBackend
+	}
+
+	return S3Backend
+}
+
+/**
+Initializes the given storage backend.
+
+The S3 backend reads the bucket from S3_BUCKET; the local backend stores files under LOCAL_STORAGE_DIR. The local
+backend's upload URLs point at LOCAL_STORAGE_UPLOAD_URL and are signed with LOCAL_STORAGE_SIGNING_KEY, falling back to
+JWT_KEY.
+*/
+func Initialize(backend string) error {
+	switch backend {
+	case LocalBackend:
+		dir, dirExists := os.LookupEnv("LOCAL_STORAGE_DIR")
+
+		if !dirExists {
+			dir = defaultLocalDirectory
+		}
+
+		uploadURL, uploadURLExists := os.LookupEnv("LOCAL_STORAGE_UPLOAD_URL")
+
+		if !uploadURLExists {
+			uploadURL = defaultLocalUploadURL
+		}
+
+		signingKey, signingKeyExists := os.LookupEnv("LOCAL_STORAGE_SIGNING_KEY")
+
+		if !signingKeyExists {
+			signingKey = os.Getenv("JWT_KEY")
+		}
+
+		local, err := newLocalStore(dir, uploadURL, []byte(signingKey))
+
+		if err != nil {
+			return err
+		}
+
+		store = local
+		log.Println("Using local blob storage at " + dir)
+	case S3Backend:
+		bucket, bucketExists := os.LookupEnv("S3_BUCKET")
+
+		if !bucketExists {
+			bucket = defaultBucketName
+		}
+
+		store = newS3Store(bucket)
+		log.Println("Using S3 blob storage in bucket " + bucket)
+	default:
+		return errors.New("unknown storage backend: " + backend)
+	}
+
+	return nil
+}
+
+func Put(key string, body io.Reader, contentType string) error {
+	if store == nil {
+		return errNotInitialized
+	}
+
+	return store.Put(key, body, contentType)
+}
+
+func PresignPut(key string, contentType string, lifetime time.Duration) (string, error) {
+	if store == nil {
+		return "", errNotInitialized
+	}
+
+	return store.PresignPut(key, contentType, lifetime)
+}
+
+func Get(key string) (*Object, error) {
+	if store == nil {
+		return nil, errNotInitialized
+	}
+
+	return store.Get(key)
+}
+
+func GetRange(key string, offset int64, length int64) (*Object, error) {
+	if store == nil {
+		return nil, errNotInitialized
+	}
+
+	return store.GetRange(key, offset, length)
+}
+
+func Delete(key string) error {
+	if store == nil {
+		return errNotInitialized
+	}
+
+	return store.Delete(key)
+}
+
+func Stat(key string) (*ObjectInfo, error) {
+	if store == nil {
+		return nil, errNotInitialized
+	}
+
+	return store.Stat(key)
+}
+
+func List(prefix string) ([]ObjectInfo, error) {
+	if store == nil {
+		return nil, errNotInitialized
+	}
+
+	return store.List(prefix)
+}